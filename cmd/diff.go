@@ -0,0 +1,210 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ollien/hashlink"
+)
+
+// diffArgs holds the arguments for the diff subcommand.
+type diffArgs struct {
+	dirA          string
+	dirB          string
+	numWorkers    int
+	format        string
+	showIdentical bool
+	// manifests holds the checksum file to use in place of hashing a directory, keyed by the cleaned directory path.
+	manifests map[string]string
+	logging   logArgs
+}
+
+// diffStatusNames holds the name of each status in JSON output.
+var diffStatusNames = map[hashlink.DiffStatus]string{
+	hashlink.DiffIdentical: "identical",
+	hashlink.DiffMoved:     "moved",
+	hashlink.DiffModified:  "modified",
+	hashlink.DiffOnlyInA:   "only_in_a",
+	hashlink.DiffOnlyInB:   "only_in_b",
+}
+
+// diffEntryOutput is the JSON representation of a hashlink.DiffEntry.
+type diffEntryOutput struct {
+	Status  string `json:"status"`
+	PathA   string `json:"path_a,omitempty"`
+	PathB   string `json:"path_b,omitempty"`
+	DigestA string `json:"digest_a,omitempty"`
+	DigestB string `json:"digest_b,omitempty"`
+}
+
+// runDiff is the entrypoint for the diff subcommand, which classifies every file in two trees by their contents.
+func runDiff(arguments []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: ./hashlink diff [-j n] [-manifest file]... [-identical] [-format text|json] [-v | -q] [-log-file file [-log-format format]] dir_a dir_b")
+		flags.PrintDefaults()
+	}
+
+	flags.Usage = usage
+	args, err := setupAndValidateDiffArgs(flags, arguments)
+	if err != nil {
+		handleDiffArgsError(err, args, usage)
+		os.Exit(exitUsage)
+	}
+
+	// Only the differences are written to stdout, so that they may be piped elsewhere.
+	runLog.info("Scanning files...")
+	hashesA, hashesB, _, err := getHashes(context.Background(), []string{args.dirA}, []string{args.dirB}, args.numWorkers, args.manifests, nil, hashlink.ErrorPolicy{}, hashlink.RetryPolicy{}, 0)
+	if err != nil {
+		handleError(err)
+		os.Exit(exitScanFailed)
+	}
+
+	entries, err := hashlink.DiffTrees(hashesA, args.dirA, hashesB, args.dirB)
+	if err != nil {
+		handleError(err)
+		os.Exit(exitFailed)
+	}
+
+	output, err := formatDiffEntries(entries, args.format, args.showIdentical)
+	if err != nil {
+		handleError(err)
+		os.Exit(exitFailed)
+	}
+
+	fmt.Println(output)
+}
+
+func setupAndValidateDiffArgs(flags *flag.FlagSet, arguments []string) (diffArgs, error) {
+	args := diffArgs{}
+	manifestPaths := stringSliceFlag{}
+	flags.IntVar(&args.numWorkers, "j", 1, "specify a number of workers")
+	flags.StringVar(&args.format, "format", textFormat, "the output format: text or json")
+	flags.BoolVar(&args.showIdentical, "identical", false, "list files that are identical in both trees, rather than only counting them")
+	flags.Var(&manifestPaths, "manifest", "use a checksum file (e.g. SHA256SUMS) in place of hashing the directory containing it; may be repeated")
+	registerLogFlags(flags, &args.logging)
+	// ExitOnError is set, so we will never get an error back.
+	_ = flags.Parse(arguments)
+	if args.numWorkers <= 0 {
+		return args, errInvalidNumberOfWorkers
+	} else if args.format != textFormat && args.format != jsonFormat {
+		return args, errInvalidOutputFormat
+	} else if flags.NArg() != 2 {
+		return args, errWrongNumberOfArguments
+	}
+
+	args.logging.errorFormat = args.format
+	err := setupLogging(args.logging)
+	if err != nil {
+		return args, err
+	}
+
+	args.dirA = flags.Arg(0)
+	args.dirB = flags.Arg(1)
+	err = assertDirsExist(args.dirA, args.dirB)
+	if err != nil {
+		return args, err
+	}
+
+	args.manifests, err = makeManifestMap(manifestPaths, args.dirA, args.dirB)
+	if err != nil {
+		return args, err
+	}
+
+	return args, nil
+}
+
+// handleDiffArgsError prints an appropriate message for an error produced by setupAndValidateDiffArgs, followed by
+// the usage.
+func handleDiffArgsError(err error, args diffArgs, usage func()) {
+	if err == errInvalidNumberOfWorkers {
+		fmt.Fprintf(os.Stderr, "Invalid number of workers (-j %d). Must be >= 1\n", args.numWorkers)
+	} else if err == errInvalidOutputFormat {
+		fmt.Fprintf(os.Stderr, "Invalid output format (%s). Must be one of text or json\n", args.format)
+	} else if err == errInvalidLogFormat {
+		fmt.Fprintf(os.Stderr, "Invalid log format (%s). Must be one of text or json\n", args.logging.logFormat)
+	} else if err != errWrongNumberOfArguments {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	usage()
+}
+
+// formatDiffEntries produces the output for the given entries in the given format. Identical entries are only
+// included if showIdentical is set, though they are always counted in the text summary.
+func formatDiffEntries(entries []hashlink.DiffEntry, format string, showIdentical bool) (string, error) {
+	shownEntries := []hashlink.DiffEntry{}
+	counts := map[hashlink.DiffStatus]int{}
+	for _, entry := range entries {
+		counts[entry.Status]++
+		if entry.Status != hashlink.DiffIdentical || showIdentical {
+			shownEntries = append(shownEntries, entry)
+		}
+	}
+
+	if format == jsonFormat {
+		outputEntries := make([]diffEntryOutput, len(shownEntries))
+		for i, entry := range shownEntries {
+			outputEntries[i] = diffEntryOutput{
+				Status:  diffStatusNames[entry.Status],
+				PathA:   entry.PathA,
+				PathB:   entry.PathB,
+				DigestA: entry.DigestA,
+				DigestB: entry.DigestB,
+			}
+		}
+
+		return makeIndentedJSONOutput(outputEntries)
+	}
+
+	output := bytes.Buffer{}
+	for _, entry := range shownEntries {
+		switch entry.Status {
+		case hashlink.DiffIdentical:
+			fmt.Fprintf(&output, "=  %s\n", entry.PathA)
+		case hashlink.DiffMoved:
+			fmt.Fprintf(&output, "R  %s -> %s\n", entry.PathA, entry.PathB)
+		case hashlink.DiffModified:
+			fmt.Fprintf(&output, "M  %s\n", entry.PathA)
+		case hashlink.DiffOnlyInA:
+			fmt.Fprintf(&output, "-  %s\n", entry.PathA)
+		case hashlink.DiffOnlyInB:
+			fmt.Fprintf(&output, "+  %s\n", entry.PathB)
+		}
+	}
+
+	if len(shownEntries) > 0 {
+		fmt.Fprintln(&output)
+	}
+
+	fmt.Fprintf(
+		&output,
+		"%d %s, %d %s, %d %s, %d %s, %d %s",
+		counts[hashlink.DiffIdentical], hashlink.DiffIdentical,
+		counts[hashlink.DiffMoved], hashlink.DiffMoved,
+		counts[hashlink.DiffModified], hashlink.DiffModified,
+		counts[hashlink.DiffOnlyInA], hashlink.DiffOnlyInA,
+		counts[hashlink.DiffOnlyInB], hashlink.DiffOnlyInB,
+	)
+
+	return output.String(), nil
+}
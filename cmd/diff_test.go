@@ -0,0 +1,90 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ollien/hashlink"
+	"github.com/stretchr/testify/assert"
+)
+
+type diffTest struct {
+	name string
+	test func(t *testing.T)
+}
+
+func runDiffTestTable(t *testing.T, table []diffTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t)
+		})
+	}
+}
+
+func TestFormatDiffEntries(t *testing.T) {
+	entries := []hashlink.DiffEntry{
+		{Status: hashlink.DiffIdentical, PathA: "a", PathB: "a", DigestA: "1", DigestB: "1"},
+		{Status: hashlink.DiffModified, PathA: "b", PathB: "b", DigestA: "1", DigestB: "2"},
+		{Status: hashlink.DiffOnlyInA, PathA: "c", DigestA: "3"},
+		{Status: hashlink.DiffOnlyInB, PathB: "d", DigestB: "4"},
+		{Status: hashlink.DiffMoved, PathA: "e", PathB: "f/e", DigestA: "5", DigestB: "5"},
+	}
+
+	tests := []diffTest{
+		{
+			name: "text",
+			test: func(t *testing.T) {
+				output, err := formatDiffEntries(entries, textFormat, false)
+				assert.Nil(t, err)
+				assert.Equal(t, "M  b\n-  c\n+  d\nR  e -> f/e\n\n1 identical, 1 moved, 1 modified, 1 only in a, 1 only in b", output)
+			},
+		},
+		{
+			name: "text with identical",
+			test: func(t *testing.T) {
+				output, err := formatDiffEntries(entries[:1], textFormat, true)
+				assert.Nil(t, err)
+				assert.Equal(t, "=  a\n\n1 identical, 0 moved, 0 modified, 0 only in a, 0 only in b", output)
+			},
+		},
+		{
+			name: "json",
+			test: func(t *testing.T) {
+				output, err := formatDiffEntries(entries[2:4], jsonFormat, false)
+				assert.Nil(t, err)
+				parsed := []diffEntryOutput{}
+				assert.Nil(t, json.Unmarshal([]byte(output), &parsed))
+				assert.Equal(t, []diffEntryOutput{
+					{Status: "only_in_a", PathA: "c", DigestA: "3"},
+					{Status: "only_in_b", PathB: "d", DigestB: "4"},
+				}, parsed)
+			},
+		},
+		{
+			name: "json without identical",
+			test: func(t *testing.T) {
+				output, err := formatDiffEntries(entries[:1], jsonFormat, false)
+				assert.Nil(t, err)
+				assert.Equal(t, "[]", output)
+			},
+		},
+	}
+
+	runDiffTestTable(t, tests)
+}
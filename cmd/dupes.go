@@ -0,0 +1,239 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/ollien/hashlink"
+	"github.com/ollien/hashlink/multierror"
+	"golang.org/x/xerrors"
+)
+
+// Orders that duplicate groups can be sorted in.
+const (
+	dupesSortWasted = "wasted"
+	dupesSortSize   = "size"
+	dupesSortPath   = "path"
+)
+
+var errInvalidDupesSort = errors.New("invalid sort order")
+
+// dupesArgs holds the arguments for the dupes subcommand.
+type dupesArgs struct {
+	dirs       []string
+	numWorkers int
+	sortBy     string
+	format     string
+	logging    logArgs
+}
+
+// dupeGroup represents a group of identical files.
+type dupeGroup struct {
+	Digest string   `json:"digest"`
+	Size   int64    `json:"size"`
+	Paths  []string `json:"paths"`
+	// Reclaimable holds the number of bytes that would be freed if every path in the group were linked together.
+	Reclaimable int64 `json:"reclaimable"`
+	// SharesInode is set if at least two of the paths are already links to the same file.
+	SharesInode bool `json:"shares_inode"`
+}
+
+// runDupes is the entrypoint for the dupes subcommand, which lists the groups of identical files within and across
+// the given directories.
+func runDupes(arguments []string) {
+	flags := flag.NewFlagSet("dupes", flag.ExitOnError)
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: ./hashlink dupes [-j n] [-sort wasted|size|path] [-format text|json] [-v | -q] [-log-file file [-log-format format]] dir...")
+		flags.PrintDefaults()
+	}
+
+	flags.Usage = usage
+	args, err := setupAndValidateDupesArgs(flags, arguments)
+	if err != nil {
+		handleDupesArgsError(err, args, usage)
+		os.Exit(exitUsage)
+	}
+
+	// Only the groups are written to stdout, so that they may be piped elsewhere.
+	runLog.info("Scanning files...")
+	hashes, _, _, err := getHashes(context.Background(), args.dirs, nil, args.numWorkers, nil, nil, hashlink.ErrorPolicy{}, hashlink.RetryPolicy{}, 0)
+	if err != nil {
+		handleError(err)
+		os.Exit(exitScanFailed)
+	}
+
+	groups, groupErr := makeDupeGroups(hashlink.FindDuplicateFiles(hashes))
+	sortDupeGroups(groups, args.sortBy)
+	output, err := formatDupeGroups(groups, args.format)
+	if err != nil {
+		handleError(err)
+		os.Exit(exitFailed)
+	}
+
+	fmt.Println(output)
+	if groupErr != nil {
+		handleError(groupErr)
+		os.Exit(exitFileErrors)
+	}
+}
+
+func setupAndValidateDupesArgs(flags *flag.FlagSet, arguments []string) (dupesArgs, error) {
+	args := dupesArgs{}
+	flags.IntVar(&args.numWorkers, "j", 1, "specify a number of workers")
+	flags.StringVar(&args.sortBy, "sort", dupesSortWasted, "the order to list groups in: wasted (most reclaimable first), size (largest files first) or path")
+	flags.StringVar(&args.format, "format", textFormat, "the output format: text or json")
+	registerLogFlags(flags, &args.logging)
+	// ExitOnError is set, so we will never get an error back.
+	_ = flags.Parse(arguments)
+	args.dirs = flags.Args()
+	if args.numWorkers <= 0 {
+		return args, errInvalidNumberOfWorkers
+	} else if args.sortBy != dupesSortWasted && args.sortBy != dupesSortSize && args.sortBy != dupesSortPath {
+		return args, errInvalidDupesSort
+	} else if args.format != textFormat && args.format != jsonFormat {
+		return args, errInvalidOutputFormat
+	} else if len(args.dirs) == 0 {
+		return args, errWrongNumberOfArguments
+	}
+
+	args.logging.errorFormat = args.format
+	err := setupLogging(args.logging)
+	if err != nil {
+		return args, err
+	}
+
+	return args, assertDirsExist(args.dirs...)
+}
+
+// handleDupesArgsError prints an appropriate message for an error produced by setupAndValidateDupesArgs, followed by
+// the usage.
+func handleDupesArgsError(err error, args dupesArgs, usage func()) {
+	if err == errInvalidNumberOfWorkers {
+		fmt.Fprintf(os.Stderr, "Invalid number of workers (-j %d). Must be >= 1\n", args.numWorkers)
+	} else if err == errInvalidDupesSort {
+		fmt.Fprintf(os.Stderr, "Invalid sort order (%s). Must be one of wasted, size or path\n", args.sortBy)
+	} else if err == errInvalidOutputFormat {
+		fmt.Fprintf(os.Stderr, "Invalid output format (%s). Must be one of text or json\n", args.format)
+	} else if err == errInvalidLogFormat {
+		fmt.Fprintf(os.Stderr, "Invalid log format (%s). Must be one of text or json\n", args.logging.logFormat)
+	} else if err != errWrongNumberOfArguments {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	usage()
+}
+
+// makeDupeGroups makes a dupeGroup for each set of duplicates, in the form produced by hashlink.FindDuplicateFiles.
+// Any path that cannot be inspected is left out of its group and an error is returned for it; groups left with fewer
+// than two paths are dropped.
+func makeDupeGroups(duplicates map[string][]string) ([]dupeGroup, error) {
+	groups := make([]dupeGroup, 0, len(duplicates))
+	errors := multierror.NewMultiError()
+	for digest, paths := range duplicates {
+		group := dupeGroup{Digest: digest, Paths: []string{}}
+		// Holds one file from each distinct inode in the group.
+		distinctFiles := []os.FileInfo{}
+		for _, path := range paths {
+			info, err := os.Lstat(path)
+			if err != nil {
+				err = xerrors.Errorf("could not inspect duplicate file (%s): %w", path, err)
+				errors.Append(err)
+				continue
+			}
+
+			group.Paths = append(group.Paths, path)
+			group.Size = info.Size()
+			if containsSameFile(distinctFiles, info) {
+				group.SharesInode = true
+			} else {
+				distinctFiles = append(distinctFiles, info)
+			}
+		}
+
+		if len(group.Paths) < 2 {
+			continue
+		}
+
+		group.Reclaimable = group.Size * int64(len(distinctFiles)-1)
+		groups = append(groups, group)
+	}
+
+	if errors.Len() > 0 {
+		return groups, errors
+	}
+
+	return groups, nil
+}
+
+// containsSameFile checks whether any of files is the same file as info.
+func containsSameFile(files []os.FileInfo, info os.FileInfo) bool {
+	for _, file := range files {
+		if os.SameFile(file, info) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sortDupeGroups sorts groups in the given order. Ties are broken by the first path of each group.
+func sortDupeGroups(groups []dupeGroup, sortBy string) {
+	sort.Slice(groups, func(i, j int) bool {
+		if sortBy == dupesSortWasted && groups[i].Reclaimable != groups[j].Reclaimable {
+			return groups[i].Reclaimable > groups[j].Reclaimable
+		} else if sortBy == dupesSortSize && groups[i].Size != groups[j].Size {
+			return groups[i].Size > groups[j].Size
+		}
+
+		return groups[i].Paths[0] < groups[j].Paths[0]
+	})
+}
+
+// formatDupeGroups produces the output for the given groups in the given format.
+func formatDupeGroups(groups []dupeGroup, format string) (string, error) {
+	if format == jsonFormat {
+		return makeIndentedJSONOutput(groups)
+	}
+
+	output := bytes.Buffer{}
+	totalReclaimable := int64(0)
+	for _, group := range groups {
+		totalReclaimable += group.Reclaimable
+		fmt.Fprintf(&output, "%s  %s each, %s reclaimable", group.Digest, formatSize(group.Size), formatSize(group.Reclaimable))
+		if group.SharesInode {
+			fmt.Fprintf(&output, ", some paths already linked")
+		}
+
+		fmt.Fprintln(&output)
+		for _, path := range group.Paths {
+			fmt.Fprintf(&output, "\t%s\n", path)
+		}
+
+		fmt.Fprintln(&output)
+	}
+
+	fmt.Fprintf(&output, "%d groups of duplicates, %s reclaimable.", len(groups), formatSize(totalReclaimable))
+
+	return output.String(), nil
+}
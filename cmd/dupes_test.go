@@ -0,0 +1,163 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ollien/hashlink/multierror"
+	"github.com/stretchr/testify/assert"
+)
+
+type dupesTest struct {
+	name string
+	test func(t *testing.T)
+}
+
+func runDupesTestTable(t *testing.T, table []dupesTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t)
+		})
+	}
+}
+
+func TestMakeDupeGroups(t *testing.T) {
+	tests := []dupesTest{
+		{
+			name: "separate files",
+			test: func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "hashlink-dupes")
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				defer os.RemoveAll(dir)
+				paths := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")}
+				for _, path := range paths {
+					assert.Nil(t, ioutil.WriteFile(path, []byte("hello"), 0644))
+				}
+
+				groups, err := makeDupeGroups(map[string][]string{"digest": paths})
+				assert.Nil(t, err)
+				assert.Equal(t, []dupeGroup{{Digest: "digest", Size: 5, Paths: paths, Reclaimable: 10}}, groups)
+			},
+		},
+		{
+			name: "already linked",
+			test: func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "hashlink-dupes")
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				defer os.RemoveAll(dir)
+				paths := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")}
+				assert.Nil(t, ioutil.WriteFile(paths[0], []byte("hello"), 0644))
+				assert.Nil(t, os.Link(paths[0], paths[1]))
+				assert.Nil(t, ioutil.WriteFile(paths[2], []byte("hello"), 0644))
+
+				groups, err := makeDupeGroups(map[string][]string{"digest": paths})
+				assert.Nil(t, err)
+				assert.Equal(t, []dupeGroup{{Digest: "digest", Size: 5, Paths: paths, Reclaimable: 5, SharesInode: true}}, groups)
+			},
+		},
+		{
+			name: "missing files",
+			test: func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "hashlink-dupes")
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				defer os.RemoveAll(dir)
+				path := filepath.Join(dir, "a")
+				assert.Nil(t, ioutil.WriteFile(path, []byte("hello"), 0644))
+
+				groups, err := makeDupeGroups(map[string][]string{"digest": []string{path, filepath.Join(dir, "missing")}})
+				assert.Equal(t, []dupeGroup{}, groups)
+				if assert.IsType(t, &multierror.MultiError{}, err) {
+					assert.Equal(t, 1, err.(*multierror.MultiError).Len())
+				}
+			},
+		},
+	}
+
+	runDupesTestTable(t, tests)
+}
+
+func TestSortDupeGroups(t *testing.T) {
+	makeGroups := func() []dupeGroup {
+		return []dupeGroup{
+			{Paths: []string{"c"}, Size: 10, Reclaimable: 10},
+			{Paths: []string{"a"}, Size: 5, Reclaimable: 20},
+			{Paths: []string{"b"}, Size: 20, Reclaimable: 0},
+		}
+	}
+
+	getFirstPaths := func(groups []dupeGroup) []string {
+		paths := []string{}
+		for _, group := range groups {
+			paths = append(paths, group.Paths[0])
+		}
+
+		return paths
+	}
+
+	tests := []dupesTest{
+		{
+			name: "wasted",
+			test: func(t *testing.T) {
+				groups := makeGroups()
+				sortDupeGroups(groups, dupesSortWasted)
+				assert.Equal(t, []string{"a", "c", "b"}, getFirstPaths(groups))
+			},
+		},
+		{
+			name: "size",
+			test: func(t *testing.T) {
+				groups := makeGroups()
+				sortDupeGroups(groups, dupesSortSize)
+				assert.Equal(t, []string{"b", "c", "a"}, getFirstPaths(groups))
+			},
+		},
+		{
+			name: "path",
+			test: func(t *testing.T) {
+				groups := makeGroups()
+				sortDupeGroups(groups, dupesSortPath)
+				assert.Equal(t, []string{"a", "b", "c"}, getFirstPaths(groups))
+			},
+		},
+	}
+
+	runDupesTestTable(t, tests)
+}
+
+func TestFormatDupeGroups(t *testing.T) {
+	groups := []dupeGroup{{Digest: "abc", Size: 2048, Paths: []string{"a", "b"}, Reclaimable: 2048, SharesInode: true}}
+	output, err := formatDupeGroups(groups, textFormat)
+	assert.Nil(t, err)
+	assert.Equal(t, "abc  2.0 KiB each, 2.0 KiB reclaimable, some paths already linked\n\ta\n\tb\n\n1 groups of duplicates, 2.0 KiB reclaimable.", output)
+
+	output, err = formatDupeGroups([]dupeGroup{}, jsonFormat)
+	assert.Nil(t, err)
+	assert.Equal(t, "[]", output)
+}
@@ -0,0 +1,260 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ollien/hashlink"
+	"golang.org/x/xerrors"
+)
+
+// connectMethod represents a way of connecting a src file to its destination.
+type connectMethod int
+
+const (
+	linkMethod connectMethod = iota
+	copyMethod
+)
+
+var (
+	errRsyncListWithoutScript = errors.New("rsync list without script")
+	errRsyncListReferences    = errors.New("rsync list with several reference_dirs")
+)
+
+// scriptHeader begins every generated script.
+const scriptHeader = `#!/bin/sh
+# Generated by hashlink. Review this script before running it; it makes the changes that hashlink would have made.
+set -e
+`
+
+// operationEmitter writes planned operations out for a separate step to perform, rather than performing them. Links
+// and copies are written to a POSIX shell script, though copies may instead be written to a NUL separated list for
+// rsync's --files-from option. As rsync can't produce links, a script is always required. It is safe to emit from
+// several goroutines at once.
+type operationEmitter struct {
+	lock   sync.Mutex
+	script *bufio.Writer
+	// rsyncList will be nil if no rsync list was requested.
+	rsyncList *bufio.Writer
+	// rsyncListPath is the absolute path of the rsync list, if one was requested.
+	rsyncListPath string
+	// rsyncRoot is the root that the paths in rsyncList are relative to. Both of its directories are absolute.
+	rsyncRoot outRoot
+	// createdDirs holds the directories that the script has already created.
+	createdDirs map[string]bool
+	files       []*os.File
+}
+
+// function gets the connectFunction that performs the method.
+func (method connectMethod) function() connectFunction {
+	if method == copyMethod {
+		return copyFile
+	}
+
+	return linkFile
+}
+
+// phase gets the phase that a failure to perform the method occurs in.
+func (method connectMethod) phase() hashlink.Phase {
+	if method == copyMethod {
+		return hashlink.PhaseCopy
+	}
+
+	return hashlink.PhaseLink
+}
+
+// newOperationEmitter makes an operationEmitter that writes a script to scriptPath, and an rsync list to rsyncListPath,
+// whose paths are relative to rsyncRoot. rsyncListPath may be empty, if that output is not wanted. Every path written
+// to the script is absolute, so that it may be run from any directory.
+func newOperationEmitter(scriptPath, rsyncListPath string, rsyncRoot outRoot) (*operationEmitter, error) {
+	absRsyncRoot, err := makeAbsOutRoot(rsyncRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	emitter := &operationEmitter{rsyncRoot: absRsyncRoot, createdDirs: map[string]bool{}}
+	// The script is only made executable by its owner, as it should be reviewed before it is run.
+	scriptFile, err := os.OpenFile(scriptPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0700)
+	if err != nil {
+		return nil, xerrors.Errorf("could not create script (%s): %w", scriptPath, err)
+	}
+
+	emitter.files = append(emitter.files, scriptFile)
+	emitter.script = bufio.NewWriter(scriptFile)
+	// Errors from writing to a bufio.Writer are held until it is flushed, so we can safely check them in close.
+	emitter.script.WriteString(scriptHeader)
+
+	if rsyncListPath != "" {
+		rsyncListFile, err := os.Create(rsyncListPath)
+		if err != nil {
+			emitter.close()
+			return nil, xerrors.Errorf("could not create rsync list (%s): %w", rsyncListPath, err)
+		}
+
+		emitter.files = append(emitter.files, rsyncListFile)
+		emitter.rsyncList = bufio.NewWriter(rsyncListFile)
+		emitter.rsyncListPath, err = filepath.Abs(rsyncListPath)
+		if err != nil {
+			emitter.close()
+			return nil, xerrors.Errorf("could not get absolute path of (%s): %w", rsyncListPath, err)
+		}
+	}
+
+	return emitter, nil
+}
+
+// emit writes out the given operation, to be performed using method.
+func (emitter *operationEmitter) emit(operation connectOperation, method connectMethod) error {
+	operation, err := makeAbsOperation(operation)
+	if err != nil {
+		return err
+	}
+
+	emitter.lock.Lock()
+	defer emitter.lock.Unlock()
+	if method == copyMethod && emitter.rsyncList != nil {
+		return emitter.emitRsyncEntry(operation)
+	}
+
+	emitter.emitScriptCommands(operation, method)
+
+	return nil
+}
+
+// emitScriptCommands writes the shell commands that perform operation, whose paths must be absolute, using method.
+func (emitter *operationEmitter) emitScriptCommands(operation connectOperation, method connectMethod) {
+	writer := emitter.script
+	src, dst := quoteShellArgument(operation.src), quoteShellArgument(operation.dst)
+	dir := filepath.Dir(operation.dst)
+	if !emitter.createdDirs[dir] {
+		fmt.Fprintf(writer, "mkdir -p -- %s\n", quoteShellArgument(dir))
+		emitter.createdDirs[dir] = true
+	}
+
+	switch {
+	case method == linkMethod && operation.overwrite:
+		fmt.Fprintf(writer, "ln -f -- %s %s\n", src, dst)
+	case method == linkMethod:
+		fmt.Fprintf(writer, "ln -- %s %s\n", src, dst)
+	case operation.overwrite:
+		// As with overwriteDestination, copy alongside the destination and move it into place, so that the destination
+		// is never left half written.
+		tempPath := quoteShellArgument(operation.dst + ".hashlink-tmp")
+		fmt.Fprintf(writer, "cat -- %s > %s\nmv -f -- %s %s\n", src, tempPath, tempPath, dst)
+	default:
+		// noclobber makes the redirection fail if the destination exists, just as copyFile does.
+		fmt.Fprintf(writer, "(set -C && cat -- %s > %s)\n", src, dst)
+	}
+}
+
+// emitRsyncEntry writes the path of the operation's src file, which must be absolute, relative to the rsync root, to the rsync list. rsync
+// can only place files at the same relative location, so the operation must not have been renamed.
+func (emitter *operationEmitter) emitRsyncEntry(operation connectOperation) error {
+	relPath, err := getContainedRelPath(emitter.rsyncRoot.dir, operation.src)
+	if err != nil {
+		return xerrors.Errorf("could not add (%s) to rsync list: %w", operation.src, err)
+	}
+
+	if filepath.Join(emitter.rsyncRoot.outDir, relPath) != operation.dst {
+		return xerrors.Errorf("(%s) is not at the same relative location as (%s), so it can't be added to the rsync list", operation.dst, operation.src)
+	}
+
+	emitter.rsyncList.WriteString(relPath)
+	emitter.rsyncList.WriteByte(0)
+
+	return nil
+}
+
+// rsyncCommand gets the rsync command that will copy the files in the rsync list. As with the script, every path in it
+// is absolute.
+func (emitter *operationEmitter) rsyncCommand() string {
+	return fmt.Sprintf(
+		"rsync -0 --files-from=%s -- %s %s",
+		quoteShellArgument(emitter.rsyncListPath),
+		quoteShellArgument(emitter.rsyncRoot.dir+string(filepath.Separator)),
+		quoteShellArgument(emitter.rsyncRoot.outDir+string(filepath.Separator)),
+	)
+}
+
+// close finishes writing all output.
+func (emitter *operationEmitter) close() error {
+	var flushErr error
+	for _, writer := range []*bufio.Writer{emitter.script, emitter.rsyncList} {
+		if writer == nil {
+			continue
+		}
+
+		err := writer.Flush()
+		if err != nil && flushErr == nil {
+			flushErr = xerrors.Errorf("could not write output: %w", err)
+		}
+	}
+
+	for _, file := range emitter.files {
+		err := file.Close()
+		if err != nil && flushErr == nil {
+			flushErr = xerrors.Errorf("could not write output: %w", err)
+		}
+	}
+
+	return flushErr
+}
+
+// makeAbsOutRoot makes a copy of root with both of its directories made absolute.
+func makeAbsOutRoot(root outRoot) (outRoot, error) {
+	absDir, err := filepath.Abs(root.dir)
+	if err != nil {
+		return outRoot{}, xerrors.Errorf("could not get absolute path of (%s): %w", root.dir, err)
+	}
+
+	absOutDir, err := filepath.Abs(root.outDir)
+	if err != nil {
+		return outRoot{}, xerrors.Errorf("could not get absolute path of (%s): %w", root.outDir, err)
+	}
+
+	return outRoot{dir: absDir, outDir: absOutDir}, nil
+}
+
+// makeAbsOperation makes a copy of operation with its src and dst made absolute.
+func makeAbsOperation(operation connectOperation) (connectOperation, error) {
+	absSrc, err := filepath.Abs(operation.src)
+	if err != nil {
+		return connectOperation{}, xerrors.Errorf("could not get absolute path of (%s): %w", operation.src, err)
+	}
+
+	absDst, err := filepath.Abs(operation.dst)
+	if err != nil {
+		return connectOperation{}, xerrors.Errorf("could not get absolute path of (%s): %w", operation.dst, err)
+	}
+
+	operation.src = absSrc
+	operation.dst = absDst
+
+	return operation, nil
+}
+
+// quoteShellArgument quotes arg so that a POSIX shell will treat it as a single literal word.
+func quoteShellArgument(arg string) string {
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
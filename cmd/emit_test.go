@@ -0,0 +1,180 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type emitTest struct {
+	name string
+	test func(t *testing.T)
+}
+
+func runEmitTestTable(t *testing.T, table []emitTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t)
+		})
+	}
+}
+
+func TestOperationEmitter(t *testing.T) {
+	// emitAll emits every operation with a new emitter, and returns the resulting script and rsync list.
+	emitAll := func(t *testing.T, useRsync bool, operations []connectOperation, methods []connectMethod) (script, rsyncList string, errs []error) {
+		dir, err := ioutil.TempDir("", "hashlink-emit")
+		if !assert.Nil(t, err) {
+			return "", "", nil
+		}
+
+		defer os.RemoveAll(dir)
+		scriptPath := filepath.Join(dir, "script.sh")
+		rsyncListPath := ""
+		if useRsync {
+			rsyncListPath = filepath.Join(dir, "files")
+		}
+
+		emitter, err := newOperationEmitter(scriptPath, rsyncListPath, outRoot{dir: "ref", outDir: "out"})
+		if !assert.Nil(t, err) {
+			return "", "", nil
+		}
+
+		for i, operation := range operations {
+			errs = append(errs, emitter.emit(operation, methods[i]))
+		}
+
+		assert.Nil(t, emitter.close())
+		scriptContents, err := ioutil.ReadFile(scriptPath)
+		assert.Nil(t, err)
+		if useRsync {
+			rsyncListContents, err := ioutil.ReadFile(rsyncListPath)
+			assert.Nil(t, err)
+			rsyncList = string(rsyncListContents)
+		}
+
+		return string(scriptContents), rsyncList, errs
+	}
+
+	// quoteAbs gets the quoted absolute form of path, as it should appear in the script.
+	quoteAbs := func(t *testing.T, path string) string {
+		absPath, err := filepath.Abs(path)
+		assert.Nil(t, err)
+
+		return quoteShellArgument(absPath)
+	}
+
+	tests := []emitTest{
+		{
+			name: "script",
+			test: func(t *testing.T) {
+				script, _, errs := emitAll(
+					t,
+					false,
+					[]connectOperation{
+						{src: "src/a", dst: "out/a"},
+						{src: "src/b", dst: "out/b", overwrite: true},
+						{src: "ref/c", dst: "out/dir/c"},
+						{src: "ref/d", dst: "out/dir/d", overwrite: true},
+					},
+					[]connectMethod{linkMethod, linkMethod, copyMethod, copyMethod},
+				)
+
+				assert.Equal(t, []error{nil, nil, nil, nil}, errs)
+				assert.Equal(t, scriptHeader+
+					"mkdir -p -- "+quoteAbs(t, "out")+"\n"+
+					"ln -- "+quoteAbs(t, "src/a")+" "+quoteAbs(t, "out/a")+"\n"+
+					"ln -f -- "+quoteAbs(t, "src/b")+" "+quoteAbs(t, "out/b")+"\n"+
+					"mkdir -p -- "+quoteAbs(t, "out/dir")+"\n"+
+					"(set -C && cat -- "+quoteAbs(t, "ref/c")+" > "+quoteAbs(t, "out/dir/c")+")\n"+
+					"cat -- "+quoteAbs(t, "ref/d")+" > "+quoteAbs(t, "out/dir/d.hashlink-tmp")+"\n"+
+					"mv -f -- "+quoteAbs(t, "out/dir/d.hashlink-tmp")+" "+quoteAbs(t, "out/dir/d")+"\n",
+					script,
+				)
+			},
+		},
+		{
+			name: "rsync list",
+			test: func(t *testing.T) {
+				script, rsyncList, errs := emitAll(
+					t,
+					true,
+					[]connectOperation{
+						{src: "src/a", dst: "out/a"},
+						{src: "ref/b", dst: "out/b"},
+						{src: "ref/dir/c", dst: "out/dir/c"},
+						{src: "ref/d", dst: "out/d (1)"},
+					},
+					[]connectMethod{linkMethod, copyMethod, copyMethod, copyMethod},
+				)
+
+				assert.Nil(t, errs[0])
+				assert.Nil(t, errs[1])
+				assert.Nil(t, errs[2])
+				assert.NotNil(t, errs[3])
+				assert.Equal(t, scriptHeader+"mkdir -p -- "+quoteAbs(t, "out")+"\nln -- "+quoteAbs(t, "src/a")+" "+quoteAbs(t, "out/a")+"\n", script)
+				assert.Equal(t, "b\x00dir/c\x00", rsyncList)
+			},
+		},
+		{
+			name: "relative roots",
+			test: func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "hashlink-emit-roots")
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				defer os.RemoveAll(dir)
+				// Resolve any symlinks in the temp dir, as the working directory will have them resolved.
+				dir, err = filepath.EvalSymlinks(dir)
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				wd, err := os.Getwd()
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				defer os.Chdir(wd)
+				if !assert.Nil(t, os.Chdir(dir)) {
+					return
+				}
+
+				script, _, errs := emitAll(t, false, []connectOperation{{src: "src/a", dst: "out/a"}}, []connectMethod{linkMethod})
+				assert.Equal(t, []error{nil}, errs)
+				// The script must not depend on the directory it is run from.
+				assert.Equal(t, scriptHeader+
+					"mkdir -p -- "+quoteShellArgument(filepath.Join(dir, "out"))+"\n"+
+					"ln -- "+quoteShellArgument(filepath.Join(dir, "src", "a"))+" "+quoteShellArgument(filepath.Join(dir, "out", "a"))+"\n",
+					script,
+				)
+			},
+		},
+	}
+
+	runEmitTestTable(t, tests)
+}
+
+func TestQuoteShellArgument(t *testing.T) {
+	assert.Equal(t, "'plain'", quoteShellArgument("plain"))
+	assert.Equal(t, "'it'\\''s $HOME'", quoteShellArgument("it's $HOME"))
+}
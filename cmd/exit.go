@@ -0,0 +1,49 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Exit codes used by every command. They are documented in the README, so their values must never change.
+const (
+	// exitSuccess indicates that everything was done.
+	exitSuccess = 0
+	// exitFileErrors indicates that the command completed, but some files could not be processed (or, for verify, that
+	// discrepancies were found).
+	exitFileErrors = 1
+	// exitUsage indicates that the arguments were invalid, so nothing was done. The flag package also exits with this
+	// code when it fails to parse a flag.
+	exitUsage = 2
+	// exitScanFailed indicates that the given directories could not be hashed, so nothing was done.
+	exitScanFailed = 3
+	// exitFailed indicates that the command could not complete, or that every file it attempted failed.
+	exitFailed = 4
+	// exitInterrupted indicates that the run was stopped by a signal before it could finish, following the shell's
+	// convention for SIGINT.
+	exitInterrupted = 130
+)
+
+// getRunExitCode gets the exit code for a run of the main command, given the number of files that ended up with each
+// action. If incomplete is set, something stopped the run from producing all of its output.
+func getRunExitCode(counts map[fileAction]int, incomplete bool) int {
+	succeeded := counts[actionLinked] + counts[actionCopied]
+	if incomplete || (counts[actionFailed] > 0 && succeeded == 0) {
+		return exitFailed
+	} else if counts[actionFailed] > 0 {
+		return exitFileErrors
+	}
+
+	return exitSuccess
+}
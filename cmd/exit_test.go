@@ -0,0 +1,77 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type exitTest struct {
+	name string
+	test func(t *testing.T)
+}
+
+func runExitTestTable(t *testing.T, table []exitTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t)
+		})
+	}
+}
+
+func TestGetRunExitCode(t *testing.T) {
+	tests := []exitTest{
+		{
+			name: "nothing to do",
+			test: func(t *testing.T) {
+				assert.Equal(t, exitSuccess, getRunExitCode(map[fileAction]int{}, false))
+			},
+		},
+		{
+			name: "all succeeded",
+			test: func(t *testing.T) {
+				counts := map[fileAction]int{actionLinked: 3, actionSkipped: 1}
+				assert.Equal(t, exitSuccess, getRunExitCode(counts, false))
+			},
+		},
+		{
+			name: "some failed",
+			test: func(t *testing.T) {
+				counts := map[fileAction]int{actionLinked: 3, actionCopied: 1, actionFailed: 1}
+				assert.Equal(t, exitFileErrors, getRunExitCode(counts, false))
+			},
+		},
+		{
+			name: "all failed",
+			test: func(t *testing.T) {
+				counts := map[fileAction]int{actionFailed: 2, actionSkipped: 1}
+				assert.Equal(t, exitFailed, getRunExitCode(counts, false))
+			},
+		},
+		{
+			name: "incomplete output",
+			test: func(t *testing.T) {
+				counts := map[fileAction]int{actionLinked: 3}
+				assert.Equal(t, exitFailed, getRunExitCode(counts, true))
+			},
+		},
+	}
+
+	runExitTestTable(t, tests)
+}
@@ -0,0 +1,34 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import "strings"
+
+// stringSliceFlag is a flag.Value that collects every occurrence of a repeatable flag.
+type stringSliceFlag []string
+
+// String gives all of the collected values, separated by commas.
+func (values *stringSliceFlag) String() string {
+	return strings.Join(*values, ",")
+}
+
+// Set appends a value each time the flag is given.
+func (values *stringSliceFlag) Set(value string) error {
+	*values = append(*values, value)
+
+	return nil
+}
@@ -17,11 +17,17 @@ package main
 */
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 
+	"github.com/google/uuid"
 	"github.com/ollien/hashlink"
 	"github.com/ollien/hashlink/multierror"
 	"golang.org/x/xerrors"
@@ -29,76 +35,164 @@ import (
 
 const defaultFileMode os.FileMode = 0755
 
+// connectFunction connects a single src file to dst, such as by hardlinking or copying.
 type connectFunction = func(src, dst string) error
 
+// operationFunction performs a single planned connectOperation.
+type operationFunction = func(operation connectOperation) error
+
+// connectResult represents the outcome of performing a single connectOperation.
+type connectResult struct {
+	operation connectOperation
+	// If the operation failed, err will be non-nil.
+	err error
+}
+
+// outRoot maps a root directory to the directory that its files will be connected into.
+type outRoot struct {
+	dir    string
+	outDir string
+}
+
 // connectMappedFiles performs the given function op on all provided files (expected in src => reference order), in
-// order to form a connection between them, such as copying or hardlinking. If the file in the value portion of files
-// does not exist in referenceDir, no connection will be created an error will be returned for that file, but
-// connecting will continue for all other files.
-func connectMappedFiles(files hashlink.FileMap, referenceDir, outDir string, op connectFunction) error {
-	errors := multierror.NewMultiError()
-	for srcFile, referenceFiles := range files {
-		for _, referenceFile := range referenceFiles {
-			err := connectMappedFile(srcFile, referenceFile, referenceDir, outDir, op)
+// order to form a connection between them, such as copying or hardlinking. Only one src file will be connected to
+// each reference file, and conflicting destinations are resolved according to plan. Up to numWorkers connections
+// will be made at once. If the file in the value portion of files does not exist in any of the given roots, no
+// connection will be created an error will be returned for that file, but connecting will continue for all other
+// files. Once ctx is done, no more connections will be started. The result of every operation that was attempted is
+// returned, regardless of errors.
+func connectMappedFiles(ctx context.Context, files hashlink.FileMap, roots []outRoot, plan *connectPlan, numWorkers int, op operationFunction) ([]connectResult, error) {
+	operations, planErr := plan.planMappedFiles(files, roots)
+
+	return connectPlannedOperations(ctx, operations, planErr, plan, numWorkers, op)
+}
+
+// connectFiles performs the given function op on all provided files, in order to form a connection between them, such
+// as copying or hardlinking. Conflicting destinations are resolved according to plan. Up to numWorkers connections
+// will be made at once. If the file does not exist in any of the roots, an error will be returned for that file, but
+// connecting will continue for all other files. Once ctx is done, no more connections will be started. The result of
+// every operation that was attempted is returned, regardless of errors.
+func connectFiles(ctx context.Context, files []string, roots []outRoot, plan *connectPlan, numWorkers int, op operationFunction) ([]connectResult, error) {
+	operations, planErr := plan.planFiles(files, roots)
+
+	return connectPlannedOperations(ctx, operations, planErr, plan, numWorkers, op)
+}
+
+// connectPlannedOperations performs op on every operation across numWorkers workers, and produces a single error
+// holding both planErr and any errors from performing the operations. If ctx is done before every operation has been
+// started, the rest are recorded in plan as unplanned.
+func connectPlannedOperations(ctx context.Context, operations []connectOperation, planErr error, plan *connectPlan, numWorkers int, op operationFunction) ([]connectResult, error) {
+	results := make([]connectResult, 0, len(operations))
+	resultLock := sync.Mutex{}
+	group, _ := multierror.NewGroup(ctx, multierror.GroupConcurrencyLimit(numWorkers))
+	for _, operation := range operations {
+		operation := operation
+		group.Go(func(context.Context) error {
+			err := op(operation)
 			if err != nil {
-				err = xerrors.Errorf("could not link file (%s): %w", srcFile, err)
-				errors.Append(err)
+				err = xerrors.Errorf("could not connect path (%s => %s): %w", operation.src, operation.dst, err)
 			}
-		}
+
+			resultLock.Lock()
+			defer resultLock.Unlock()
+			results = append(results, connectResult{operation: operation, err: err})
+
+			return err
+		})
+	}
+
+	errors := multierror.NewMultiError()
+	errors.Append(planErr)
+	if groupErrors := group.Wait(); groupErrors != nil {
+		errors.Append(groupErrors)
+	}
+
+	if ctx.Err() != nil {
+		plan.addUnattempted(operations, results, reasonInterrupted)
 	}
 
 	if errors.Len() > 0 {
-		return errors
+		return results, errors
 	}
 
-	return nil
+	return results, nil
 }
 
-// connectMappedFile will connect srcPath to a file in outDir that is relative to outDir in the same fashion that
-// referencePath is relative to referenceDir. If referencePath is not relative to referenceDir, an error is returned
-// and no connection will take place.
-func connectMappedFile(srcPath, referencePath, referenceDir, outDir string, op connectFunction) error {
-	relReferencePath, err := filepath.Rel(referenceDir, referencePath)
-	if err != nil {
-		return xerrors.Errorf("could not produce relative path for file connection: %w", err)
+// getOutPath finds the path that the given file should be connected to. If the path is within several roots, the most
+// specific one is used.
+func getOutPath(filePath string, roots []outRoot) (string, error) {
+	outPath := ""
+	matchedDirLength := -1
+	for _, root := range roots {
+		dirLength := len(filepath.Clean(root.dir))
+		relPath, err := getContainedRelPath(root.dir, filePath)
+		if err != nil || dirLength <= matchedDirLength {
+			continue
+		}
+
+		outPath = path.Join(root.outDir, relPath)
+		matchedDirLength = dirLength
 	}
 
-	outPath := path.Join(outDir, relReferencePath)
-	err = op(srcPath, outPath)
+	if matchedDirLength == -1 {
+		return "", xerrors.Errorf("path (%s) is not within any root directory", filePath)
+	}
+
+	return outPath, nil
+}
+
+// getContainedRelPath gets the path of filePath relative to dir, but produces an error if filePath is not inside dir.
+func getContainedRelPath(dir, filePath string) (string, error) {
+	relPath, err := filepath.Rel(dir, filePath)
 	if err != nil {
-		return xerrors.Errorf("could not connect path (%s => %s): %w", srcPath, outPath)
+		return "", xerrors.Errorf("could not produce relative path: %w", err)
+	} else if relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", xerrors.Errorf("path (%s) is not within (%s)", filePath, dir)
 	}
 
-	return nil
+	return relPath, nil
 }
 
-// connectFiles performs the given function op on all provided files, in order to form a connection between them, such
-// as copying or hardlinking. If the file does not exist in baseDir, an error will be returned for that file, but
-// connecting will continue for all other files.
-func connectFiles(files []string, baseDir, outDir string, op connectFunction) error {
-	errors := multierror.NewMultiError()
-	for _, file := range files {
-		err := connectFile(file, baseDir, outDir, op)
-		if err != nil {
-			err = xerrors.Errorf("could not link file (%s): %w", file, err)
-			errors.Append(err)
+// makeOutRoots makes an outRoot for each of the given dirs. If separate is set, each dir will get its own
+// subdirectory of outDir, named after the dir. Otherwise, all dirs will be merged directly into outDir.
+func makeOutRoots(dirs []string, outDir string, separate bool) []outRoot {
+	roots := make([]outRoot, len(dirs))
+	usedNames := map[string]bool{}
+	for i, dir := range dirs {
+		roots[i] = outRoot{dir: dir, outDir: outDir}
+		if !separate {
+			continue
 		}
-	}
 
-	if errors.Len() > 0 {
-		return errors
+		// Each subdirectory needs a unique name, but two dirs may well share one (e.g. /mnt/a/photos, /mnt/b/photos).
+		baseName := filepath.Base(filepath.Clean(dir))
+		if baseName == "." || baseName == ".." || baseName == string(filepath.Separator) {
+			baseName = "root"
+		}
+
+		name := baseName
+		for suffix := 2; usedNames[name]; suffix++ {
+			name = fmt.Sprintf("%s-%d", baseName, suffix)
+		}
+
+		usedNames[name] = true
+		roots[i].outDir = path.Join(outDir, name)
 	}
 
-	return nil
+	return roots
 }
 
-// connectFile will connect path to a file in outDir that is relative to outDir in the same fashion that it is
-// relative to baseDir. If the given path is not relative to srcDir, an error is returned and no connection will
-// take place.
-func connectFile(path, baseDir, outDir string, op connectFunction) error {
-	// This looks a little silly, but path can safely act as our "referencePath", as we are still operating relative
-	// to it.
-	return connectMappedFile(path, path, baseDir, outDir, op)
+// makeSrcOnlyRoots makes the outRoots that the files only present in srcDirs are linked into, within the srcOnlyDir
+// subdirectory of outDir, as makeOutRoots would. srcOnlyDir must be a relative path to a subdirectory of outDir, and
+// errInvalidSrcOnlyDir is returned otherwise.
+func makeSrcOnlyRoots(srcDirs []string, outDir, srcOnlyDir string, separate bool) ([]outRoot, error) {
+	srcOnlyOutDir := filepath.Join(outDir, srcOnlyDir)
+	relPath, err := getContainedRelPath(outDir, srcOnlyOutDir)
+	if filepath.IsAbs(srcOnlyDir) || err != nil || relPath == "." {
+		return nil, errInvalidSrcOnlyDir
+	}
+
+	return makeOutRoots(srcDirs, srcOnlyOutDir, separate), nil
 }
 
 // ensureContainingDirsArePresent ensures that the dirs needed for a file are fully present. Will make the directories
@@ -113,25 +207,84 @@ func ensureContainingDirsArePresent(filePath string) error {
 	return nil
 }
 
-// copyFile copies a file from src to dst. Both paths must be regular files.
+// overwriteDestination replaces dst with the result of connect. The replacement is performed by connecting to a
+// temporary path and renaming it into place, so dst is never left absent.
+func overwriteDestination(src, dst string, connect connectFunction) error {
+	tempPath := fmt.Sprintf("%s.hashlink-%s", dst, uuid.New())
+	err := connect(src, tempPath)
+	if err != nil {
+		return xerrors.Errorf("could not connect to temporary path (%s): %w", tempPath, err)
+	}
+
+	err = os.Rename(tempPath, dst)
+	if err != nil {
+		os.Remove(tempPath)
+		return xerrors.Errorf("could not replace (%s): %w", dst, err)
+	}
+
+	return nil
+}
+
+// crossDeviceError wraps the error from a link that failed because its destination is on a different device. It
+// matches hashlink.ErrCrossDevice, while still unwrapping to the original error.
+type crossDeviceError struct {
+	err error
+}
+
+// linkFile hardlinks src to dst. If dst is on a different device than src, the error will match
+// hashlink.ErrCrossDevice, as well as wrapping the *os.LinkError.
+func linkFile(src, dst string) error {
+	err := os.Link(src, dst)
+	if xerrors.Is(err, syscall.EXDEV) {
+		return &crossDeviceError{err: err}
+	}
+
+	return err
+}
+
+// Error gives the original error, marked as a cross-device link.
+func (crossErr *crossDeviceError) Error() string {
+	return fmt.Sprintf("%s: %s", crossErr.err, hashlink.ErrCrossDevice)
+}
+
+// Unwrap gives the original error.
+func (crossErr *crossDeviceError) Unwrap() error {
+	return crossErr.err
+}
+
+// Is checks whether target is hashlink.ErrCrossDevice.
+func (crossErr *crossDeviceError) Is(target error) bool {
+	return target == hashlink.ErrCrossDevice
+}
+
+// copyFile copies a file from src to dst. Both paths must be regular files, and dst must not already exist.
 // (for some reason the standard library includes no way to do this out of the box...)
 func copyFile(src, dst string) error {
 	srcFile, err := os.Open(src)
 	if err != nil {
-		return xerrors.Errorf("could not open file (%s) for copying: %w", srcFile, err)
+		return xerrors.Errorf("could not open file (%s) for copying: %w", src, err)
 	}
 
+	defer srcFile.Close()
 	createMode := removeExecuteBits(defaultFileMode)
-	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE, createMode)
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, createMode)
 	if err != nil {
 		return xerrors.Errorf("could not open path (%s) as copying destination: %w", dst, err)
 	}
 
 	_, err = io.Copy(dstFile, srcFile)
 	if err != nil {
+		dstFile.Close()
+		// Don't leave a partial copy behind, as it would stop the copy from being retried.
+		os.Remove(dst)
 		return xerrors.Errorf("could noy copy (%s => %s): %w", src, dst, err)
 	}
 
+	err = dstFile.Close()
+	if err != nil {
+		return xerrors.Errorf("could not finish copying (%s => %s): %w", src, dst, err)
+	}
+
 	return nil
 }
 
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"testing"
 
 	"github.com/ollien/hashlink"
+	"github.com/ollien/hashlink/multierror"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
 )
 
 // opArgs represents a set of arguments given to an op function
@@ -15,25 +24,28 @@ type opArgs struct {
 
 // mockOpWrapper is a wrapper for a connectFunction that will record all calls given to it
 type mockOpWrapper struct {
-	calls []opArgs
+	calls     []opArgs
+	callsLock sync.Mutex
 }
 
-// op is a bsic connectFunction that will record what calls are given to it, and return no error
-func (m *mockOpWrapper) op(src, dst string) error {
-	m.calls = append(m.calls, opArgs{src, dst})
+// op is a bsic operationFunction that will record what calls are given to it, and return no error
+func (m *mockOpWrapper) op(operation connectOperation) error {
+	m.callsLock.Lock()
+	defer m.callsLock.Unlock()
+	m.calls = append(m.calls, opArgs{operation.src, operation.dst})
 
 	return nil
 }
 
 type connectTest struct {
 	name string
-	test func(t *testing.T, opWrapper mockOpWrapper)
+	test func(t *testing.T, opWrapper *mockOpWrapper)
 }
 
 func runConnectTestTable(t *testing.T, table []connectTest) {
 	for _, tt := range table {
 		t.Run(tt.name, func(t *testing.T) {
-			tt.test(t, mockOpWrapper{})
+			tt.test(t, &mockOpWrapper{})
 		})
 	}
 }
@@ -42,15 +54,15 @@ func TestConnectMappedFiles(t *testing.T) {
 	tests := []connectTest{
 		{
 			name: "no files",
-			test: func(t *testing.T, opWrapper mockOpWrapper) {
-				err := connectMappedFiles(hashlink.FileMap{}, "foo/ref", "foo/out", opWrapper.op)
+			test: func(t *testing.T, opWrapper *mockOpWrapper) {
+				_, err := connectMappedFiles(context.Background(), hashlink.FileMap{}, []outRoot{{dir: "foo/ref", outDir: "foo/out"}}, newConnectPlan(conflictError), 1, opWrapper.op)
 				assert.Nil(t, err)
 				assert.ElementsMatch(t, []opArgs{}, opWrapper.calls)
 			},
 		},
 		{
 			name: "some files",
-			test: func(t *testing.T, opWrapper mockOpWrapper) {
+			test: func(t *testing.T, opWrapper *mockOpWrapper) {
 				files := hashlink.FileMap{
 					"src/b":           []string{"foo/ref/b"},
 					"src/a":           []string{"foo/ref/c"},
@@ -58,7 +70,7 @@ func TestConnectMappedFiles(t *testing.T) {
 					"src/something/g": []string{"foo/ref/g"},
 				}
 
-				err := connectMappedFiles(files, "foo/ref", "foo/out", opWrapper.op)
+				_, err := connectMappedFiles(context.Background(), files, []outRoot{{dir: "foo/ref", outDir: "foo/out"}}, newConnectPlan(conflictError), 1, opWrapper.op)
 				assert.Nil(t, err)
 				assert.ElementsMatch(t, []opArgs{
 					{src: "src/b", dst: "foo/out/b"},
@@ -71,14 +83,14 @@ func TestConnectMappedFiles(t *testing.T) {
 		},
 		{
 			name: "file not relative to reference dir",
-			test: func(t *testing.T, opWrapper mockOpWrapper) {
+			test: func(t *testing.T, opWrapper *mockOpWrapper) {
 				files := hashlink.FileMap{
 					"src/b": []string{"foo/ref/b"},
 					"src/a": []string{"/wrong/location"},
 					"src/c": []string{"foo/ref/d"},
 				}
 
-				err := connectMappedFiles(files, "foo/ref", "foo/out", opWrapper.op)
+				_, err := connectMappedFiles(context.Background(), files, []outRoot{{dir: "foo/ref", outDir: "foo/out"}}, newConnectPlan(conflictError), 1, opWrapper.op)
 				assert.NotNil(t, err)
 				// We should still call op for all of the elements we can
 				assert.ElementsMatch(t, []opArgs{
@@ -87,6 +99,74 @@ func TestConnectMappedFiles(t *testing.T) {
 				}, opWrapper.calls)
 			},
 		},
+		{
+			name: "multiple roots",
+			test: func(t *testing.T, opWrapper *mockOpWrapper) {
+				files := hashlink.FileMap{
+					"src1/b": []string{"foo/ref1/b"},
+					"src2/a": []string{"foo/ref2/dir/c", "foo/ref1/d"},
+					"src1/e": []string{"foo/ref1/nested/f"},
+				}
+
+				roots := []outRoot{
+					{dir: "foo/ref1", outDir: "foo/out/ref1"},
+					{dir: "foo/ref2", outDir: "foo/out/ref2"},
+					{dir: "foo/ref1/nested", outDir: "foo/out/nested"},
+				}
+
+				_, err := connectMappedFiles(context.Background(), files, roots, newConnectPlan(conflictError), 1, opWrapper.op)
+				assert.Nil(t, err)
+				assert.ElementsMatch(t, []opArgs{
+					{src: "src1/b", dst: "foo/out/ref1/b"},
+					{src: "src2/a", dst: "foo/out/ref2/dir/c"},
+					{src: "src2/a", dst: "foo/out/ref1/d"},
+					// The most specific root should always win
+					{src: "src1/e", dst: "foo/out/nested/f"},
+				}, opWrapper.calls)
+			},
+		},
+		{
+			name: "several workers",
+			test: func(t *testing.T, opWrapper *mockOpWrapper) {
+				files := hashlink.FileMap{}
+				expectedCalls := []opArgs{}
+				for i := 0; i < 100; i++ {
+					srcFile := fmt.Sprintf("src/%d", i)
+					files[srcFile] = []string{fmt.Sprintf("foo/ref/%d", i)}
+					expectedCalls = append(expectedCalls, opArgs{src: srcFile, dst: fmt.Sprintf("foo/out/%d", i)})
+				}
+
+				_, err := connectMappedFiles(context.Background(), files, []outRoot{{dir: "foo/ref", outDir: "foo/out"}}, newConnectPlan(conflictError), 8, opWrapper.op)
+				assert.Nil(t, err)
+				assert.ElementsMatch(t, expectedCalls, opWrapper.calls)
+			},
+		},
+		{
+			name: "errors from several workers",
+			test: func(t *testing.T, opWrapper *mockOpWrapper) {
+				files := []string{"foo/ref/a", "foo/ref/b", "foo/ref/c", "foo/ref/d"}
+				failingOp := func(operation connectOperation) error {
+					return errors.New("nope")
+				}
+
+				_, err := connectFiles(context.Background(), files, []outRoot{{dir: "foo/ref", outDir: "foo/out"}}, newConnectPlan(conflictError), 3, failingOp)
+				if assert.IsType(t, &multierror.MultiError{}, err) {
+					assert.Equal(t, 4, err.(*multierror.MultiError).Len())
+				}
+			},
+		},
+		{
+			name: "file in sibling of root",
+			test: func(t *testing.T, opWrapper *mockOpWrapper) {
+				files := hashlink.FileMap{
+					"src/a": []string{"foo/reference/a"},
+				}
+
+				_, err := connectMappedFiles(context.Background(), files, []outRoot{{dir: "foo/ref", outDir: "foo/out"}}, newConnectPlan(conflictError), 1, opWrapper.op)
+				assert.NotNil(t, err)
+				assert.ElementsMatch(t, []opArgs{}, opWrapper.calls)
+			},
+		},
 	}
 
 	runConnectTestTable(t, tests)
@@ -96,21 +176,21 @@ func TestConnectFiles(t *testing.T) {
 	tests := []connectTest{
 		{
 			name: "no files",
-			test: func(t *testing.T, opWrapper mockOpWrapper) {
-				err := connectFiles([]string{}, "foo/ref", "foo/out", opWrapper.op)
+			test: func(t *testing.T, opWrapper *mockOpWrapper) {
+				_, err := connectFiles(context.Background(), []string{}, []outRoot{{dir: "foo/ref", outDir: "foo/out"}}, newConnectPlan(conflictError), 1, opWrapper.op)
 				assert.Nil(t, err)
 				assert.ElementsMatch(t, []opArgs{}, opWrapper.calls)
 			},
 		},
 		{
 			name: "some files",
-			test: func(t *testing.T, opWrapper mockOpWrapper) {
+			test: func(t *testing.T, opWrapper *mockOpWrapper) {
 				files := []string{
 					"foo/ref/dir/a_file",
 					"foo/ref/another_file",
 				}
 
-				err := connectFiles(files, "foo/ref", "foo/out", opWrapper.op)
+				_, err := connectFiles(context.Background(), files, []outRoot{{dir: "foo/ref", outDir: "foo/out"}}, newConnectPlan(conflictError), 1, opWrapper.op)
 				assert.Nil(t, err)
 				assert.ElementsMatch(t, []opArgs{
 					{src: "foo/ref/dir/a_file", dst: "foo/out/dir/a_file"},
@@ -120,14 +200,14 @@ func TestConnectFiles(t *testing.T) {
 		},
 		{
 			name: "file not relative to reference dir",
-			test: func(t *testing.T, opWrapper mockOpWrapper) {
+			test: func(t *testing.T, opWrapper *mockOpWrapper) {
 				files := []string{
 					"foo/ref/dir/a_file",
 					"foo/ref/another_file",
 					"/wrong/location",
 				}
 
-				err := connectFiles(files, "foo/ref", "foo/out", opWrapper.op)
+				_, err := connectFiles(context.Background(), files, []outRoot{{dir: "foo/ref", outDir: "foo/out"}}, newConnectPlan(conflictError), 1, opWrapper.op)
 				assert.NotNil(t, err)
 				// We should still call op for all of the elements we can
 				assert.ElementsMatch(t, []opArgs{
@@ -136,6 +216,21 @@ func TestConnectFiles(t *testing.T) {
 				}, opWrapper.calls)
 			},
 		},
+		{
+			name: "interrupted",
+			test: func(t *testing.T, opWrapper *mockOpWrapper) {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				plan := newConnectPlan(conflictError)
+				results, err := connectFiles(ctx, []string{"foo/ref/a_file"}, []outRoot{{dir: "foo/ref", outDir: "foo/out"}}, plan, 1, opWrapper.op)
+				assert.Nil(t, err)
+				assert.Equal(t, 0, len(results))
+				assert.Equal(t, 0, len(opWrapper.calls))
+				assert.Equal(t, []unplannedFile{
+					{src: "foo/ref/a_file", dst: "foo/out/a_file", reason: reasonInterrupted},
+				}, plan.unplanned)
+			},
+		},
 	}
 
 	runConnectTestTable(t, tests)
@@ -154,6 +249,180 @@ func runFsTestTable(t *testing.T, table []fsTest) {
 	}
 }
 
+func TestMakeOutRoots(t *testing.T) {
+	tests := []fsTest{
+		{
+			name: "merged",
+			test: func(t *testing.T) {
+				roots := makeOutRoots([]string{"/mnt/a/photos", "/mnt/b/music"}, "out", false)
+				assert.Equal(t, []outRoot{
+					{dir: "/mnt/a/photos", outDir: "out"},
+					{dir: "/mnt/b/music", outDir: "out"},
+				}, roots)
+			},
+		},
+		{
+			name: "separate",
+			test: func(t *testing.T) {
+				roots := makeOutRoots([]string{"/mnt/a/photos/", "/mnt/b/music", "/mnt/c/photos", "."}, "out", true)
+				assert.Equal(t, []outRoot{
+					{dir: "/mnt/a/photos/", outDir: "out/photos"},
+					{dir: "/mnt/b/music", outDir: "out/music"},
+					{dir: "/mnt/c/photos", outDir: "out/photos-2"},
+					{dir: ".", outDir: "out/root"},
+				}, roots)
+			},
+		},
+	}
+
+	runFsTestTable(t, tests)
+}
+
+func TestMakeSrcOnlyRoots(t *testing.T) {
+	// assertInvalid checks that srcOnlyDir is rejected for both layouts.
+	assertInvalid := func(t *testing.T, srcOnlyDir string) {
+		for _, separate := range []bool{false, true} {
+			roots, err := makeSrcOnlyRoots([]string{"src"}, "out", srcOnlyDir, separate)
+			assert.Nil(t, roots)
+			assert.Equal(t, errInvalidSrcOnlyDir, err)
+		}
+	}
+
+	tests := []fsTest{
+		{
+			name: "merged",
+			test: func(t *testing.T) {
+				roots, err := makeSrcOnlyRoots([]string{"/mnt/a/photos", "/mnt/b/photos"}, "out", "src-only", false)
+				assert.Nil(t, err)
+				assert.Equal(t, []outRoot{
+					{dir: "/mnt/a/photos", outDir: "out/src-only"},
+					{dir: "/mnt/b/photos", outDir: "out/src-only"},
+				}, roots)
+			},
+		},
+		{
+			name: "separate",
+			test: func(t *testing.T) {
+				roots, err := makeSrcOnlyRoots([]string{"/mnt/a/photos", "/mnt/b/photos"}, "out", "src-only", true)
+				assert.Nil(t, err)
+				assert.Equal(t, []outRoot{
+					{dir: "/mnt/a/photos", outDir: "out/src-only/photos"},
+					{dir: "/mnt/b/photos", outDir: "out/src-only/photos-2"},
+				}, roots)
+			},
+		},
+		{
+			name: "nested and uncleaned",
+			test: func(t *testing.T) {
+				roots, err := makeSrcOnlyRoots([]string{"src"}, "out", "./extra/../only/src/", false)
+				assert.Nil(t, err)
+				assert.Equal(t, []outRoot{{dir: "src", outDir: "out/only/src"}}, roots)
+			},
+		},
+		{
+			name: "absolute",
+			test: func(t *testing.T) {
+				assertInvalid(t, "/tmp/src-only")
+			},
+		},
+		{
+			name: "out_dir itself",
+			test: func(t *testing.T) {
+				assertInvalid(t, ".")
+				assertInvalid(t, "")
+				assertInvalid(t, "src-only/..")
+			},
+		},
+		{
+			name: "escapes out_dir",
+			test: func(t *testing.T) {
+				assertInvalid(t, "..")
+				assertInvalid(t, "../src-only")
+				assertInvalid(t, "src-only/../../elsewhere")
+			},
+		},
+	}
+
+	runFsTestTable(t, tests)
+}
+
+func TestConnectFiles_SrcOnly(t *testing.T) {
+	files := []string{"/mnt/a/photos/x.jpg", "/mnt/a/photos/trip/y.jpg", "/mnt/b/photos/z.jpg"}
+	srcDirs := []string{"/mnt/a/photos", "/mnt/b/photos"}
+	tests := []connectTest{
+		{
+			name: "merged",
+			test: func(t *testing.T, opWrapper *mockOpWrapper) {
+				roots, err := makeSrcOnlyRoots(srcDirs, "out", "src-only", false)
+				assert.Nil(t, err)
+				_, err = connectFiles(context.Background(), files, roots, newConnectPlan(conflictError), 1, opWrapper.op)
+				assert.Nil(t, err)
+				assert.ElementsMatch(t, []opArgs{
+					{src: "/mnt/a/photos/x.jpg", dst: "out/src-only/x.jpg"},
+					{src: "/mnt/a/photos/trip/y.jpg", dst: "out/src-only/trip/y.jpg"},
+					{src: "/mnt/b/photos/z.jpg", dst: "out/src-only/z.jpg"},
+				}, opWrapper.calls)
+			},
+		},
+		{
+			name: "separate",
+			test: func(t *testing.T, opWrapper *mockOpWrapper) {
+				roots, err := makeSrcOnlyRoots(srcDirs, "out", "src-only", true)
+				assert.Nil(t, err)
+				_, err = connectFiles(context.Background(), files, roots, newConnectPlan(conflictError), 1, opWrapper.op)
+				assert.Nil(t, err)
+				assert.ElementsMatch(t, []opArgs{
+					{src: "/mnt/a/photos/x.jpg", dst: "out/src-only/photos/x.jpg"},
+					{src: "/mnt/a/photos/trip/y.jpg", dst: "out/src-only/photos/trip/y.jpg"},
+					{src: "/mnt/b/photos/z.jpg", dst: "out/src-only/photos-2/z.jpg"},
+				}, opWrapper.calls)
+			},
+		},
+	}
+
+	runConnectTestTable(t, tests)
+}
+
+func TestCrossDeviceError(t *testing.T) {
+	linkErr := &os.LinkError{Op: "link", Old: "a", New: "b", Err: syscall.EXDEV}
+	err := error(&crossDeviceError{err: linkErr})
+	assert.Equal(t, linkErr.Error()+": "+hashlink.ErrCrossDevice.Error(), err.Error())
+	assert.True(t, xerrors.Is(err, hashlink.ErrCrossDevice))
+	assert.True(t, xerrors.Is(err, syscall.EXDEV))
+	unwrappedErr := &os.LinkError{}
+	if assert.True(t, xerrors.As(err, &unwrappedErr)) {
+		assert.Equal(t, linkErr, unwrappedErr)
+	}
+
+	// The same must hold once wrapped as the connect functions do.
+	pathErr := error(&hashlink.PathError{Path: "a", Phase: hashlink.PhaseLink, Err: err})
+	assert.True(t, xerrors.Is(pathErr, hashlink.ErrCrossDevice))
+	assert.True(t, xerrors.Is(pathErr, syscall.EXDEV))
+}
+
+func TestOverwriteDestination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashlink-overwrite")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src.txt")
+	dst := filepath.Join(dir, "dst.txt")
+	assert.Nil(t, ioutil.WriteFile(src, []byte("new"), 0644))
+	assert.Nil(t, ioutil.WriteFile(dst, []byte("old"), 0644))
+
+	err = overwriteDestination(src, dst, copyFile)
+	assert.Nil(t, err)
+	contents, err := ioutil.ReadFile(dst)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(contents))
+	// The temporary file used to replace dst should not be left behind.
+	entries, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+}
+
 func TestRemoveExecuteBits(t *testing.T) {
 	tests := []fsTest{
 		{
@@ -17,87 +17,251 @@ package main
 */
 
 import (
+	"context"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/ollien/hashlink"
 	"github.com/ollien/hashlink/multierror"
+	"golang.org/x/xerrors"
 )
 
 // dirResult represents the result of generting the hashes of a directory
 type dirResult struct {
-	dir    string
 	hashes hashlink.PathHashes
-	err    error
+	// failures holds the files that could not be hashed, if they were skipped according to the error policy.
+	failures []unplannedFile
+	err      error
 }
 
-// getHashes will get all of the hashes needed from the given directories.
-func getHashes(srcDir, referenceDir string, numWorkers int) (srcHashes hashlink.PathHashes, referenceHashes hashlink.PathHashes, err error) {
+// getHashes will get all of the hashes needed from the given directories, with the hashes of all srcDirs and all
+// referenceDirs each merged together. If a directory has a manifest in manifests (keyed by the cleaned directory path),
+// it will be read rather than hashing the directory. Otherwise, if it has a file list in fileLists (keyed the same
+// way), only the listed files will be hashed, rather than walking the directory. If policy allows files that cannot be
+// hashed to be skipped, they are returned as failures (sorted by path), and err will only be set if hashing could not
+// continue, such as when more than policy.MaxErrors files failed across all directories. Files that fail with a
+// transient error are retried according to retry, and if stallTimeout is positive, files that no data can be read from
+// for that long are abandoned. Once ctx is done, hashing stops, and err will wrap the context's error.
+func getHashes(ctx context.Context, srcDirs, referenceDirs []string, numWorkers int, manifests map[string]string, fileLists map[string][]string, policy hashlink.ErrorPolicy, retry hashlink.RetryPolicy, stallTimeout time.Duration) (srcHashes hashlink.PathHashes, referenceHashes hashlink.PathHashes, failures []unplannedFile, err error) {
 	reporter := progressBarReporter{}
-	reporterAggregator := newProgressReporterAggregator(reporter, 2)
+	dirs := append(append([]string{}, srcDirs...), referenceDirs...)
+	reporterAggregator := newProgressReporterAggregator(reporter, len(dirs))
 
-	srcChan := getHashesForDir(srcDir, numWorkers, reporterAggregator)
-	referenceChan := getHashesForDir(referenceDir, numWorkers, reporterAggregator)
-	resultChan := mergeResultChannels(srcChan, referenceChan)
 	// Store our hashes in a map based on directory so we can get the proper return result
-	hashes := make(map[string]hashlink.PathHashes, 2)
-	errors := multierror.NewMultiError()
-	for result := range resultChan {
-		hashes[result.dir] = result.hashes
-		if result.err != nil {
-			errors.Append(result.err)
-		}
+	hashes := make(map[string]hashlink.PathHashes, len(dirs))
+	failures = []unplannedFile{}
+	resultLock := sync.Mutex{}
+	group, _ := multierror.NewGroup(context.Background())
+	for _, dir := range dirs {
+		dir := dir
+		group.Go(func(context.Context) error {
+			result := getHashesForDir(ctx, dir, numWorkers, manifests, fileLists, policy, retry, stallTimeout, reporterAggregator)
+			resultLock.Lock()
+			defer resultLock.Unlock()
+
+			hashes[dir] = result.hashes
+			failures = append(failures, result.failures...)
+
+			return result.err
+		})
 	}
 
+	errors := group.Wait()
+	// Each hasher only knows about the failures in its own directory, so the limit must be checked across all of them.
+	if errors == nil && policy.MaxErrors > 0 && len(failures) > policy.MaxErrors {
+		err := xerrors.Errorf("%d files could not be hashed, which is more than %d: %w", len(failures), policy.MaxErrors, hashlink.ErrHashingStopped)
+		errors = multierror.NewMultiError(err)
+	}
+
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].src < failures[j].src
+	})
+
 	// avoid returns with type nils by specifying our nil error here
 	retErr := error(nil)
-	if errors.Len() > 0 {
+	if errors != nil {
 		retErr = errors
 		reporter.abort()
 	} else {
 		reporter.finish()
 	}
 
-	return hashes[srcDir], hashes[referenceDir], retErr
+	return mergeDirHashes(hashes, srcDirs), mergeDirHashes(hashes, referenceDirs), failures, retErr
+}
+
+// mergeDirHashes merges the hashes of each of the given dirs into a single PathHashes.
+func mergeDirHashes(hashes map[string]hashlink.PathHashes, dirs []string) hashlink.PathHashes {
+	dirHashes := make([]hashlink.PathHashes, len(dirs))
+	for i, dir := range dirs {
+		dirHashes[i] = hashes[dir]
+	}
+
+	return hashlink.MergePathHashes(dirHashes...)
+}
+
+// getHashesForDir will get all of the hashes for the given dir.
+func getHashesForDir(ctx context.Context, dir string, numWorkers int, manifests map[string]string, fileLists map[string][]string, policy hashlink.ErrorPolicy, retry hashlink.RetryPolicy, stallTimeout time.Duration, aggregator *progressReporterAggregator) dirResult {
+	reporter := newSubAggregateProgressReporter(aggregator)
+	if manifestPath, haveManifest := manifests[filepath.Clean(dir)]; haveManifest {
+		hashes, err := readManifestFile(manifestPath, dir)
+		reporter.ReportProgress(hashlink.Progress(100))
+
+		return dirResult{hashes: hashes, failures: []unplannedFile{}, err: err}
+	}
+
+	// Our hashers never call this concurrently, so we need not lock failures.
+	failures := []unplannedFile{}
+	handler := func(path string, hash hash.Hash, err error) {
+		if err != nil {
+			failures = append(failures, unplannedFile{src: path, err: err})
+		}
+	}
+
+	hasher := getWalkHasher(ctx, numWorkers, reporter, fileLists[filepath.Clean(dir)], policy, retry, stallTimeout, handler)
+	hashes, err := hasher.WalkAndHash(dir)
+	if policy.KeepGoing && isOnlyFileErrors(err) {
+		err = nil
+	}
+
+	return dirResult{hashes: hashes, failures: failures, err: err}
+}
+
+// isOnlyFileErrors checks whether err, as returned by a hashlink.WalkHasher, only holds the errors of individual files
+// that were skipped, rather than an error that stopped hashing.
+func isOnlyFileErrors(err error) bool {
+	_, isMulti := err.(*multierror.MultiError)
+
+	return isMulti && !xerrors.Is(err, hashlink.ErrHashingStopped)
+}
+
+// readManifestFile reads the manifest at manifestPath, with all paths relative to dir.
+func readManifestFile(manifestPath, dir string) (hashlink.PathHashes, error) {
+	manifestFile, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, xerrors.Errorf("could not open manifest (%s): %w", manifestPath, err)
+	}
+
+	defer manifestFile.Close()
+	hashes, err := hashlink.ReadManifest(manifestFile, dir, hashAlgorithm)
+	if err != nil {
+		return nil, xerrors.Errorf("could not read manifest (%s): %w", manifestPath, err)
+	}
+
+	return hashes, nil
 }
 
-// getHashesForDir will get all of the hashes for the given dir, and report them onto the provided channel
-func getHashesForDir(dir string, numWorkers int, aggregator *progressReporterAggregator) <-chan dirResult {
-	resultChan := make(chan dirResult)
-	go func() {
-		reporter := newSubAggregateProgressReporter(aggregator)
-		hasher := getWalkHasher(numWorkers, reporter)
-		hashes, err := hasher.WalkAndHash(dir)
-		resultChan <- dirResult{
-			dir:    dir,
-			hashes: hashes,
-			err:    err,
+// readFileList reads a list of paths from the file at listPath, or from stdin if listPath is "-". Paths are separated by
+// NUL characters if nulSeparated is set, and by newlines otherwise. Empty entries are ignored.
+func readFileList(listPath string, nulSeparated bool) ([]string, error) {
+	reader := io.Reader(os.Stdin)
+	if listPath != "-" {
+		listFile, err := os.Open(listPath)
+		if err != nil {
+			return nil, xerrors.Errorf("could not open file list (%s): %w", listPath, err)
 		}
 
-		close(resultChan)
-	}()
+		defer listFile.Close()
+		reader = listFile
+	}
+
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, xerrors.Errorf("could not read file list (%s): %w", listPath, err)
+	}
+
+	separator := "\n"
+	if nulSeparated {
+		separator = "\x00"
+	}
+
+	paths := []string{}
+	for _, path := range strings.Split(string(contents), separator) {
+		// Allow lists with Windows line endings, such as those produced by a database query.
+		if !nulSeparated {
+			path = strings.TrimSuffix(path, "\r")
+		}
 
-	return resultChan
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths, nil
 }
 
-// mergeResultChannels will merge all channels of hashResult into a single channel.
-func mergeResultChannels(resultChannels ...<-chan dirResult) <-chan dirResult {
-	outChan := make(chan dirResult)
-	go func() {
-		waitGroup := sync.WaitGroup{}
-		for _, resultChan := range resultChannels {
-			waitGroup.Add(1)
-			go func(resultChan <-chan dirResult, outChan chan<- dirResult) {
-				for result := range resultChan {
-					outChan <- result
-				}
-				waitGroup.Done()
-			}(resultChan, outChan)
+// assignFileList assigns each of the given paths to the most specific of dirs that contains it. The result is keyed by
+// the cleaned directory path, and holds an entry for every one of dirs, even if no paths were assigned to it. Each
+// path is rewritten to be relative to the directory as it was given, so that it matches the paths a walk of that
+// directory would produce.
+func assignFileList(paths []string, dirs []string) (map[string][]string, error) {
+	absDirs := make([]string, len(dirs))
+	fileLists := make(map[string][]string, len(dirs))
+	for i, dir := range dirs {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, xerrors.Errorf("could not find absolute path of (%s): %w", dir, err)
+		}
+
+		absDirs[i] = absDir
+		fileLists[filepath.Clean(dir)] = []string{}
+	}
+
+	errors := multierror.NewMultiError()
+	for _, path := range paths {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			err = xerrors.Errorf("could not find absolute path of (%s): %w", path, err)
+			errors.Append(err)
+			continue
+		}
+
+		bestDir, bestRelPath := -1, ""
+		for i, absDir := range absDirs {
+			relPath, err := getContainedRelPath(absDir, absPath)
+			if err == nil && (bestDir == -1 || len(absDir) > len(absDirs[bestDir])) {
+				bestDir, bestRelPath = i, relPath
+			}
+		}
+
+		if bestDir == -1 {
+			err = xerrors.Errorf("listed file (%s) is not within any of (%s): %w", path, strings.Join(dirs, ", "), hashlink.ErrOutsideRoot)
+			errors.Append(err)
+			continue
 		}
 
-		// When we're done merging all of the results, we can safely close the channel
-		waitGroup.Wait()
-		close(outChan)
-	}()
+		dir := dirs[bestDir]
+		fileLists[filepath.Clean(dir)] = append(fileLists[filepath.Clean(dir)], filepath.Join(dir, bestRelPath))
+	}
+
+	if errors.Len() > 0 {
+		return nil, errors
+	}
+
+	return fileLists, nil
+}
+
+// hashFile hashes a single file with the same algorithm as the hashers produced by getWalkHasher. Any error will be a
+// *hashlink.PathError.
+func hashFile(path string) (hash.Hash, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, &hashlink.PathError{Path: path, Phase: hashlink.PhaseOpen, Err: err}
+	}
+
+	defer file.Close()
+	outHash := sha256.New()
+	_, err = io.Copy(outHash, file)
+	if err != nil {
+		return nil, &hashlink.PathError{Path: path, Phase: hashlink.PhaseRead, Err: err}
+	}
 
-	return outChan
+	return outHash, nil
 }
@@ -0,0 +1,154 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ollien/hashlink"
+	"github.com/ollien/hashlink/multierror"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+type hashTest struct {
+	name string
+	test func(t *testing.T)
+}
+
+func runHashTestTable(t *testing.T, table []hashTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t)
+		})
+	}
+}
+
+func TestReadFileList(t *testing.T) {
+	// writeList writes a file list with the given contents, and returns the directory holding it, and its path.
+	writeList := func(t *testing.T, contents string) (string, string) {
+		dir, err := ioutil.TempDir("", "hashlink-list")
+		assert.Nil(t, err)
+		listPath := filepath.Join(dir, "list")
+		assert.Nil(t, ioutil.WriteFile(listPath, []byte(contents), 0644))
+
+		return dir, listPath
+	}
+
+	tests := []hashTest{
+		{
+			name: "newline separated",
+			test: func(t *testing.T) {
+				dir, listPath := writeList(t, "a/b\nc d\r\n\ne\n")
+				defer os.RemoveAll(dir)
+				paths, err := readFileList(listPath, false)
+				assert.Nil(t, err)
+				assert.Equal(t, []string{"a/b", "c d", "e"}, paths)
+			},
+		},
+		{
+			name: "nul separated",
+			test: func(t *testing.T) {
+				dir, listPath := writeList(t, "a/b\x00c\nd\x00")
+				defer os.RemoveAll(dir)
+				paths, err := readFileList(listPath, true)
+				assert.Nil(t, err)
+				assert.Equal(t, []string{"a/b", "c\nd"}, paths)
+			},
+		},
+		{
+			name: "missing list",
+			test: func(t *testing.T) {
+				_, err := readFileList("/does/not/exist", false)
+				assert.NotNil(t, err)
+			},
+		},
+	}
+
+	runHashTestTable(t, tests)
+}
+
+func TestAssignFileList(t *testing.T) {
+	tests := []hashTest{
+		{
+			name: "most specific directory",
+			test: func(t *testing.T) {
+				fileLists, err := assignFileList([]string{"a/x", "a/b/y", "./a/b/../z"}, []string{"a", "a/b/", "c"})
+				assert.Nil(t, err)
+				assert.Equal(t, map[string][]string{
+					"a":   []string{"a/x", "a/z"},
+					"a/b": []string{"a/b/y"},
+					"c":   []string{},
+				}, fileLists)
+			},
+		},
+		{
+			name: "absolute paths",
+			test: func(t *testing.T) {
+				workingDir, err := os.Getwd()
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				fileLists, err := assignFileList([]string{filepath.Join(workingDir, "a", "x")}, []string{"a"})
+				assert.Nil(t, err)
+				assert.Equal(t, map[string][]string{"a": []string{"a/x"}}, fileLists)
+			},
+		},
+		{
+			name: "outside of every directory",
+			test: func(t *testing.T) {
+				_, err := assignFileList([]string{"a/x", "b/y"}, []string{"a"})
+				if assert.IsType(t, &multierror.MultiError{}, err) {
+					assert.True(t, xerrors.Is(err.(*multierror.MultiError).Errors()[0], hashlink.ErrOutsideRoot))
+				}
+			},
+		},
+	}
+
+	runHashTestTable(t, tests)
+}
+
+func TestIsOnlyFileErrors(t *testing.T) {
+	tests := []hashTest{
+		{
+			name: "skipped files",
+			test: func(t *testing.T) {
+				errors := multierror.NewMultiError(xerrors.New("could not open a"), xerrors.New("could not open b"))
+				assert.True(t, isOnlyFileErrors(errors))
+			},
+		},
+		{
+			name: "stopped early",
+			test: func(t *testing.T) {
+				errors := multierror.NewMultiError(xerrors.New("could not open a"), hashlink.ErrHashingStopped)
+				assert.False(t, isOnlyFileErrors(errors))
+			},
+		},
+		{
+			name: "walk failed",
+			test: func(t *testing.T) {
+				assert.False(t, isOnlyFileErrors(xerrors.New("could not walk")))
+			},
+		},
+	}
+
+	runHashTestTable(t, tests)
+}
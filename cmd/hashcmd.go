@@ -0,0 +1,254 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ollien/hashlink"
+	"github.com/ollien/hashlink/multierror"
+	"golang.org/x/xerrors"
+)
+
+// stdinListRoot is the root argument to the hash subcommand that reads a list of files from stdin, rather than
+// walking a directory.
+const stdinListRoot = "-"
+
+var errFrom0WithoutList = errors.New("-from0 given without a file list")
+
+// hashArgs holds the arguments for the hash subcommand.
+type hashArgs struct {
+	root         string
+	numWorkers   int
+	nulSeparated bool
+	logging      logArgs
+}
+
+// hashRecord describes a single hashed file. The JSON names of each field make up the documented output of the hash
+// subcommand; see the README for the meaning of each.
+type hashRecord struct {
+	Path string `json:"path"`
+	// Size, Mtime and Inode will be nil if they could not be determined.
+	Size   *int64     `json:"size"`
+	Mtime  *time.Time `json:"mtime"`
+	Inode  *uint64    `json:"inode"`
+	Digest string     `json:"digest,omitempty"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// runHash is the entrypoint for the hash subcommand, which hashes every file under a root and writes a hashRecord for
+// each as NDJSON, as soon as it has been hashed.
+func runHash(arguments []string) {
+	flags := flag.NewFlagSet("hash", flag.ExitOnError)
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: ./hashlink hash [-j n] [-v | -q] [-log-file file [-log-format format]] root")
+		fmt.Fprintln(os.Stderr, "       ./hashlink hash [-j n] [-from0] [-v | -q] [-log-file file [-log-format format]] -")
+		flags.PrintDefaults()
+	}
+
+	flags.Usage = usage
+	args, err := setupAndValidateHashArgs(flags, arguments)
+	if err != nil {
+		handleHashArgsError(err, args, usage)
+		os.Exit(exitUsage)
+	}
+
+	if args.root == stdinListRoot {
+		var fileList []string
+		fileList, err = readFileList(stdinListRoot, args.nulSeparated)
+		if err != nil {
+			handleError(err)
+			os.Exit(exitScanFailed)
+		}
+
+		err = writeListedHashRecords(os.Stdout, fileList, args.numWorkers)
+	} else {
+		err = writeHashRecords(os.Stdout, args.root, nil, args.numWorkers)
+	}
+
+	if err != nil {
+		handleError(err)
+		// Errors from hashing individual files are collected together, whereas a failed walk produces a single error.
+		if isOnlyFileErrors(err) {
+			os.Exit(exitFileErrors)
+		}
+
+		os.Exit(exitScanFailed)
+	}
+}
+
+// writeHashRecords hashes every file under root (or only those in fileList, if it is non-nil) with numWorkers
+// workers, and writes a hashRecord for each to writer. Files that cannot be hashed are written with their error, and
+// do not stop the rest from being hashed; their errors are returned together once every file has been written.
+func writeHashRecords(writer io.Writer, root string, fileList []string, numWorkers int) error {
+	options := []func(*hashlink.ParallelWalkHasher){
+		hashlink.ParallelWalkHasherResultHandler(makeHashRecordWriter(writer)),
+		hashlink.ParallelWalkHasherErrorPolicy(hashlink.ErrorPolicy{KeepGoing: true}),
+	}
+
+	if fileList != nil {
+		options = append(options, hashlink.ParallelWalkHasherFileList(fileList))
+	}
+
+	hasher := hashlink.NewParallelWalkHasher(numWorkers, sha256.New, options...)
+	_, err := hasher.WalkAndHash(root)
+
+	return err
+}
+
+func setupAndValidateHashArgs(flags *flag.FlagSet, arguments []string) (hashArgs, error) {
+	args := hashArgs{}
+	flags.IntVar(&args.numWorkers, "j", 1, "specify a number of workers")
+	flags.BoolVar(&args.nulSeparated, "from0", false, "the list of files read from stdin is NUL separated, as produced by find -print0, rather than newline separated")
+	registerLogFlags(flags, &args.logging)
+	// ExitOnError is set, so we will never get an error back.
+	_ = flags.Parse(arguments)
+	if args.numWorkers <= 0 {
+		return args, errInvalidNumberOfWorkers
+	} else if flags.NArg() != 1 {
+		return args, errWrongNumberOfArguments
+	}
+
+	// Our output is always JSON, so our errors should be too.
+	args.logging.errorFormat = jsonFormat
+	err := setupLogging(args.logging)
+	if err != nil {
+		return args, err
+	}
+
+	args.root = flags.Arg(0)
+	if args.root == stdinListRoot {
+		return args, nil
+	} else if args.nulSeparated {
+		return args, errFrom0WithoutList
+	}
+
+	return args, assertDirsExist(args.root)
+}
+
+// handleHashArgsError prints an appropriate message for an error produced by setupAndValidateHashArgs, followed by
+// the usage.
+func handleHashArgsError(err error, args hashArgs, usage func()) {
+	if err == errInvalidNumberOfWorkers {
+		fmt.Fprintf(os.Stderr, "Invalid number of workers (-j %d). Must be >= 1\n", args.numWorkers)
+	} else if err == errFrom0WithoutList {
+		fmt.Fprintln(os.Stderr, "-from0 may only be given when reading a list of files from stdin (-)")
+	} else if err == errInvalidLogFormat {
+		fmt.Fprintf(os.Stderr, "Invalid log format (%s). Must be one of text or json\n", args.logging.logFormat)
+	} else if err != errWrongNumberOfArguments {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	usage()
+}
+
+// writeListedHashRecords is like writeHashRecords, but hashes only the files in fileList, wherever they may be. Each
+// file is walked from the root of its volume (e.g. C:\ on Windows), as there is no single root that holds them all.
+func writeListedHashRecords(writer io.Writer, fileList []string, numWorkers int) error {
+	roots, rootFiles, err := groupByVolumeRoot(fileList)
+	if err != nil {
+		return err
+	}
+
+	fileErrors := multierror.NewMultiError()
+	for _, root := range roots {
+		err := writeHashRecords(writer, root, rootFiles[root], numWorkers)
+		if err != nil && !isOnlyFileErrors(err) {
+			return err
+		}
+
+		fileErrors.Append(err)
+	}
+
+	if fileErrors.Len() > 0 {
+		return fileErrors
+	}
+
+	return nil
+}
+
+// groupByVolumeRoot groups paths by the root of the volume that each is on, in the order each root was first seen.
+func groupByVolumeRoot(paths []string) (roots []string, rootPaths map[string][]string, err error) {
+	rootPaths = map[string][]string{}
+	for _, path := range paths {
+		// Relative paths have no volume name of their own, so we must look at the absolute path.
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("could not get absolute path of (%s): %w", path, err)
+		}
+
+		root := filepath.VolumeName(absPath) + string(filepath.Separator)
+		if _, seen := rootPaths[root]; !seen {
+			roots = append(roots, root)
+		}
+
+		rootPaths[root] = append(rootPaths[root], path)
+	}
+
+	return roots, rootPaths, nil
+}
+
+// makeHashRecordWriter makes a hashlink.HashResultHandler that writes a hashRecord for each result to writer, as a
+// single line of JSON.
+func makeHashRecordWriter(writer io.Writer) hashlink.HashResultHandler {
+	encoder := json.NewEncoder(writer)
+
+	return func(path string, hash hash.Hash, err error) {
+		record := makeHashRecord(path, hash, err)
+		encodeErr := encoder.Encode(record)
+		if encodeErr != nil {
+			handleError(xerrors.Errorf("could not write hash of (%s): %w", path, encodeErr))
+		}
+	}
+}
+
+// makeHashRecord makes a hashRecord for the result of hashing path.
+func makeHashRecord(path string, hash hash.Hash, err error) hashRecord {
+	record := hashRecord{Path: path}
+	info, statErr := os.Lstat(path)
+	if statErr == nil {
+		size := info.Size()
+		mtime := info.ModTime()
+		record.Size = &size
+		record.Mtime = &mtime
+		if inode, haveInode := inodeNumber(info); haveInode {
+			record.Inode = &inode
+		}
+	} else if err == nil {
+		err = xerrors.Errorf("could not stat (%s): %w", path, statErr)
+	}
+
+	if hash != nil {
+		record.Digest = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	return record
+}
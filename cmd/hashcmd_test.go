@@ -0,0 +1,196 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakeHashRecordWriter(t *testing.T) {
+	// writeRecord writes the record for a single result, and decodes it back into a map so that null fields can be
+	// distinguished from missing ones.
+	writeRecord := func(t *testing.T, path string, hashErr error) map[string]interface{} {
+		output := bytes.Buffer{}
+		hash := sha256.New()
+		if hashErr != nil {
+			hash = nil
+		} else {
+			hash.Write([]byte("hello"))
+		}
+
+		makeHashRecordWriter(&output)(path, hash, hashErr)
+		record := map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal(output.Bytes(), &record))
+
+		return record
+	}
+
+	tests := []hashTest{
+		{
+			name: "hashed file",
+			test: func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "hashlink-hash")
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				defer os.RemoveAll(dir)
+				path := filepath.Join(dir, "a")
+				assert.Nil(t, ioutil.WriteFile(path, []byte("hello"), 0644))
+				record := writeRecord(t, path, nil)
+				assert.Equal(t, path, record["path"])
+				assert.Equal(t, float64(5), record["size"])
+				assert.NotNil(t, record["mtime"])
+				assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", record["digest"])
+				assert.NotContains(t, record, "error")
+			},
+		},
+		{
+			name: "failed hash",
+			test: func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "hashlink-hash")
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				defer os.RemoveAll(dir)
+				path := filepath.Join(dir, "a")
+				assert.Nil(t, ioutil.WriteFile(path, []byte("hello"), 0644))
+				record := writeRecord(t, path, errors.New("could not read"))
+				assert.Equal(t, float64(5), record["size"])
+				assert.Equal(t, "could not read", record["error"])
+				assert.NotContains(t, record, "digest")
+			},
+		},
+		{
+			name: "file removed after hashing",
+			test: func(t *testing.T) {
+				record := writeRecord(t, "/does/not/exist", nil)
+				assert.Nil(t, record["size"])
+				assert.Nil(t, record["mtime"])
+				assert.Nil(t, record["inode"])
+				assert.Contains(t, record, "digest")
+				assert.Contains(t, record["error"], "could not stat")
+			},
+		},
+	}
+
+	runHashTestTable(t, tests)
+}
+
+func TestWriteListedHashRecords(t *testing.T) {
+	tests := []hashTest{
+		{
+			name: "failed file does not stop later files",
+			test: func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "hashlink-hash")
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				defer os.RemoveAll(dir)
+				missingPath := filepath.Join(dir, "missing")
+				fileList := []string{missingPath}
+				for _, name := range []string{"a", "b", "c", "d", "e"} {
+					path := filepath.Join(dir, name)
+					assert.Nil(t, ioutil.WriteFile(path, []byte(name), 0644))
+					fileList = append(fileList, path)
+				}
+
+				output := bytes.Buffer{}
+				err = writeListedHashRecords(&output, fileList, 2)
+				assert.True(t, isOnlyFileErrors(err))
+
+				records := map[string]hashRecord{}
+				decoder := json.NewDecoder(&output)
+				for decoder.More() {
+					record := hashRecord{}
+					if !assert.Nil(t, decoder.Decode(&record)) {
+						return
+					}
+
+					records[record.Path] = record
+				}
+
+				assert.Len(t, records, len(fileList))
+				assert.NotEmpty(t, records[missingPath].Error)
+				for _, path := range fileList[1:] {
+					assert.Empty(t, records[path].Error)
+					assert.NotEmpty(t, records[path].Digest)
+				}
+			},
+		},
+	}
+
+	runHashTestTable(t, tests)
+}
+
+func TestGroupByVolumeRoot(t *testing.T) {
+	tests := []hashTest{
+		{
+			name: "relative and absolute paths",
+			test: func(t *testing.T) {
+				wd, err := os.Getwd()
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				root := filepath.VolumeName(wd) + string(filepath.Separator)
+				absPath := filepath.Join(wd, "b")
+				roots, rootPaths, err := groupByVolumeRoot([]string{"a", absPath})
+				assert.Nil(t, err)
+				assert.Equal(t, []string{root}, roots)
+				// The paths themselves should be left as they were given.
+				assert.Equal(t, map[string][]string{root: {"a", absPath}}, rootPaths)
+			},
+		},
+		{
+			name: "several volumes",
+			test: func(t *testing.T) {
+				if runtime.GOOS != "windows" {
+					t.Skip("volumes only exist on Windows")
+				}
+
+				roots, rootPaths, err := groupByVolumeRoot([]string{`C:\a`, `D:\b`, `C:\c`})
+				assert.Nil(t, err)
+				assert.Equal(t, []string{`C:\`, `D:\`}, roots)
+				assert.Equal(t, map[string][]string{`C:\`: {`C:\a`, `C:\c`}, `D:\`: {`D:\b`}}, rootPaths)
+			},
+		},
+		{
+			name: "no paths",
+			test: func(t *testing.T) {
+				roots, rootPaths, err := groupByVolumeRoot([]string{})
+				assert.Nil(t, err)
+				assert.Empty(t, roots)
+				assert.Empty(t, rootPaths)
+			},
+		},
+	}
+
+	runHashTestTable(t, tests)
+}
@@ -0,0 +1,382 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ollien/hashlink/multierror"
+	"github.com/ollien/xtrace"
+	"golang.org/x/xerrors"
+)
+
+// logTimeFormat is the format of the timestamp of every record written to a log file.
+const logTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// maxQuietErrors is the number of errors printed to a quiet terminal, before the rest are only counted.
+const maxQuietErrors = 20
+
+var (
+	errInvalidLogFormat     = errors.New("invalid log format")
+	errConflictingVerbosity = errors.New("-v and -q cannot be used together")
+)
+
+// logLevel is the severity of a log record. Lower levels are more severe.
+type logLevel int
+
+const (
+	levelError logLevel = iota
+	levelWarn
+	levelInfo
+	levelDebug
+)
+
+// logField is a single key/value pair attached to a log record.
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// logArgs holds the flags that control logging, which are shared between subcommands.
+type logArgs struct {
+	verbose   bool
+	quiet     bool
+	logPath   string
+	logFormat string
+	// errorFormat is the format that errors are printed to the terminal in. It is not a flag, but follows the format
+	// of a command's output, so that errors may be read by the same tools.
+	errorFormat string
+}
+
+// logger writes human readable messages to the terminal, and timestamped structured records to a log file, if one is
+// set. Only records at or above terminalLevel reach the terminal, but every record is written to the log file.
+type logger struct {
+	lock          sync.Mutex
+	terminal      io.Writer
+	terminalLevel logLevel
+	// file will be nil if no log file is being written.
+	file       io.WriteCloser
+	fileFormat string
+	// errorFormat is the format of the errors printed to the terminal: text or json.
+	errorFormat string
+	now         func() time.Time
+}
+
+// runLog is the logger used for all diagnostics. It is configured by setupLogging.
+var runLog = newLogger(os.Stderr, levelInfo)
+
+// String gets the name of the level, as it appears in log records.
+func (level logLevel) String() string {
+	switch level {
+	case levelError:
+		return "error"
+	case levelWarn:
+		return "warn"
+	case levelInfo:
+		return "info"
+	case levelDebug:
+		return "debug"
+	default:
+		return "unknown"
+	}
+}
+
+// field makes a logField.
+func field(key string, value interface{}) logField {
+	return logField{key: key, value: value}
+}
+
+// newLogger makes a logger that writes records at or above terminalLevel to terminal, and has no log file.
+func newLogger(terminal io.Writer, terminalLevel logLevel) *logger {
+	return &logger{
+		terminal:      terminal,
+		terminalLevel: terminalLevel,
+		errorFormat:   textFormat,
+		now:           time.Now,
+	}
+}
+
+// registerLogFlags registers the flags that control logging, which are shared between subcommands.
+func registerLogFlags(flags *flag.FlagSet, args *logArgs) {
+	flags.BoolVar(&args.verbose, "v", false, "print every decision made about each file, in addition to the usual messages")
+	flags.BoolVar(&args.quiet, "q", false, "only print errors, along with the results of the command")
+	flags.StringVar(&args.logPath, "log-file", "", "append timestamped records of everything done, at every verbosity, to the given file")
+	flags.StringVar(&args.logFormat, "log-format", textFormat, "the format of the records written to -log-file: text or json")
+}
+
+// setupLogging configures runLog according to args.
+func setupLogging(args logArgs) error {
+	if args.verbose && args.quiet {
+		return errConflictingVerbosity
+	} else if args.logFormat != textFormat && args.logFormat != jsonFormat {
+		return errInvalidLogFormat
+	}
+
+	terminalLevel := levelInfo
+	if args.verbose {
+		terminalLevel = levelDebug
+	} else if args.quiet {
+		terminalLevel = levelError
+	}
+
+	runLog = newLogger(os.Stderr, terminalLevel)
+	if args.errorFormat != "" {
+		runLog.errorFormat = args.errorFormat
+	}
+
+	if args.logPath == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(args.logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return xerrors.Errorf("could not open log file: %w", err)
+	}
+
+	runLog.file = file
+	runLog.fileFormat = args.logFormat
+	runLog.debug("starting", field("args", os.Args[1:]))
+
+	return nil
+}
+
+// debug logs a message about an individual decision.
+func (log *logger) debug(message string, fields ...logField) {
+	log.log(levelDebug, message, fields)
+}
+
+// info logs a message about the progress of a run.
+func (log *logger) info(message string, fields ...logField) {
+	log.log(levelInfo, message, fields)
+}
+
+// warn logs a message about something that did not go as expected, but did not fail.
+func (log *logger) warn(message string, fields ...logField) {
+	log.log(levelWarn, message, fields)
+}
+
+// error logs an error. In JSON, the terminal receives it as a single element array, just as multiError would print it.
+// Otherwise, it receives a trace of every error that err wraps.
+func (log *logger) error(err error, fields ...logField) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	log.writeToFile(levelError, err.Error(), fields)
+	if log.errorFormat == jsonFormat {
+		encoded, encodeErr := json.Marshal(multierror.NewMultiError(err))
+		if encodeErr == nil {
+			fmt.Fprintf(log.terminal, "%s\n", encoded)
+			return
+		}
+	}
+
+	log.trace(err)
+}
+
+// multiError logs every error within multiErr. Every error is written to the log file, but how they are printed to the
+// terminal depends on its format and level. In JSON, they are printed as a single array. Otherwise, a quiet terminal
+// receives a numbered list of the first maxQuietErrors, and any other receives them in groups that share a root cause.
+func (log *logger) multiError(multiErr *multierror.MultiError) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	for _, err := range multiErr.Errors() {
+		log.writeToFile(levelError, err.Error(), nil)
+	}
+
+	if log.errorFormat == jsonFormat {
+		encoded, err := json.Marshal(multiErr)
+		if err == nil {
+			fmt.Fprintf(log.terminal, "%s\n", encoded)
+			return
+		}
+	}
+
+	if log.terminalLevel == levelError {
+		fmt.Fprint(log.terminal, multiErr.Lines(maxQuietErrors))
+		return
+	}
+
+	for i, group := range multiErr.Group() {
+		if i != 0 {
+			fmt.Fprintln(log.terminal)
+		}
+
+		log.traceGroup(group)
+	}
+}
+
+// traceGroup writes a group of errors that share a root cause to the terminal. Unless the terminal shows debug records,
+// it only receives a summary of the group, followed by a trace of its first error. log.lock must be held.
+func (log *logger) traceGroup(group multierror.ErrorGroup) {
+	if len(group.Errors) > 1 && log.terminalLevel < levelDebug {
+		fmt.Fprintf(log.terminal, "%s, such as\n", group)
+		log.trace(group.Errors[0])
+		return
+	}
+
+	for i, err := range group.Errors {
+		if i != 0 {
+			fmt.Fprintln(log.terminal)
+		}
+
+		log.trace(err)
+	}
+}
+
+// trace writes a trace of every error that err wraps to the terminal. log.lock must be held.
+func (log *logger) trace(err error) {
+	tracer, traceErr := xtrace.NewTracer(err)
+	if traceErr == nil {
+		traceErr = tracer.Trace(log.terminal)
+	}
+
+	// Being unable to trace shouldn't stop us from showing the error at all.
+	if traceErr != nil {
+		fmt.Fprint(log.terminal, err)
+	}
+
+	// Traces are not terminated with a newline.
+	fmt.Fprintln(log.terminal)
+}
+
+// close closes the log file, if there is one.
+func (log *logger) close() error {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	if log.file == nil {
+		return nil
+	}
+
+	err := log.file.Close()
+	log.file = nil
+
+	return err
+}
+
+// log writes a record to the log file, and to the terminal if level is at or above the terminal's level.
+func (log *logger) log(level logLevel, message string, fields []logField) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	log.writeToFile(level, message, fields)
+	if level > log.terminalLevel {
+		return
+	}
+
+	output := message
+	if len(fields) > 0 {
+		output += " " + formatLogFields(fields)
+	}
+
+	fmt.Fprintln(log.terminal, output)
+}
+
+// writeToFile writes a single record to the log file, if there is one. Text records are a line of key=value pairs,
+// starting with the same time, level and msg keys that JSON records hold. log.lock must be held. Failing to write a
+// record is not considered an error, as there is nowhere left to report it.
+func (log *logger) writeToFile(level logLevel, message string, fields []logField) {
+	if log.file == nil {
+		return
+	}
+
+	timestamp := log.now().Format(logTimeFormat)
+	if log.fileFormat == jsonFormat {
+		record := make(map[string]interface{}, len(fields)+3)
+		for _, logField := range fields {
+			record[logField.key] = logField.value
+			// Most errors have no exported fields, so they would otherwise be encoded as an empty object.
+			if err, isErr := logField.value.(error); isErr {
+				record[logField.key] = err.Error()
+			}
+		}
+
+		record["time"] = timestamp
+		record["level"] = level.String()
+		record["msg"] = message
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			return
+		}
+
+		_, _ = log.file.Write(append(encoded, '\n'))
+		return
+	}
+
+	recordFields := append([]logField{field("time", timestamp), field("level", level), field("msg", message)}, fields...)
+	_, _ = io.WriteString(log.file, formatLogFields(recordFields)+"\n")
+}
+
+// formatLogFields formats fields as space separated key=value pairs.
+func formatLogFields(fields []logField) string {
+	pairs := make([]string, len(fields))
+	for i, logField := range fields {
+		pairs[i] = logField.key + "=" + quoteLogValue(fmt.Sprint(logField.value))
+	}
+
+	return strings.Join(pairs, " ")
+}
+
+// quoteLogValue quotes value if it would otherwise be ambiguous within a line of key=value pairs.
+func quoteLogValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") || strconv.Quote(value) != "\""+value+"\"" {
+		return strconv.Quote(value)
+	}
+
+	return value
+}
+
+// logConnectResults records what was done with each connected file, with successful connections recorded as action.
+func logConnectResults(results []connectResult, action fileAction) {
+	for _, result := range results {
+		if result.err != nil {
+			runLog.debug(string(actionFailed), field("src", result.operation.src), field("dst", result.operation.dst), field("error", result.err))
+			continue
+		}
+
+		runLog.debug(string(action), field("src", result.operation.src), field("dst", result.operation.dst))
+	}
+}
+
+// logUnplanned records every file that a connectPlan decided not to connect.
+func logUnplanned(files []unplannedFile) {
+	for _, file := range files {
+		if file.err != nil {
+			runLog.debug(string(actionFailed), field("src", file.src), field("dst", file.dst), field("error", file.err))
+			continue
+		}
+
+		runLog.debug(string(actionSkipped), field("src", file.src), field("dst", file.dst), field("reason", file.reason))
+	}
+}
+
+// logSkipped records that every one of the given files was skipped for the given reason.
+func logSkipped(paths []string, reason string) {
+	for _, path := range paths {
+		runLog.debug(string(actionSkipped), field("src", path), field("reason", reason))
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ollien/hashlink/multierror"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+type logTest struct {
+	name string
+	test func(t *testing.T)
+}
+
+func runLogTestTable(t *testing.T, table []logTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t)
+		})
+	}
+}
+
+// bufferCloser is a bytes.Buffer that can stand in for a log file.
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (buffer *bufferCloser) Close() error {
+	return nil
+}
+
+// makeTestLogger makes a logger with a fixed clock, writing to the returned terminal and file buffers.
+func makeTestLogger(terminalLevel logLevel, fileFormat string) (*logger, *bytes.Buffer, *bufferCloser) {
+	terminal := &bytes.Buffer{}
+	file := &bufferCloser{}
+	log := newLogger(terminal, terminalLevel)
+	log.file = file
+	log.fileFormat = fileFormat
+	log.now = func() time.Time {
+		return time.Date(2019, 10, 18, 13, 37, 0, 0, time.UTC)
+	}
+
+	return log, terminal, file
+}
+
+func TestLogger(t *testing.T) {
+	tests := []logTest{
+		{
+			name: "text records",
+			test: func(t *testing.T) {
+				log, terminal, file := makeTestLogger(levelInfo, textFormat)
+				log.info("Scanning files...")
+				log.debug("linked", field("src", "src/a b"), field("dst", "out/a"))
+				assert.Equal(t, "Scanning files...\n", terminal.String())
+				assert.Equal(
+					t,
+					"time=2019-10-18T13:37:00.000Z level=info msg=\"Scanning files...\"\n"+
+						"time=2019-10-18T13:37:00.000Z level=debug msg=linked src=\"src/a b\" dst=out/a\n",
+					file.String(),
+				)
+			},
+		},
+		{
+			name: "json records",
+			test: func(t *testing.T) {
+				log, _, file := makeTestLogger(levelInfo, jsonFormat)
+				log.debug("failed", field("src", "src/a"), field("error", errors.New("no space left on device")))
+				assert.Equal(
+					t,
+					`{"error":"no space left on device","level":"debug","msg":"failed","src":"src/a","time":"2019-10-18T13:37:00.000Z"}`+"\n",
+					file.String(),
+				)
+			},
+		},
+		{
+			name: "verbose terminal",
+			test: func(t *testing.T) {
+				log, terminal, _ := makeTestLogger(levelDebug, textFormat)
+				log.debug("skipped", field("src", "ref/b"), field("reason", ""))
+				assert.Equal(t, "skipped src=ref/b reason=\"\"\n", terminal.String())
+			},
+		},
+		{
+			name: "quiet terminal",
+			test: func(t *testing.T) {
+				log, terminal, file := makeTestLogger(levelError, textFormat)
+				log.warn("Leaving file in place")
+				log.error(errors.New("could not link"))
+				assert.Equal(t, "could not link\n", terminal.String())
+				assert.Contains(t, file.String(), "level=warn")
+				assert.Contains(t, file.String(), "level=error msg=\"could not link\"")
+			},
+		},
+		{
+			name: "grouped errors",
+			test: func(t *testing.T) {
+				errDenied := errors.New("permission denied")
+				multiErr := multierror.NewMultiError(
+					xerrors.Errorf("could not open a: %w", errDenied),
+					xerrors.Errorf("could not open b: %w", errDenied),
+				)
+
+				log, terminal, file := makeTestLogger(levelInfo, textFormat)
+				log.multiError(multiErr)
+				assert.Contains(t, terminal.String(), "2 × permission denied, such as\n")
+				assert.NotContains(t, terminal.String(), "could not open b")
+				assert.Contains(t, file.String(), "msg=\"could not open b: permission denied\"")
+
+				log, terminal, _ = makeTestLogger(levelDebug, textFormat)
+				log.multiError(multiErr)
+				assert.Contains(t, terminal.String(), "could not open a")
+				assert.Contains(t, terminal.String(), "could not open b")
+			},
+		},
+		{
+			name: "quiet errors",
+			test: func(t *testing.T) {
+				multiErr := multierror.NewMultiError()
+				for i := 0; i < maxQuietErrors+5; i++ {
+					multiErr.Append(errors.New("could not link"))
+				}
+
+				log, terminal, _ := makeTestLogger(levelError, textFormat)
+				log.multiError(multiErr)
+				assert.Equal(t, multiErr.Lines(maxQuietErrors), terminal.String())
+				assert.Contains(t, terminal.String(), "... and 5 more\n")
+			},
+		},
+		{
+			name: "json errors",
+			test: func(t *testing.T) {
+				log, terminal, _ := makeTestLogger(levelInfo, textFormat)
+				log.errorFormat = jsonFormat
+				log.multiError(multierror.NewMultiError(errors.New("could not link")))
+				assert.Equal(t, `[{"index":1,"error":"could not link","cause":"could not link"}]`+"\n", terminal.String())
+			},
+		},
+		{
+			name: "single json error",
+			test: func(t *testing.T) {
+				log, terminal, _ := makeTestLogger(levelInfo, textFormat)
+				log.errorFormat = jsonFormat
+				log.error(xerrors.Errorf("could not read manifest: %w", errors.New("no such file")))
+				assert.Equal(t, `[{"index":1,"error":"could not read manifest: no such file","cause":"no such file"}]`+"\n", terminal.String())
+			},
+		},
+	}
+
+	runLogTestTable(t, tests)
+}
+
+func TestSetupLogging(t *testing.T) {
+	defer func() {
+		runLog = newLogger(os.Stderr, levelInfo)
+	}()
+
+	assert.Equal(t, errConflictingVerbosity, setupLogging(logArgs{verbose: true, quiet: true, logFormat: textFormat}))
+	assert.Equal(t, errInvalidLogFormat, setupLogging(logArgs{logFormat: "xml"}))
+	assert.Nil(t, setupLogging(logArgs{quiet: true, logFormat: jsonFormat}))
+	assert.Equal(t, levelError, runLog.terminalLevel)
+}
@@ -17,6 +17,7 @@ package main
 */
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
@@ -24,10 +25,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"time"
 
 	"github.com/ollien/hashlink"
 	"github.com/ollien/hashlink/multierror"
-	"github.com/ollien/xtrace"
 	"golang.org/x/xerrors"
 )
 
@@ -35,30 +38,129 @@ var (
 	errWrongNumberOfArguments = errors.New("wrong number of arguments")
 	errInvalidNumberOfWorkers = errors.New("invalid number of workers")
 	errOutDirNotEmpty         = errors.New("out_dir not empty")
+	errInvalidLayout          = errors.New("invalid layout")
+	errInvalidOutputFormat    = errors.New("invalid output format")
+	errInvalidSrcOnlyDir      = errors.New("invalid src-only directory")
+	errBothListsFromStdin     = errors.New("both file lists from stdin")
+	errInvalidMaxErrors       = errors.New("invalid maximum number of errors")
+	errInvalidRetries         = errors.New("invalid retries")
+	errInvalidStallTimeout    = errors.New("invalid stall timeout")
 )
 
+// Formats that the output of a subcommand can be written in.
+const (
+	textFormat = "text"
+	jsonFormat = "json"
+)
+
+const (
+	// mergedLayout places the files from every reference_dir directly into out_dir.
+	mergedLayout = "merged"
+	// separateLayout places the files from each reference_dir into its own subdirectory of out_dir.
+	separateLayout = "separate"
+)
+
+// hashAlgorithm is the name of the algorithm produced by getWalkHasher's hashers, as it would appear in a manifest.
+const hashAlgorithm = "sha256"
+
+// maxRetryBackoff is the longest that -retries will wait between attempts, no matter how many have been made.
+const maxRetryBackoff = time.Minute
+
 // cliArgs rpresents the arguments that can be passed to the entrypoint command
 type cliArgs struct {
-	dryRun       bool
-	copyMissing  bool
-	numWorkers   int
-	srcDir       string
-	referenceDir string
-	outDir       string
+	dryRun      bool
+	copyMissing bool
+	numWorkers  int
+	// numConnectWorkers is the number of workers used to link and copy, which is independent of numWorkers as
+	// connecting is often bound by a different device than hashing.
+	numConnectWorkers int
+	layout            string
+	reportPath        string
+	reportFormat      string
+	onConflict        conflictPolicy
+	srcDirs           []string
+	referenceDirs     []string
+	outDir            string
+	// outRoots holds where the files from each of referenceDirs will be placed within outDir.
+	outRoots []outRoot
+	// manifests holds the checksum file to use in place of hashing a directory, keyed by the cleaned directory path.
+	manifests map[string]string
+	// fileLists holds the files to hash in place of walking a directory, keyed by the cleaned directory path.
+	fileLists      map[string][]string
+	includeSrcOnly bool
+	// srcOnlyDir is the subdirectory of outDir that files only present in srcDirs are linked into, if includeSrcOnly
+	// is set.
+	srcOnlyDir string
+	// srcOnlyRoots holds where the files from each of srcDirs will be placed within srcOnlyDir.
+	srcOnlyRoots []outRoot
+	// If scriptPath is set, the planned operations will be written to it, and to rsyncListPath if it is set, rather than
+	// being performed.
+	scriptPath    string
+	rsyncListPath string
+	// If keepGoing is set, files that cannot be hashed will be skipped, unless there are more than maxErrors of them.
+	// A maxErrors of zero allows any number of files to be skipped.
+	keepGoing bool
+	maxErrors int
+	// retries is the number of times an operation that fails with a transient error is retried, with the first retry
+	// waiting for retryBackoff.
+	retries      int
+	retryBackoff time.Duration
+	// stallTimeout is how long a file may go without any data being read from it before it is abandoned, if positive.
+	stallTimeout time.Duration
+	logging      logArgs
+}
+
+// dirFlags holds the flags used to specify the directories that a command will operate on.
+type dirFlags struct {
+	srcDirs       stringSliceFlag
+	referenceDirs stringSliceFlag
+	manifestPaths stringSliceFlag
+	// srcListPath and referenceListPath hold the file lists to use in place of walking each side, if any.
+	srcListPath       string
+	referenceListPath string
+	nulSeparatedLists bool
+}
+
+// subcommands holds the entrypoint for each subcommand, keyed by the name given as the first argument. Each
+// entrypoint is given the remaining arguments.
+var subcommands = map[string]func(arguments []string){
+	"verify":      runVerify,
+	"dupes":       runDupes,
+	"diff":        runDiff,
+	"rename-sync": runRenameSync,
+	"hash":        runHash,
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		subcommand, isSubcommand := subcommands[os.Args[1]]
+		if isSubcommand {
+			subcommand(os.Args[2:])
+			return
+		}
+	}
+
 	args, err := setupAndValidateArgs()
 	if err != nil {
-		handleArgsError(err, args)
-		os.Exit(1)
+		handleArgsError(err, args, Usage)
+		os.Exit(exitUsage)
 	}
 
-	fmt.Println("Scanning files...")
-	srcHashes, referenceHashes, err := getHashes(args.srcDir, args.referenceDir, args.numWorkers)
-	if err != nil {
+	status := newRunStatus()
+	ctx, stopHandlingSignals := handleSignals(status)
+	defer stopHandlingSignals()
+	runLog.info("Scanning files...")
+	status.startPhase("Scanning files", -1)
+	policy := hashlink.ErrorPolicy{KeepGoing: args.keepGoing, MaxErrors: args.maxErrors}
+	retries := newRetryCounter()
+	retry := hashlink.RetryPolicy{MaxAttempts: args.retries + 1, InitialBackoff: args.retryBackoff, MaxBackoff: maxRetryBackoff, OnRetry: retries.recordHash}
+	srcHashes, referenceHashes, hashFailures, err := getHashes(ctx, args.srcDirs, args.referenceDirs, args.numWorkers, args.manifests, args.fileLists, policy, retry, args.stallTimeout)
+	if err != nil && ctx.Err() != nil {
+		finishInterruptedScan(args, hashlink.MergePathHashes(srcHashes, referenceHashes), hashFailures, retries)
+		os.Exit(exitInterrupted)
+	} else if err != nil {
 		handleError(err)
-		os.Exit(1)
+		os.Exit(exitScanFailed)
 	}
 
 	// Create a mapping of src files to reference files
@@ -66,131 +168,445 @@ func main() {
 	// In order to get the files missing from the reference directory, we must flip our file map into reference => src order
 	flippedFiles := hashlink.MakeFlippedFileMap(identicalFiles)
 	missingFiles := hashlink.GetUnmappedFiles(referenceHashes, flippedFiles)
-	fmt.Println("Done scanning.")
-	if len(missingFiles) > 0 {
-		missingFilesOutput, err := makeIndentedJSONOutput(missingFiles)
-		if err != nil {
-			err = xerrors.Errorf("could not generate missing file output: %w", err)
-			handleError(err)
-			os.Exit(1)
-		}
+	srcOnlyFiles := hashlink.GetUnmappedFiles(srcHashes, identicalFiles)
+	sort.Strings(missingFiles)
+	sort.Strings(srcOnlyFiles)
+	runLog.info("Done scanning.")
+	missingHeading := "The following files in reference_dir have no counterpart in src_dir, and will not be linked."
+	if args.copyMissing {
+		missingHeading = "The following files in reference_dir have no counterpart in src_dir, and will be copied."
+	}
 
-		fmt.Printf("The following files will not be linked.\n%v\n", missingFilesOutput)
-	} else {
-		fmt.Print("\n")
+	err = printFileList(missingHeading, missingFiles)
+	if err != nil {
+		handleError(err)
+		os.Exit(exitFailed)
+	}
+
+	srcOnlyHeading := "The following files in src_dir have no counterpart in reference_dir, and will not be linked."
+	if args.includeSrcOnly {
+		srcOnlyHeading = fmt.Sprintf("The following files in src_dir have no counterpart in reference_dir, and will be linked into %s.", args.srcOnlyDir)
+	}
+
+	err = printFileList(srcOnlyHeading, srcOnlyFiles)
+	if err != nil {
+		handleError(err)
+		os.Exit(exitFailed)
 	}
 
-	fmt.Printf("Linking %d files...\n", len(identicalFiles))
-	op := getConnectFunction(args.dryRun, os.Link)
-	err = connectMappedFiles(identicalFiles, args.referenceDir, args.outDir, op)
+	fmt.Print("\n")
+	emitter, err := makeOperationEmitter(args)
 	if err != nil {
 		handleError(err)
-		os.Exit(1)
+		os.Exit(exitFailed)
 	}
 
+	report := newRunReport(args.dryRun, hashlink.MergePathHashes(srcHashes, referenceHashes))
+	report.retries = retries
+	plan := newConnectPlan(args.onConflict)
+	// Errors for individual files do not stop the run, so that every phase is attempted. They are reported at the end.
+	fileErrors := multierror.NewMultiError()
+	logUnplanned(hashFailures)
+	report.addUnplanned(hashFailures)
+	for _, failure := range hashFailures {
+		fileErrors.Append(failure.err)
+	}
+
+	runLog.info(fmt.Sprintf("Linking %d files...", len(identicalFiles)))
+	status.startPhase("Linking", len(identicalFiles))
+	op := status.track(getConnectFunction(ctx, args.dryRun, emitter, linkMethod, retry, retries))
+	space := spaceSummary{}
+	results, err := connectMappedFiles(ctx, identicalFiles, args.outRoots, plan, args.numConnectWorkers, op)
+	logConnectResults(results, actionLinked)
+	report.addConnectResults(results, actionLinked)
+	space.addConnectResults(results, false)
+	fileErrors.Append(err)
 	if args.copyMissing {
-		fmt.Printf("Copying %d files...\n", len(missingFiles))
-		op = getConnectFunction(args.dryRun, copyFile)
-		err = connectFiles(missingFiles, args.referenceDir, args.outDir, op)
-		if err != nil {
-			handleError(err)
-			os.Exit(1)
-		}
+		runLog.info(fmt.Sprintf("Copying %d files...", len(missingFiles)))
+		status.startPhase("Copying", len(missingFiles))
+		op = status.track(getConnectFunction(ctx, args.dryRun, emitter, copyMethod, retry, retries))
+		results, err = connectFiles(ctx, missingFiles, args.outRoots, plan, args.numConnectWorkers, op)
+		logConnectResults(results, actionCopied)
+		report.addConnectResults(results, actionCopied)
+		space.addConnectResults(results, true)
+		fileErrors.Append(err)
+	} else {
+		logSkipped(missingFiles, reasonNotCopied)
+		report.addSkipped(missingFiles, reasonNotCopied)
+	}
+
+	if args.includeSrcOnly {
+		runLog.info(fmt.Sprintf("Linking %d files only in src_dir...", len(srcOnlyFiles)))
+		status.startPhase("Linking files only in src_dir", len(srcOnlyFiles))
+		op = status.track(getConnectFunction(ctx, args.dryRun, emitter, linkMethod, retry, retries))
+		results, err = connectFiles(ctx, srcOnlyFiles, args.srcOnlyRoots, plan, args.numConnectWorkers, op)
+		logConnectResults(results, actionLinked)
+		report.addConnectResults(results, actionLinked)
+		space.addConnectResults(results, false)
+		fileErrors.Append(err)
+	} else {
+		logSkipped(srcOnlyFiles, reasonNoMatch)
+		report.addSkipped(srcOnlyFiles, reasonNoMatch)
+	}
+
+	logUnplanned(plan.unplanned)
+	report.addUnplanned(plan.unplanned)
+	status.startPhase("Writing the results", -1)
+	// If either of these fail, the run's output is incomplete, even if every file was connected.
+	outputErrors := multierror.NewMultiError()
+	outputErrors.Append(finishReport(args, report))
+	outputErrors.Append(finishEmitting(args, emitter))
+	if fileErrors.Len() > 0 {
+		handleError(fileErrors)
+	}
+
+	if outputErrors.Len() > 0 {
+		handleError(outputErrors)
 	}
 
-	output := "Done processing. Enjoy your files :)"
 	if args.dryRun {
 		copiedFiles := []string{}
 		if args.copyMissing {
 			copiedFiles = missingFiles
 		}
 
-		output = getDryRunOutput(identicalFiles, copiedFiles)
+		linkedSrcOnlyFiles := []string{}
+		if args.includeSrcOnly {
+			linkedSrcOnlyFiles = srcOnlyFiles
+		}
+
+		fmt.Println(getDryRunOutput(identicalFiles, copiedFiles, linkedSrcOnlyFiles))
+		fmt.Printf("\nThis run would use the following space.\n%s", space)
+	} else {
+		fmt.Printf("This run used the following space.\n%s", space)
+	}
+
+	counts := report.countActions()
+	fmt.Printf("\nSummary of this run.\n%s", formatActionCounts(counts))
+	if ctx.Err() != nil {
+		runLog.warn("The run was interrupted; the files that were not connected are listed as skipped.")
+		os.Exit(exitInterrupted)
 	}
 
-	fmt.Println(output)
+	exitCode := getRunExitCode(counts, outputErrors.Len() > 0)
+	if exitCode != exitSuccess {
+		os.Exit(exitCode)
+	}
+
+	runLog.info("Done processing. Enjoy your files :)")
 }
 
 // Usage specifies the usage for the cmd package.
 func Usage() {
-	fmt.Fprintln(os.Stderr, "Usage: ./hashlink [-j n] [-n] [-c] src_dir reference_dir out_dir")
+	fmt.Fprintln(os.Stderr, "Usage: ./hashlink [-j n] [-link-j n] [-n] [-c] [-manifest file]... [-src-list file] [-reference-list file] [-from0] [-on-conflict policy] [-report file [-report-format format]] [-include-src-only [-src-only-dir dir]] [-script file [-rsync-list file]] [-keep-going] [-max-errors n] [-retries n [-retry-backoff duration]] [-stall-timeout duration] [-v | -q] [-log-file file [-log-format format]] src_dir reference_dir out_dir")
+	fmt.Fprintln(os.Stderr, "       ./hashlink [-j n] [-link-j n] [-n] [-c] [-manifest file]... [-src-list file] [-reference-list file] [-from0] [-on-conflict policy] [-report file [-report-format format]] [-include-src-only [-src-only-dir dir]] [-script file [-rsync-list file]] [-keep-going] [-max-errors n] [-retries n [-retry-backoff duration]] [-stall-timeout duration] [-layout merged|separate] [-v | -q] [-log-file file [-log-format format]] -src dir... -reference dir... out_dir")
+	fmt.Fprintln(os.Stderr, "       ./hashlink verify [-j n] [-c] [-manifest file]... [-src-list file] [-reference-list file] [-from0] [-layout merged|separate] [-v | -q] [-log-file file [-log-format format]] src_dir reference_dir out_dir")
+	fmt.Fprintln(os.Stderr, "       ./hashlink verify [-j n] [-c] [-manifest file]... [-src-list file] [-reference-list file] [-from0] [-layout merged|separate] [-v | -q] [-log-file file [-log-format format]] -src dir... -reference dir... out_dir")
+	fmt.Fprintln(os.Stderr, "       ./hashlink dupes [-j n] [-sort wasted|size|path] [-format text|json] [-v | -q] [-log-file file [-log-format format]] dir...")
+	fmt.Fprintln(os.Stderr, "       ./hashlink diff [-j n] [-manifest file]... [-identical] [-format text|json] [-v | -q] [-log-file file [-log-format format]] dir_a dir_b")
+	fmt.Fprintln(os.Stderr, "       ./hashlink rename-sync [-j n] [-n] [-manifest file]... [-v | -q] [-log-file file [-log-format format]] target_dir reference_dir")
+	fmt.Fprintln(os.Stderr, "       ./hashlink hash [-j n] [-v | -q] [-log-file file [-log-format format]] root")
+	fmt.Fprintln(os.Stderr, "       ./hashlink hash [-j n] [-from0] [-v | -q] [-log-file file [-log-format format]] -")
 	flag.PrintDefaults()
 }
 
 func setupAndValidateArgs() (cliArgs, error) {
 	args := cliArgs{}
+	dirs := dirFlags{}
+	onConflict := ""
 	flag.Usage = Usage
 	flag.IntVar(&args.numWorkers, "j", 1, "specify a number of workers")
+	flag.IntVar(&args.numConnectWorkers, "link-j", 1, "specify a number of workers for linking and copying files")
 	flag.BoolVar(&args.dryRun, "n", false, "do not link any files, but print out what files would have been linked")
 	flag.BoolVar(&args.copyMissing, "c", false, "copy the files that are missing from src_dir")
+	flag.StringVar(&onConflict, "on-conflict", "error", "what to do when a destination already exists: error, skip, rename or overwrite. out_dir may be non-empty unless this is error")
+	flag.StringVar(&args.reportPath, "report", "", "write a report of what was done with every file to the given file")
+	flag.StringVar(&args.reportFormat, "report-format", reportFormatJSON, "the format of the report given by -report: json, ndjson or csv")
+	flag.StringVar(&args.scriptPath, "script", "", "write the planned operations to the given file as a shell script, rather than performing them; implies -n")
+	flag.StringVar(&args.rsyncListPath, "rsync-list", "", "write the files to copy to the given file as a NUL separated list for rsync's --files-from, rather than copying them; implies -n")
+	flag.BoolVar(&args.includeSrcOnly, "include-src-only", false, "also link the files that are only in src_dir into out_dir, under the directory given by -src-only-dir")
+	flag.StringVar(&args.srcOnlyDir, "src-only-dir", "src-only", "the subdirectory of out_dir to link the files that are only in src_dir into, with -include-src-only")
+	flag.BoolVar(&args.keepGoing, "keep-going", false, "skip the files that cannot be hashed, rather than stopping before anything is linked")
+	flag.IntVar(&args.maxErrors, "max-errors", 0, "stop before anything is linked if more than the given number of files cannot be hashed; implies -keep-going. 0 means no limit")
+	flag.IntVar(&args.retries, "retries", 0, "retry reading, linking or copying a file that fails with a transient I/O error (e.g. EIO or ESTALE) up to the given number of times")
+	flag.DurationVar(&args.retryBackoff, "retry-backoff", 100*time.Millisecond, "how long to wait before the first retry given by -retries; every retry after it waits twice as long")
+	flag.DurationVar(&args.stallTimeout, "stall-timeout", 0, "give up on a file that no data has been read from for the given duration (e.g. 30s), such as one on a hung mount. 0 means no limit")
+	registerDirFlags(flag.CommandLine, &args, &dirs)
+	registerLogFlags(flag.CommandLine, &args.logging)
 	flag.Parse()
-	if flag.NArg() != 3 {
-		return cliArgs{}, errWrongNumberOfArguments
-	} else if args.numWorkers <= 0 {
-		return cliArgs{}, errInvalidNumberOfWorkers
+	if args.numWorkers <= 0 || args.numConnectWorkers <= 0 {
+		return args, errInvalidNumberOfWorkers
+	} else if args.maxErrors < 0 {
+		return args, errInvalidMaxErrors
+	} else if args.retries < 0 || args.retryBackoff < 0 {
+		return args, errInvalidRetries
+	} else if args.stallTimeout < 0 {
+		return args, errInvalidStallTimeout
+	} else if args.maxErrors > 0 {
+		args.keepGoing = true
+	}
+
+	err := setupLogging(args.logging)
+	if err != nil {
+		return args, err
+	}
+
+	args.onConflict, err = parseConflictPolicy(onConflict)
+	if err != nil {
+		return args, err
+	}
+
+	err = validateReportFormat(args.reportFormat)
+	if err != nil {
+		return args, err
 	}
 
-	args.srcDir = flag.Arg(0)
-	args.referenceDir = flag.Arg(1)
-	args.outDir = flag.Arg(2)
-	err := assertDirsExist(args.srcDir, args.referenceDir, args.outDir)
+	err = setupDirArgs(&args, dirs, flag.Args())
 	if err != nil {
 		return args, err
 	}
 
+	if args.rsyncListPath != "" && args.scriptPath == "" {
+		return args, errRsyncListWithoutScript
+	} else if args.rsyncListPath != "" && len(args.referenceDirs) != 1 {
+		return args, errRsyncListReferences
+	} else if args.scriptPath != "" {
+		// Nothing will be changed if we are writing the operations out, so we can behave just as a dry run would.
+		args.dryRun = true
+	}
+
+	if args.includeSrcOnly {
+		args.srcOnlyRoots, err = makeSrcOnlyRoots(args.srcDirs, args.outDir, args.srcOnlyDir, args.layout == separateLayout)
+		if err != nil {
+			return args, err
+		}
+	}
+
+	// If we have been told how to deal with existing files, there's no need to require an empty directory.
 	err = assertDirEmpty(args.outDir)
-	if !args.dryRun && err != nil {
+	if !args.dryRun && args.onConflict == conflictError && err != nil {
 		return args, err
 	}
 
 	return args, nil
 }
 
-func handleArgsError(err error, args cliArgs) {
+// registerDirFlags registers the flags that are used to specify directories, which are shared between subcommands.
+func registerDirFlags(flags *flag.FlagSet, args *cliArgs, dirs *dirFlags) {
+	flags.Var(&dirs.srcDirs, "src", "use the given src_dir; may be repeated, in which case out_dir is the only positional argument")
+	flags.Var(&dirs.referenceDirs, "reference", "use the given reference_dir; may be repeated, in which case out_dir is the only positional argument")
+	flags.Var(&dirs.manifestPaths, "manifest", "use a checksum file (e.g. SHA256SUMS) in place of hashing the directory containing it; may be repeated")
+	flags.StringVar(&dirs.srcListPath, "src-list", "", "hash only the files listed in the given file (or stdin, if -) rather than walking each src_dir")
+	flags.StringVar(&dirs.referenceListPath, "reference-list", "", "hash only the files listed in the given file (or stdin, if -) rather than walking each reference_dir")
+	flags.BoolVar(&dirs.nulSeparatedLists, "from0", false, "the lists given by -src-list and -reference-list are NUL separated, as produced by find -print0, rather than newline separated")
+	flags.StringVar(&args.layout, "layout", mergedLayout, "place the files from each reference_dir directly into out_dir (merged), or into a subdirectory named after each (separate)")
+}
+
+// setupDirArgs fills in the directories of args from the given flags and positional arguments, which are either
+// src_dir, reference_dir and out_dir, or only out_dir if -src and -reference were given.
+func setupDirArgs(args *cliArgs, dirs dirFlags, positional []string) error {
+	if len(dirs.srcDirs) == 0 && len(dirs.referenceDirs) == 0 && len(positional) == 3 {
+		args.srcDirs = positional[0:1]
+		args.referenceDirs = positional[1:2]
+		args.outDir = positional[2]
+	} else if len(dirs.srcDirs) > 0 && len(dirs.referenceDirs) > 0 && len(positional) == 1 {
+		args.srcDirs = dirs.srcDirs
+		args.referenceDirs = dirs.referenceDirs
+		args.outDir = positional[0]
+	} else {
+		return errWrongNumberOfArguments
+	}
+
+	if args.layout != mergedLayout && args.layout != separateLayout {
+		return errInvalidLayout
+	}
+
+	allDirs := append(append([]string{}, args.srcDirs...), args.referenceDirs...)
+	err := assertDirsExist(append(allDirs, args.outDir)...)
+	if err != nil {
+		return err
+	}
+
+	args.manifests, err = makeManifestMap(dirs.manifestPaths, allDirs...)
+	if err != nil {
+		return err
+	}
+
+	args.fileLists, err = makeFileLists(dirs, args.srcDirs, args.referenceDirs)
+	if err != nil {
+		return err
+	}
+
+	args.outRoots = makeOutRoots(args.referenceDirs, args.outDir, args.layout == separateLayout)
+
+	return nil
+}
+
+// handleArgsError prints a description of the given argument error, followed by the given usage.
+func handleArgsError(err error, args cliArgs, usage func()) {
 	if err == errInvalidNumberOfWorkers {
-		fmt.Fprintf(os.Stderr, "Invalid number of workers (%d). Must be >= 1\n", args.numWorkers)
+		fmt.Fprintf(os.Stderr, "Invalid number of workers (-j %d, -link-j %d). Must be >= 1\n", args.numWorkers, args.numConnectWorkers)
+	} else if err == errInvalidConflictPolicy {
+		fmt.Fprintln(os.Stderr, "Invalid conflict policy. Must be one of error, skip, rename or overwrite")
+	} else if err == errInvalidReportFormat {
+		fmt.Fprintf(os.Stderr, "Invalid report format (%s). Must be one of json, ndjson or csv\n", args.reportFormat)
+	} else if err == errInvalidMaxErrors {
+		fmt.Fprintf(os.Stderr, "Invalid maximum number of errors (-max-errors %d). Must be >= 0\n", args.maxErrors)
+	} else if err == errInvalidRetries {
+		fmt.Fprintf(os.Stderr, "Invalid retries (-retries %d, -retry-backoff %s). Must be >= 0\n", args.retries, args.retryBackoff)
+	} else if err == errInvalidStallTimeout {
+		fmt.Fprintf(os.Stderr, "Invalid stall timeout (%s). Must be >= 0\n", args.stallTimeout)
+	} else if err == errBothListsFromStdin {
+		fmt.Fprintln(os.Stderr, "Only one of -src-list and -reference-list may be read from stdin")
+	} else if err == errRsyncListWithoutScript {
+		fmt.Fprintln(os.Stderr, "-rsync-list must be used alongside -script, as rsync can't produce links")
+	} else if err == errRsyncListReferences {
+		fmt.Fprintln(os.Stderr, "-rsync-list can only be used with exactly one reference_dir")
+	} else if err == errInvalidSrcOnlyDir {
+		fmt.Fprintf(os.Stderr, "Invalid src-only directory (%s). Must be a subdirectory of out_dir\n", args.srcOnlyDir)
+	} else if err == errInvalidLayout {
+		fmt.Fprintf(os.Stderr, "Invalid layout (%s). Must be one of %s or %s\n", args.layout, mergedLayout, separateLayout)
 	} else if err == errOutDirNotEmpty {
 		fmt.Fprintf(os.Stderr, "The provided out_dir (%s) is non-empty. Cowardly refusing to run.\n", args.outDir)
+	} else if err == errInvalidLogFormat {
+		fmt.Fprintf(os.Stderr, "Invalid log format (%s). Must be one of text or json\n", args.logging.logFormat)
 	} else if err != errWrongNumberOfArguments {
 		// If we have errWrongNumberOfArguments, we don't need to do any special handling other than the usage string.
 		fmt.Fprintln(os.Stderr, err)
 	}
 
-	Usage()
+	usage()
 }
 
+// handleError logs err to the terminal in the format chosen by the command. In JSON, its errors are printed as an array,
+// even if err is not a MultiError. Otherwise, a MultiError is printed as a numbered and truncated list on a quiet
+// terminal and grouped by root cause on any other, while any other error is printed as a trace.
 func handleError(err error) {
 	multiErr, isMulti := err.(*multierror.MultiError)
 	if isMulti {
-		for i, singleError := range multiErr.Errors() {
-			xtrace.Trace(singleError)
-			if i != multiErr.Len()-1 {
-				fmt.Fprintf(os.Stderr, "\n")
-			}
-		}
+		runLog.multiError(multiErr)
 	} else {
-		xtrace.Trace(err)
+		runLog.error(err)
+	}
+}
+
+// makeOperationEmitter makes an operationEmitter for the outputs requested in args, or returns nil if none were.
+func makeOperationEmitter(args cliArgs) (*operationEmitter, error) {
+	if args.scriptPath == "" {
+		return nil, nil
+	}
+
+	rsyncRoot := outRoot{}
+	if args.rsyncListPath != "" {
+		// This is guaranteed by setupAndValidateArgs.
+		rsyncRoot = args.outRoots[0]
+	}
+
+	return newOperationEmitter(args.scriptPath, args.rsyncListPath, rsyncRoot)
+}
+
+// finishEmitting finishes writing the outputs of emitter, if there is one, and explains how to use them.
+func finishEmitting(args cliArgs, emitter *operationEmitter) error {
+	if emitter == nil {
+		return nil
+	}
+
+	err := emitter.close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote the planned operations to %s. Review it, then run it with sh.\n", args.scriptPath)
+
+	if args.rsyncListPath != "" {
+		fmt.Printf("Wrote the files to copy to %s. Review it, then run\n\t%s\n", args.rsyncListPath, emitter.rsyncCommand())
+	}
+
+	return nil
+}
+
+// finishInterruptedScan finishes a run that was interrupted while its directories were being hashed. Nothing has been
+// linked by then, so every file that was hashed is recorded as skipped, and the run's report, script and summary are
+// written as usual.
+func finishInterruptedScan(args cliArgs, hashes hashlink.PathHashes, failures []unplannedFile, retries *retryCounter) {
+	runLog.warn("Interrupted before anything was linked.")
+	hashedFiles := make([]string, 0, len(hashes))
+	for path := range hashes {
+		hashedFiles = append(hashedFiles, path)
+	}
+
+	sort.Strings(hashedFiles)
+	report := newRunReport(args.dryRun, hashes)
+	report.retries = retries
+	logUnplanned(failures)
+	report.addUnplanned(failures)
+	logSkipped(hashedFiles, reasonInterrupted)
+	report.addSkipped(hashedFiles, reasonInterrupted)
+
+	outputErrors := multierror.NewMultiError()
+	outputErrors.Append(finishReport(args, report))
+	emitter, err := makeOperationEmitter(args)
+	outputErrors.Append(err)
+	if err == nil {
+		outputErrors.Append(finishEmitting(args, emitter))
 	}
+
+	if outputErrors.Len() > 0 {
+		handleError(outputErrors)
+	}
+
+	fmt.Printf("\nSummary of this run.\n%s", formatActionCounts(report.countActions()))
+}
+
+// finishReport writes the run report to the file requested in args, if any.
+func finishReport(args cliArgs, report *runReport) error {
+	if args.reportPath == "" {
+		return nil
+	}
+
+	err := report.writeToFile(args.reportPath, args.reportFormat)
+	if err != nil {
+		return xerrors.Errorf("could not write run report: %w", err)
+	}
+
+	return nil
 }
 
-// getConnectFunction gives a nop function if dryRun is true, otherwise ensureContainingDirsArePresent and then fallback
-// are run.
-func getConnectFunction(dryRun bool, fallback connectFunction) connectFunction {
-	if dryRun {
-		return func(src, dst string) error {
+// getConnectFunction gives a function that writes each operation out with emitter if it is non-nil, a nop function if
+// dryRun is true, and otherwise a function that will ensureContainingDirsArePresent and then connect using method. In
+// the last case, connecting is retried according to retry until ctx is done, with every retry recorded in retries if it
+// is non-nil, and any error will be a *hashlink.PathError for the src file.
+func getConnectFunction(ctx context.Context, dryRun bool, emitter *operationEmitter, method connectMethod, retry hashlink.RetryPolicy, retries *retryCounter) operationFunction {
+	if emitter != nil {
+		return func(operation connectOperation) error {
+			return emitter.emit(operation, method)
+		}
+	} else if dryRun {
+		return func(operation connectOperation) error {
 			return nil
 		}
 	}
 
-	return func(src, dst string) error {
+	fallback := method.function()
+	return func(operation connectOperation) error {
+		src, dst := operation.src, operation.dst
 		err := ensureContainingDirsArePresent(dst)
 		if err != nil {
-			return xerrors.Errorf("could not ensure containing directories exst for connecting (%s => %s): %w", src, dst, err)
+			err = xerrors.Errorf("could not ensure containing directories exst for connecting (%s => %s): %w", src, dst, err)
+			return &hashlink.PathError{Path: src, Phase: method.phase(), Err: err}
 		}
 
-		err = fallback(src, dst)
+		err = retries.connectPolicy(retry, operation).Do(ctx, src, func() error {
+			if operation.overwrite {
+				return overwriteDestination(src, dst, fallback)
+			}
+
+			return fallback(src, dst)
+		})
+
 		if err != nil {
-			return xerrors.Errorf("could not connect files (%s => %s): %w", src, dst, err)
+			err = xerrors.Errorf("could not connect files (%s => %s): %w", src, dst, err)
+			return &hashlink.PathError{Path: src, Phase: method.phase(), Err: err}
 		}
 
 		return nil
@@ -221,6 +637,76 @@ func assertDirsExist(dirs ...string) error {
 	return nil
 }
 
+// makeManifestMap maps each of the given manifests to the directory containing it. Each manifest must be located
+// directly within one of dirs.
+func makeManifestMap(manifestPaths []string, dirs ...string) (map[string]string, error) {
+	manifests := make(map[string]string, len(manifestPaths))
+	errors := multierror.NewMultiError()
+	for _, manifestPath := range manifestPaths {
+		manifestDir := filepath.Dir(filepath.Clean(manifestPath))
+		isKnownDir := false
+		for _, dir := range dirs {
+			if filepath.Clean(dir) == manifestDir {
+				isKnownDir = true
+				break
+			}
+		}
+
+		if !isKnownDir {
+			err := fmt.Errorf("manifest %s is not located directly in a src_dir or reference_dir", manifestPath)
+			errors.Append(err)
+			continue
+		}
+
+		manifests[manifestDir] = manifestPath
+	}
+
+	if errors.Len() > 0 {
+		return nil, errors
+	}
+
+	return manifests, nil
+}
+
+// makeFileLists reads the file lists given in dirs, and assigns their files to the directories on the corresponding
+// side. The result is keyed by the cleaned directory path, and only holds directories that had a list given for them.
+func makeFileLists(dirs dirFlags, srcDirs, referenceDirs []string) (map[string][]string, error) {
+	if dirs.srcListPath == "-" && dirs.referenceListPath == "-" {
+		return nil, errBothListsFromStdin
+	}
+
+	fileLists := map[string][]string{}
+	sides := []struct {
+		listPath string
+		dirs     []string
+	}{
+		{dirs.srcListPath, srcDirs},
+		{dirs.referenceListPath, referenceDirs},
+	}
+
+	for _, side := range sides {
+		if side.listPath == "" {
+			continue
+		}
+
+		paths, err := readFileList(side.listPath, dirs.nulSeparatedLists)
+		if err != nil {
+			return nil, err
+		}
+
+		sideLists, err := assignFileList(paths, side.dirs)
+		if err != nil {
+			return nil, err
+		}
+
+		for dir, paths := range sideLists {
+			fileLists[dir] = paths
+		}
+	}
+
+	return fileLists, nil
+}
+
 // assertDirEmpty will return nil if the given directory is empty, and an error otherwise.
 func assertDirEmpty(dir string) error {
 	contents, err := ioutil.ReadDir(dir)
@@ -235,11 +721,28 @@ func assertDirEmpty(dir string) error {
 	return nil
 }
 
+// printFileList prints the given heading, followed by the given files, if there are any.
+func printFileList(heading string, files []string) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	output, err := makeIndentedJSONOutput(files)
+	if err != nil {
+		return xerrors.Errorf("could not generate file list output: %w", err)
+	}
+
+	fmt.Printf("%s\n%v\n", heading, output)
+
+	return nil
+}
+
 // getDryRunOutput gets the output for the termination of the program when the dryRun flag is provided.
-func getDryRunOutput(identicalFiles hashlink.FileMap, copiedFiles []string) string {
+func getDryRunOutput(identicalFiles hashlink.FileMap, copiedFiles, linkedSrcOnlyFiles []string) string {
 	type output struct {
-		Linked []string `json:"linked"`
-		Copied []string `json:"copied,omitempty"`
+		Linked        []string `json:"linked"`
+		Copied        []string `json:"copied,omitempty"`
+		LinkedSrcOnly []string `json:"linked_src_only,omitempty"`
 	}
 
 	linkedFiles := make([]string, len(identicalFiles))
@@ -249,10 +752,10 @@ func getDryRunOutput(identicalFiles hashlink.FileMap, copiedFiles []string) stri
 		i++
 	}
 
-	out, err := makeIndentedJSONOutput(output{Linked: linkedFiles, Copied: copiedFiles})
+	out, err := makeIndentedJSONOutput(output{Linked: linkedFiles, Copied: copiedFiles, LinkedSrcOnly: linkedSrcOnlyFiles})
 	if err != nil {
 		handleError(err)
-		os.Exit(1)
+		os.Exit(exitFailed)
 	}
 
 	return out
@@ -265,14 +768,42 @@ func makeIndentedJSONOutput(target interface{}) (string, error) {
 	return string(out), err
 }
 
-// getWalkHasher gets the approrpiate WalkHasher based on the number of workers.
-func getWalkHasher(numWorkers int, reporter hashlink.ProgressReporter) hashlink.WalkHasher {
+// getWalkHasher gets the approrpiate WalkHasher based on the number of workers. If fileList is non-nil, the hasher will
+// only hash the files in it, rather than walking its root. handler will be called with the result of every file, and
+// the hasher will stop once ctx is done.
+func getWalkHasher(ctx context.Context, numWorkers int, reporter hashlink.ProgressReporter, fileList []string, policy hashlink.ErrorPolicy, retry hashlink.RetryPolicy, stallTimeout time.Duration, handler hashlink.HashResultHandler) hashlink.WalkHasher {
 	// If we only have one worker, there's no point in spinning up a parallel hash walker.
 	if numWorkers > 1 {
-		return hashlink.NewParallelWalkHasher(numWorkers, sha256.New, hashlink.ParallelWalkHasherProgressReporter(reporter))
+		options := []func(*hashlink.ParallelWalkHasher){
+			hashlink.ParallelWalkHasherProgressReporter(reporter),
+			hashlink.ParallelWalkHasherErrorPolicy(policy),
+			hashlink.ParallelWalkHasherRetryPolicy(retry),
+			hashlink.ParallelWalkHasherStallTimeout(stallTimeout),
+			hashlink.ParallelWalkHasherContext(ctx),
+			hashlink.ParallelWalkHasherResultHandler(handler),
+		}
+
+		if fileList != nil {
+			options = append(options, hashlink.ParallelWalkHasherFileList(fileList))
+		}
+
+		return hashlink.NewParallelWalkHasher(numWorkers, sha256.New, options...)
+	}
+
+	options := []func(*hashlink.SerialWalkHasher){
+		hashlink.SerialWalkHasherProgressReporter(reporter),
+		hashlink.SerialWalkHasherErrorPolicy(policy),
+		hashlink.SerialWalkHasherRetryPolicy(retry),
+		hashlink.SerialWalkHasherStallTimeout(stallTimeout),
+		hashlink.SerialWalkHasherContext(ctx),
+		hashlink.SerialWalkHasherResultHandler(handler),
+	}
+
+	if fileList != nil {
+		options = append(options, hashlink.SerialWalkHasherFileList(fileList))
 	}
 
-	return hashlink.NewSerialWalkHasher(sha256.New, hashlink.SerialWalkHasherProgressReporter(reporter))
+	return hashlink.NewSerialWalkHasher(sha256.New, options...)
 }
 
 // getKeysFromFileMap gets all of the files that are keys of a given FileMap
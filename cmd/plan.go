@@ -0,0 +1,302 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ollien/hashlink"
+	"github.com/ollien/hashlink/multierror"
+	"golang.org/x/xerrors"
+)
+
+// conflictPolicy dictates what happens when a destination is already taken.
+type conflictPolicy int
+
+const (
+	// conflictError reports an error for the conflicting file, and does not connect it.
+	conflictError conflictPolicy = iota
+	// conflictSkip leaves the existing destination in place, and does not connect the conflicting file.
+	conflictSkip
+	// conflictRename connects the conflicting file under a new name alongside the existing destination.
+	conflictRename
+	// conflictOverwrite replaces an existing destination with the conflicting file.
+	conflictOverwrite
+)
+
+var (
+	errInvalidConflictPolicy = errors.New("invalid conflict policy")
+	errDestinationConflict   = errors.New("destination already taken")
+)
+
+// Reasons that a file may be left unconnected by a connectPlan.
+const (
+	reasonDuplicateSource     = "an identical src file was used instead"
+	reasonIdenticalPlanned    = "an identical file was already planned for the destination"
+	reasonDestinationPlanned  = "another file was already planned for the destination"
+	reasonDestinationExists   = "destination already exists"
+	reasonDestinationIsSource = "destination is already this file"
+	reasonInterrupted         = "the run was interrupted before the file was connected"
+)
+
+// connectOperation represents a single planned connection from a src file to its destination.
+type connectOperation struct {
+	src string
+	dst string
+	// If overwrite is set, dst already exists, and should be replaced.
+	overwrite bool
+}
+
+// unplannedFile represents a file that a connectPlan decided not to connect.
+type unplannedFile struct {
+	src string
+	// dst may be empty if no destination could be determined.
+	dst string
+	// reason holds why the file was skipped, if it was skipped intentionally.
+	reason string
+	// err holds why the file could not be planned, if it was not skipped intentionally.
+	err error
+}
+
+// connectPlan ensures that no two operations are planned for the same destination, and decides what to do with
+// destinations that already exist. A single plan should be shared across all of the phases of a run, so that
+// conflicts between phases are also caught.
+type connectPlan struct {
+	policy conflictPolicy
+	// destinations maps every planned destination to the files it was planned for.
+	destinations map[string]plannedDestination
+	// unplanned holds every file that has been left unconnected.
+	unplanned []unplannedFile
+}
+
+// plannedDestination records the files that a destination has been planned for.
+type plannedDestination struct {
+	src       string
+	reference string
+}
+
+// parseConflictPolicy parses the value of the -on-conflict flag.
+func parseConflictPolicy(policy string) (conflictPolicy, error) {
+	switch policy {
+	case "error":
+		return conflictError, nil
+	case "skip":
+		return conflictSkip, nil
+	case "rename":
+		return conflictRename, nil
+	case "overwrite":
+		return conflictOverwrite, nil
+	default:
+		return conflictError, errInvalidConflictPolicy
+	}
+}
+
+// newConnectPlan makes a connectPlan that will resolve conflicts with the given policy.
+func newConnectPlan(policy conflictPolicy) *connectPlan {
+	return &connectPlan{
+		policy:       policy,
+		destinations: map[string]plannedDestination{},
+	}
+}
+
+// planMappedFiles plans the operations needed to connect all provided files (expected in src => reference order)
+// into the given roots. Exactly one src file is used for each reference file. If a reference file cannot be planned,
+// an error is returned for it, but all other files will still be planned.
+func (plan *connectPlan) planMappedFiles(files hashlink.FileMap, roots []outRoot) ([]connectOperation, error) {
+	uniqueFiles := hashlink.AssignUniqueSources(files)
+	srcFiles := make([]string, 0, len(files))
+	for srcFile := range files {
+		_, isUsed := uniqueFiles[srcFile]
+		if !isUsed {
+			plan.unplanned = append(plan.unplanned, unplannedFile{src: srcFile, reason: reasonDuplicateSource})
+			continue
+		}
+
+		srcFiles = append(srcFiles, srcFile)
+	}
+
+	// Sort everything we plan, so that conflicts are always resolved in the same way.
+	sort.Strings(srcFiles)
+	operations := []connectOperation{}
+	errors := multierror.NewMultiError()
+	for _, srcFile := range srcFiles {
+		referenceFiles := append([]string{}, uniqueFiles[srcFile]...)
+		sort.Strings(referenceFiles)
+		for _, referenceFile := range referenceFiles {
+			operation, planned, err := plan.planFile(srcFile, referenceFile, roots)
+			if err != nil {
+				err = xerrors.Errorf("could not plan link for file (%s): %w", srcFile, err)
+				errors.Append(err)
+			} else if planned {
+				operations = append(operations, operation)
+			}
+		}
+	}
+
+	if errors.Len() > 0 {
+		return operations, errors
+	}
+
+	return operations, nil
+}
+
+// planFiles plans the operations needed to connect all provided files into the given roots. If a file cannot be
+// planned, an error is returned for it, but all other files will still be planned.
+func (plan *connectPlan) planFiles(files []string, roots []outRoot) ([]connectOperation, error) {
+	sortedFiles := append([]string{}, files...)
+	sort.Strings(sortedFiles)
+	operations := []connectOperation{}
+	errors := multierror.NewMultiError()
+	for _, file := range sortedFiles {
+		// file can safely act as its own reference file, as we are still operating relative to it.
+		operation, planned, err := plan.planFile(file, file, roots)
+		if err != nil {
+			err = xerrors.Errorf("could not plan connection for file (%s): %w", file, err)
+			errors.Append(err)
+		} else if planned {
+			operations = append(operations, operation)
+		}
+	}
+
+	if errors.Len() > 0 {
+		return operations, errors
+	}
+
+	return operations, nil
+}
+
+// planFile plans an operation to connect srcPath to the destination of referencePath. If the destination has already
+// been planned for another reference file, or already exists, the plan's policy is applied; planned will be false if
+// no operation should take place. Any file that is not planned is recorded in the plan's unplanned files.
+func (plan *connectPlan) planFile(srcPath, referencePath string, roots []outRoot) (operation connectOperation, planned bool, err error) {
+	operation, skipReason, err := plan.resolveDestination(srcPath, referencePath, roots)
+	if err != nil {
+		plan.unplanned = append(plan.unplanned, unplannedFile{src: srcPath, dst: operation.dst, err: err})
+		return connectOperation{}, false, err
+	} else if skipReason != "" {
+		plan.unplanned = append(plan.unplanned, unplannedFile{src: srcPath, dst: operation.dst, reason: skipReason})
+		return connectOperation{}, false, nil
+	}
+
+	plan.destinations[operation.dst] = plannedDestination{src: srcPath, reference: referencePath}
+
+	return operation, true, nil
+}
+
+// resolveDestination finds the destination for srcPath, given that it is being connected in place of referencePath.
+// If the file should not be connected, skipReason will hold why. The returned operation will always hold the intended
+// destination, if one could be determined.
+func (plan *connectPlan) resolveDestination(srcPath, referencePath string, roots []outRoot) (operation connectOperation, skipReason string, err error) {
+	dst, err := getOutPath(referencePath, roots)
+	if err != nil {
+		return connectOperation{}, "", xerrors.Errorf("could not produce out path: %w", err)
+	}
+
+	operation = connectOperation{src: srcPath, dst: dst}
+	planned, isPlanned := plan.destinations[dst]
+	if isPlanned && (planned.reference == referencePath || planned.src == srcPath) {
+		// Either this exact file has already been planned, or an identical one has (as they share a src file), so
+		// there's nothing left to do.
+		return operation, reasonIdenticalPlanned, nil
+	} else if isPlanned {
+		switch plan.policy {
+		case conflictRename:
+			operation.dst = plan.findFreeDestination(dst)
+			return operation, "", nil
+		case conflictError:
+			err = xerrors.Errorf("(%s) and (%s) both map to (%s): %w", planned.reference, referencePath, dst, errDestinationConflict)
+			return operation, "", err
+		default:
+			// Neither skipping nor overwriting would leave anything but the file we already planned, so we leave it be.
+			return operation, reasonDestinationPlanned, nil
+		}
+	}
+
+	dstInfo, err := os.Lstat(dst)
+	if os.IsNotExist(err) {
+		return operation, "", nil
+	} else if err != nil {
+		return operation, "", xerrors.Errorf("could not check for existing destination (%s): %w", dst, err)
+	}
+
+	srcInfo, err := os.Stat(srcPath)
+	if err == nil && os.SameFile(srcInfo, dstInfo) {
+		return operation, reasonDestinationIsSource, nil
+	}
+
+	switch plan.policy {
+	case conflictSkip:
+		return operation, reasonDestinationExists, nil
+	case conflictRename:
+		operation.dst = plan.findFreeDestination(dst)
+	case conflictOverwrite:
+		operation.overwrite = true
+	default:
+		return operation, "", xerrors.Errorf("(%s) exists: %w", dst, errDestinationConflict)
+	}
+
+	return operation, "", nil
+}
+
+// findFreeDestination finds a variant of dst that has not been planned, and does not exist on disk.
+func (plan *connectPlan) findFreeDestination(dst string) string {
+	return findFreePath(dst, func(candidate string) bool {
+		_, isTaken := plan.destinations[candidate]
+
+		return isTaken
+	})
+}
+
+// findFreePath finds the first variant of filePath, in the form "name (n).ext", that is neither taken according to
+// isTaken nor present on disk.
+func findFreePath(filePath string, isTaken func(candidate string) bool) string {
+	extension := filepath.Ext(filePath)
+	stem := strings.TrimSuffix(filePath, extension)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", stem, i, extension)
+		if isTaken(candidate) {
+			continue
+		}
+
+		// If we can't tell whether the candidate exists, we may as well use it; connecting will fail with a more useful
+		// error than we could give here.
+		_, err := os.Lstat(candidate)
+		if err != nil {
+			return candidate
+		}
+	}
+}
+
+// addUnattempted records every one of operations that has no result in results as unplanned, with the given reason.
+// Used for the operations that were never started, such as when a run is interrupted.
+func (plan *connectPlan) addUnattempted(operations []connectOperation, results []connectResult, reason string) {
+	attempted := make(map[string]bool, len(results))
+	for _, result := range results {
+		attempted[result.operation.dst] = true
+	}
+
+	for _, operation := range operations {
+		if !attempted[operation.dst] {
+			plan.unplanned = append(plan.unplanned, unplannedFile{src: operation.src, dst: operation.dst, reason: reason})
+		}
+	}
+}
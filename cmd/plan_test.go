@@ -0,0 +1,242 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ollien/hashlink"
+	"github.com/ollien/hashlink/multierror"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+type planTest struct {
+	name string
+	test func(t *testing.T)
+}
+
+func runPlanTestTable(t *testing.T, table []planTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t)
+		})
+	}
+}
+
+// mergedRoots has two reference roots that share an out dir, so that they can conflict.
+var mergedRoots = []outRoot{
+	{dir: "ref1", outDir: "out"},
+	{dir: "ref2", outDir: "out"},
+}
+
+func TestConnectPlan_PlanMappedFiles(t *testing.T) {
+	tests := []planTest{
+		{
+			name: "one source per destination",
+			test: func(t *testing.T) {
+				files := hashlink.FileMap{
+					"src/b": []string{"ref1/a"},
+					"src/a": []string{"ref1/a", "ref1/c"},
+				}
+
+				operations, err := newConnectPlan(conflictError).planMappedFiles(files, mergedRoots)
+				assert.Nil(t, err)
+				assert.Equal(t, []connectOperation{
+					{src: "src/a", dst: "out/a"},
+					{src: "src/a", dst: "out/c"},
+				}, operations)
+			},
+		},
+		{
+			name: "identical references sharing a destination",
+			test: func(t *testing.T) {
+				files := hashlink.FileMap{
+					"src/a": []string{"ref1/a", "ref2/a"},
+				}
+
+				operations, err := newConnectPlan(conflictError).planMappedFiles(files, mergedRoots)
+				assert.Nil(t, err)
+				assert.Equal(t, []connectOperation{{src: "src/a", dst: "out/a"}}, operations)
+			},
+		},
+		{
+			name: "conflict with error policy",
+			test: func(t *testing.T) {
+				files := hashlink.FileMap{
+					"src/a": []string{"ref1/a.txt"},
+					"src/b": []string{"ref2/a.txt"},
+				}
+
+				operations, err := newConnectPlan(conflictError).planMappedFiles(files, mergedRoots)
+				assert.Equal(t, []connectOperation{{src: "src/a", dst: "out/a.txt"}}, operations)
+				if assert.IsType(t, &multierror.MultiError{}, err) {
+					assert.True(t, xerrors.Is(err.(*multierror.MultiError).Errors()[0], errDestinationConflict))
+				}
+			},
+		},
+		{
+			name: "conflict with skip policy",
+			test: func(t *testing.T) {
+				files := hashlink.FileMap{
+					"src/a": []string{"ref1/a.txt"},
+					"src/b": []string{"ref2/a.txt"},
+				}
+
+				operations, err := newConnectPlan(conflictSkip).planMappedFiles(files, mergedRoots)
+				assert.Nil(t, err)
+				assert.Equal(t, []connectOperation{{src: "src/a", dst: "out/a.txt"}}, operations)
+			},
+		},
+		{
+			name: "conflict with rename policy",
+			test: func(t *testing.T) {
+				files := hashlink.FileMap{
+					"src/a": []string{"ref1/a.txt"},
+					"src/b": []string{"ref2/a.txt"},
+				}
+
+				operations, err := newConnectPlan(conflictRename).planMappedFiles(files, mergedRoots)
+				assert.Nil(t, err)
+				assert.Equal(t, []connectOperation{
+					{src: "src/a", dst: "out/a.txt"},
+					{src: "src/b", dst: "out/a (1).txt"},
+				}, operations)
+			},
+		},
+	}
+
+	runPlanTestTable(t, tests)
+}
+
+func TestConnectPlan_ExistingDestinations(t *testing.T) {
+	// setup makes a src file, and an existing file with different contents at its destination, in a temporary directory.
+	setup := func(t *testing.T) (dir string, roots []outRoot) {
+		dir, err := ioutil.TempDir("", "hashlink-conflict")
+		assert.Nil(t, err)
+		assert.Nil(t, os.Mkdir(filepath.Join(dir, "src"), 0755))
+		assert.Nil(t, os.Mkdir(filepath.Join(dir, "out"), 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "src", "a.txt"), []byte("new"), 0644))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "out", "a.txt"), []byte("old"), 0644))
+
+		return dir, []outRoot{{dir: filepath.Join(dir, "src"), outDir: filepath.Join(dir, "out")}}
+	}
+
+	tests := []planTest{
+		{
+			name: "error",
+			test: func(t *testing.T) {
+				dir, roots := setup(t)
+				defer os.RemoveAll(dir)
+				plan := newConnectPlan(conflictError)
+				operations, err := plan.planFiles([]string{filepath.Join(dir, "src", "a.txt")}, roots)
+				assert.Equal(t, []connectOperation{}, operations)
+				assert.True(t, xerrors.Is(err.(*multierror.MultiError).Errors()[0], errDestinationConflict))
+				if assert.Equal(t, 1, len(plan.unplanned)) {
+					assert.NotNil(t, plan.unplanned[0].err)
+				}
+			},
+		},
+		{
+			name: "skip",
+			test: func(t *testing.T) {
+				dir, roots := setup(t)
+				defer os.RemoveAll(dir)
+				plan := newConnectPlan(conflictSkip)
+				operations, err := plan.planFiles([]string{filepath.Join(dir, "src", "a.txt")}, roots)
+				assert.Nil(t, err)
+				assert.Equal(t, []connectOperation{}, operations)
+				assert.Equal(t, []unplannedFile{{
+					src:    filepath.Join(dir, "src", "a.txt"),
+					dst:    filepath.Join(dir, "out", "a.txt"),
+					reason: reasonDestinationExists,
+				}}, plan.unplanned)
+			},
+		},
+		{
+			name: "rename",
+			test: func(t *testing.T) {
+				dir, roots := setup(t)
+				defer os.RemoveAll(dir)
+				operations, err := newConnectPlan(conflictRename).planFiles([]string{filepath.Join(dir, "src", "a.txt")}, roots)
+				assert.Nil(t, err)
+				assert.Equal(t, []connectOperation{{
+					src: filepath.Join(dir, "src", "a.txt"),
+					dst: filepath.Join(dir, "out", "a (1).txt"),
+				}}, operations)
+			},
+		},
+		{
+			name: "overwrite",
+			test: func(t *testing.T) {
+				dir, roots := setup(t)
+				defer os.RemoveAll(dir)
+				operations, err := newConnectPlan(conflictOverwrite).planFiles([]string{filepath.Join(dir, "src", "a.txt")}, roots)
+				assert.Nil(t, err)
+				assert.Equal(t, []connectOperation{{
+					src:       filepath.Join(dir, "src", "a.txt"),
+					dst:       filepath.Join(dir, "out", "a.txt"),
+					overwrite: true,
+				}}, operations)
+			},
+		},
+		{
+			name: "already linked",
+			test: func(t *testing.T) {
+				dir, roots := setup(t)
+				defer os.RemoveAll(dir)
+				dst := filepath.Join(dir, "out", "a.txt")
+				assert.Nil(t, os.Remove(dst))
+				assert.Nil(t, os.Link(filepath.Join(dir, "src", "a.txt"), dst))
+				plan := newConnectPlan(conflictError)
+				operations, err := plan.planFiles([]string{filepath.Join(dir, "src", "a.txt")}, roots)
+				assert.Nil(t, err)
+				assert.Equal(t, []connectOperation{}, operations)
+				if assert.Equal(t, 1, len(plan.unplanned)) {
+					assert.Equal(t, reasonDestinationIsSource, plan.unplanned[0].reason)
+				}
+			},
+		},
+	}
+
+	runPlanTestTable(t, tests)
+}
+
+func TestConnectPlan_PhasesShareDestinations(t *testing.T) {
+	plan := newConnectPlan(conflictRename)
+	operations, err := plan.planMappedFiles(hashlink.FileMap{"src/a": []string{"ref1/a"}}, mergedRoots)
+	assert.Nil(t, err)
+	assert.Equal(t, []connectOperation{{src: "src/a", dst: "out/a"}}, operations)
+
+	operations, err = plan.planFiles([]string{"ref2/a"}, mergedRoots)
+	assert.Nil(t, err)
+	assert.Equal(t, []connectOperation{{src: "ref2/a", dst: "out/a (1)"}}, operations)
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	for name, expected := range map[string]conflictPolicy{"error": conflictError, "skip": conflictSkip, "rename": conflictRename, "overwrite": conflictOverwrite} {
+		policy, err := parseConflictPolicy(name)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, policy)
+	}
+
+	_, err := parseConflictPolicy("yolo")
+	assert.Equal(t, errInvalidConflictPolicy, err)
+}
@@ -0,0 +1,385 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/google/uuid"
+	"github.com/ollien/hashlink"
+	"github.com/ollien/hashlink/multierror"
+	"golang.org/x/xerrors"
+)
+
+// Reasons that a file may be left in place by a rename sync.
+const (
+	reasonDestinationOccupied = "destination is taken by a file that is not being moved"
+	reasonAncestorOccupied    = "a directory above the destination is taken by a file that is not being moved"
+	reasonMoveInterrupted     = "the run was interrupted before the file was moved"
+)
+
+// tempNamePrefix is the prefix given to the temporary name of a file while it is being moved.
+const tempNamePrefix = ".hashlink-"
+
+// renameSyncArgs holds the arguments for the rename-sync subcommand.
+type renameSyncArgs struct {
+	targetDir    string
+	referenceDir string
+	numWorkers   int
+	dryRun       bool
+	// manifests holds the checksum file to use in place of hashing a directory, keyed by the cleaned directory path.
+	manifests map[string]string
+	logging   logArgs
+}
+
+// renameSyncPlan holds the moves needed to make a target tree match the layout of a reference tree.
+type renameSyncPlan struct {
+	moves []connectOperation
+	// skipped holds every move that was found, but cannot be made safely.
+	skipped []unplannedFile
+}
+
+// runRenameSync is the entrypoint for the rename-sync subcommand, which moves the files within target_dir so that its
+// layout matches reference_dir.
+func runRenameSync(arguments []string) {
+	flags := flag.NewFlagSet("rename-sync", flag.ExitOnError)
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: ./hashlink rename-sync [-j n] [-n] [-manifest file]... [-v | -q] [-log-file file [-log-format format]] target_dir reference_dir")
+		flags.PrintDefaults()
+	}
+
+	flags.Usage = usage
+	args, err := setupAndValidateRenameSyncArgs(flags, arguments)
+	if err != nil {
+		handleRenameSyncArgsError(err, args, usage)
+		os.Exit(exitUsage)
+	}
+
+	status := newRunStatus()
+	ctx, stopHandlingSignals := handleSignals(status)
+	defer stopHandlingSignals()
+	runLog.info("Scanning files...")
+	status.startPhase("Scanning files", -1)
+	targetHashes, referenceHashes, _, err := getHashes(ctx, []string{args.targetDir}, []string{args.referenceDir}, args.numWorkers, args.manifests, nil, hashlink.ErrorPolicy{}, hashlink.RetryPolicy{}, 0)
+	if err != nil && ctx.Err() != nil {
+		runLog.warn("Interrupted before anything was moved.")
+		os.Exit(exitInterrupted)
+	} else if err != nil {
+		handleError(err)
+		os.Exit(exitScanFailed)
+	}
+
+	runLog.info("Done scanning.")
+	plan, err := planRenameSync(targetHashes, referenceHashes, args.targetDir, args.referenceDir)
+	if err != nil {
+		handleError(err)
+		os.Exit(exitFailed)
+	}
+
+	for _, file := range plan.skipped {
+		runLog.warn("Leaving file in place", field("src", file.src), field("dst", file.dst), field("reason", file.reason))
+	}
+
+	if args.dryRun {
+		fmt.Println(formatRenameSyncMoves(plan.moves))
+		return
+	}
+
+	runLog.info(fmt.Sprintf("Moving %d files...", len(plan.moves)))
+	status.startPhase("Moving files", -1)
+	numMoved, err := performRenameSync(ctx, plan.moves)
+	if err != nil {
+		handleError(err)
+	}
+
+	if ctx.Err() != nil {
+		runLog.warn(fmt.Sprintf("The run was interrupted after moving %d of %d files; the rest were left in place.", numMoved, len(plan.moves)))
+		os.Exit(exitInterrupted)
+	} else if err != nil {
+		// Each move that failed produced exactly one error.
+		if multiErr, isMulti := err.(*multierror.MultiError); isMulti && multiErr.Len() >= len(plan.moves) {
+			os.Exit(exitFailed)
+		}
+
+		os.Exit(exitFileErrors)
+	}
+
+	runLog.info("Done processing. Enjoy your files :)")
+}
+
+func setupAndValidateRenameSyncArgs(flags *flag.FlagSet, arguments []string) (renameSyncArgs, error) {
+	args := renameSyncArgs{}
+	manifestPaths := stringSliceFlag{}
+	flags.IntVar(&args.numWorkers, "j", 1, "specify a number of workers")
+	flags.BoolVar(&args.dryRun, "n", false, "do not move any files, but print out what files would have been moved")
+	flags.Var(&manifestPaths, "manifest", "use a checksum file (e.g. SHA256SUMS) in place of hashing the directory containing it; may be repeated")
+	registerLogFlags(flags, &args.logging)
+	// ExitOnError is set, so we will never get an error back.
+	_ = flags.Parse(arguments)
+	if args.numWorkers <= 0 {
+		return args, errInvalidNumberOfWorkers
+	} else if flags.NArg() != 2 {
+		return args, errWrongNumberOfArguments
+	}
+
+	err := setupLogging(args.logging)
+	if err != nil {
+		return args, err
+	}
+
+	args.targetDir = flags.Arg(0)
+	args.referenceDir = flags.Arg(1)
+	err = assertDirsExist(args.targetDir, args.referenceDir)
+	if err != nil {
+		return args, err
+	}
+
+	args.manifests, err = makeManifestMap(manifestPaths, args.targetDir, args.referenceDir)
+	if err != nil {
+		return args, err
+	}
+
+	return args, nil
+}
+
+// handleRenameSyncArgsError prints an appropriate message for an error produced by setupAndValidateRenameSyncArgs,
+// followed by the usage.
+func handleRenameSyncArgsError(err error, args renameSyncArgs, usage func()) {
+	if err == errInvalidNumberOfWorkers {
+		fmt.Fprintf(os.Stderr, "Invalid number of workers (-j %d). Must be >= 1\n", args.numWorkers)
+	} else if err == errInvalidLogFormat {
+		fmt.Fprintf(os.Stderr, "Invalid log format (%s). Must be one of text or json\n", args.logging.logFormat)
+	} else if err != errWrongNumberOfArguments {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	usage()
+}
+
+// planRenameSync finds the moves needed within targetDir so that every file with a counterpart in referenceDir is at
+// the same relative location as that counterpart. Files already in the right place are left alone, and each file is
+// moved to at most one location. A move is skipped if its destination, or a directory above it, is taken by a file
+// that is not itself being moved.
+func planRenameSync(targetHashes, referenceHashes hashlink.PathHashes, targetDir, referenceDir string) (renameSyncPlan, error) {
+	// Holds the hash that each path in targetDir should have, according to referenceDir.
+	desiredHashes := make(hashlink.PathHashes, len(referenceHashes))
+	for referencePath, hash := range referenceHashes {
+		relPath, err := getContainedRelPath(referenceDir, referencePath)
+		if err != nil {
+			return renameSyncPlan{}, xerrors.Errorf("could not find location of (%s) in target_dir: %w", referencePath, err)
+		}
+
+		desiredHashes[filepath.Join(targetDir, relPath)] = hash
+	}
+
+	remainingTargetHashes := hashlink.PathHashes{}
+	for targetPath, hash := range targetHashes {
+		desiredHash, isDesired := desiredHashes[targetPath]
+		if isDesired && bytes.Equal(hash.Sum(nil), desiredHash.Sum(nil)) {
+			// This file is already where it belongs, so neither it nor its location should take part in any move.
+			delete(desiredHashes, targetPath)
+			continue
+		}
+
+		remainingTargetHashes[targetPath] = hash
+	}
+
+	pairs := hashlink.PairIdenticalFiles(hashlink.FindIdenticalFiles(remainingTargetHashes, desiredHashes))
+	plan := renameSyncPlan{}
+	// Skipping a move leaves its file in place, which can block other moves, so we repeat until nothing changes.
+	for {
+		skippedAny := false
+		for src, dsts := range pairs {
+			reason, err := getRenameSyncSkipReason(dsts[0], targetDir, targetHashes, pairs)
+			if err != nil {
+				return renameSyncPlan{}, err
+			} else if reason == "" {
+				continue
+			}
+
+			plan.skipped = append(plan.skipped, unplannedFile{src: src, dst: dsts[0], reason: reason})
+			delete(pairs, src)
+			skippedAny = true
+		}
+
+		if !skippedAny {
+			break
+		}
+	}
+
+	for src, dsts := range pairs {
+		plan.moves = append(plan.moves, connectOperation{src: src, dst: dsts[0]})
+	}
+
+	sort.Slice(plan.moves, func(i, j int) bool {
+		return plan.moves[i].src < plan.moves[j].src
+	})
+
+	sort.Slice(plan.skipped, func(i, j int) bool {
+		return plan.skipped[i].src < plan.skipped[j].src
+	})
+
+	return plan, nil
+}
+
+// getRenameSyncSkipReason checks whether dst, or any directory between it and targetDir, is taken by something other
+// than a file that is moving according to pairs. If so, the reason the move to dst must be skipped is returned.
+func getRenameSyncSkipReason(dst, targetDir string, targetHashes hashlink.PathHashes, pairs hashlink.FileMap) (string, error) {
+	isStaying := func(path string) (bool, error) {
+		if _, isMoving := pairs[path]; isMoving {
+			return false, nil
+		} else if _, isTargetFile := targetHashes[path]; isTargetFile {
+			return true, nil
+		}
+
+		_, err := os.Lstat(path)
+		// If a directory above path is a file that is moving, path can't exist.
+		if os.IsNotExist(err) || xerrors.Is(err, syscall.ENOTDIR) {
+			return false, nil
+		} else if err != nil {
+			return false, xerrors.Errorf("could not check for existing destination (%s): %w", path, err)
+		}
+
+		return true, nil
+	}
+
+	relDir, err := filepath.Rel(targetDir, filepath.Dir(dst))
+	if err != nil {
+		return "", xerrors.Errorf("could not find location of (%s) in target_dir: %w", dst, err)
+	}
+
+	for ; relDir != "."; relDir = filepath.Dir(relDir) {
+		dir := filepath.Join(targetDir, relDir)
+		info, err := os.Lstat(dir)
+		if err == nil && info.IsDir() {
+			continue
+		}
+
+		staying, err := isStaying(dir)
+		if err != nil {
+			return "", err
+		} else if staying {
+			return reasonAncestorOccupied, nil
+		}
+	}
+
+	staying, err := isStaying(dst)
+	if err != nil {
+		return "", err
+	} else if staying {
+		return reasonDestinationOccupied, nil
+	}
+
+	return "", nil
+}
+
+// performRenameSync makes all of the given moves, and returns how many were made. To allow files to trade places,
+// every file is first moved to a temporary name alongside it, and then to its destination. No file is ever replaced or
+// deleted; if a file cannot be moved to its destination, it is returned to where it was, or if that is no longer
+// possible, left at its temporary name. An error is returned for each move that could not be made, but all other moves
+// will still be made. Once ctx is done, no more files are moved to temporary names, and the rest are left in place, but
+// every file that already has a temporary name is still moved to its destination.
+func performRenameSync(ctx context.Context, moves []connectOperation) (int, error) {
+	errors := multierror.NewMultiError()
+	tempPaths := make([]string, len(moves))
+	for i, move := range moves {
+		if ctx.Err() != nil {
+			runLog.debug(string(actionSkipped), field("src", move.src), field("dst", move.dst), field("reason", reasonMoveInterrupted))
+			continue
+		}
+
+		tempPath := filepath.Join(filepath.Dir(move.src), tempNamePrefix+uuid.New().String())
+		err := moveWithoutReplacing(move.src, tempPath)
+		if err != nil {
+			err = xerrors.Errorf("could not move (%s) out of the way: %w", move.src, err)
+			errors.Append(err)
+			continue
+		}
+
+		tempPaths[i] = tempPath
+	}
+
+	numMoved := 0
+	for i, move := range moves {
+		tempPath := tempPaths[i]
+		if tempPath == "" {
+			continue
+		}
+
+		err := ensureContainingDirsArePresent(move.dst)
+		if err == nil {
+			err = moveWithoutReplacing(tempPath, move.dst)
+		}
+
+		if err == nil {
+			runLog.debug("moved", field("src", move.src), field("dst", move.dst))
+			numMoved++
+			continue
+		}
+
+		restoreErr := moveWithoutReplacing(tempPath, move.src)
+		if restoreErr != nil {
+			err = xerrors.Errorf("could not move (%s) to (%s), and it was left at (%s): %w", move.src, move.dst, tempPath, err)
+		} else {
+			err = xerrors.Errorf("could not move (%s) to (%s): %w", move.src, move.dst, err)
+		}
+
+		errors.Append(err)
+	}
+
+	if errors.Len() > 0 {
+		return numMoved, errors
+	}
+
+	return numMoved, nil
+}
+
+// moveWithoutReplacing moves src to dst, failing if dst already exists. Unlike os.Rename, it will never replace an
+// existing file.
+func moveWithoutReplacing(src, dst string) error {
+	// Linking will fail if dst exists, so this is the only way to move without a race between checking and renaming.
+	err := os.Link(src, dst)
+	if err != nil {
+		return xerrors.Errorf("could not link (%s) to (%s): %w", src, dst, err)
+	}
+
+	err = os.Remove(src)
+	if err != nil {
+		return xerrors.Errorf("could not remove old name (%s): %w", src, err)
+	}
+
+	return nil
+}
+
+// formatRenameSyncMoves lists the given moves for a dry run.
+func formatRenameSyncMoves(moves []connectOperation) string {
+	output := bytes.Buffer{}
+	for _, move := range moves {
+		fmt.Fprintf(&output, "%s -> %s\n", move.src, move.dst)
+	}
+
+	fmt.Fprintf(&output, "%d files would be moved.", len(moves))
+
+	return output.String()
+}
@@ -0,0 +1,207 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ollien/hashlink"
+	"github.com/stretchr/testify/assert"
+)
+
+type renameSyncTest struct {
+	name string
+	test func(t *testing.T)
+}
+
+func runRenameSyncTestTable(t *testing.T, table []renameSyncTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t)
+		})
+	}
+}
+
+// writeTestTree writes each of the given files, keyed by their path relative to root, and returns their hashes.
+func writeTestTree(t *testing.T, root string, files map[string]string) hashlink.PathHashes {
+	hashes := hashlink.PathHashes{}
+	for relPath, contents := range files {
+		path := filepath.Join(root, relPath)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, ioutil.WriteFile(path, []byte(contents), 0644))
+		hash, err := hashFile(path)
+		assert.Nil(t, err)
+		hashes[path] = hash
+	}
+
+	return hashes
+}
+
+// readTestTree reads every file under root, keyed by its path relative to root.
+func readTestTree(t *testing.T, root string) map[string]string {
+	files := map[string]string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		files[relPath] = string(contents)
+
+		return err
+	})
+
+	assert.Nil(t, err)
+
+	return files
+}
+
+func TestRenameSync(t *testing.T) {
+	tests := []renameSyncTest{
+		{
+			name: "moves and swaps",
+			test: func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "hashlink-rename-sync")
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				defer os.RemoveAll(dir)
+				targetDir := filepath.Join(dir, "target")
+				referenceDir := filepath.Join(dir, "reference")
+				targetHashes := writeTestTree(t, targetDir, map[string]string{"a": "A", "b": "B", "c": "C", "same": "S"})
+				referenceHashes := writeTestTree(t, referenceDir, map[string]string{"a": "B", "b": "A", "dir/c": "C", "same": "S"})
+
+				plan, err := planRenameSync(targetHashes, referenceHashes, targetDir, referenceDir)
+				assert.Nil(t, err)
+				assert.Equal(t, []unplannedFile(nil), plan.skipped)
+				assert.Equal(t, []connectOperation{
+					{src: filepath.Join(targetDir, "a"), dst: filepath.Join(targetDir, "b")},
+					{src: filepath.Join(targetDir, "b"), dst: filepath.Join(targetDir, "a")},
+					{src: filepath.Join(targetDir, "c"), dst: filepath.Join(targetDir, "dir", "c")},
+				}, plan.moves)
+
+				numMoved, err := performRenameSync(context.Background(), plan.moves)
+				assert.Nil(t, err)
+				assert.Equal(t, 3, numMoved)
+				assert.Equal(t, map[string]string{"a": "B", "b": "A", "dir/c": "C", "same": "S"}, readTestTree(t, targetDir))
+			},
+		},
+		{
+			name: "interrupted",
+			test: func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "hashlink-rename-sync")
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				defer os.RemoveAll(dir)
+				targetDir := filepath.Join(dir, "target")
+				referenceDir := filepath.Join(dir, "reference")
+				targetHashes := writeTestTree(t, targetDir, map[string]string{"a": "A", "b": "B"})
+				referenceHashes := writeTestTree(t, referenceDir, map[string]string{"a": "B", "b": "A"})
+
+				plan, err := planRenameSync(targetHashes, referenceHashes, targetDir, referenceDir)
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				numMoved, err := performRenameSync(ctx, plan.moves)
+				assert.Nil(t, err)
+				assert.Equal(t, 0, numMoved)
+				// Nothing should have been left at a temporary name.
+				assert.Equal(t, map[string]string{"a": "A", "b": "B"}, readTestTree(t, targetDir))
+			},
+		},
+		{
+			name: "occupied destinations",
+			test: func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "hashlink-rename-sync")
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				defer os.RemoveAll(dir)
+				targetDir := filepath.Join(dir, "target")
+				referenceDir := filepath.Join(dir, "reference")
+				targetHashes := writeTestTree(t, targetDir, map[string]string{"a": "A", "b": "B", "blocker": "X"})
+				referenceHashes := writeTestTree(t, referenceDir, map[string]string{"blocker/a": "A", "blocker2": "B"})
+				// The file at the destination of b is not part of either tree, so that it has no hash.
+				assert.Nil(t, os.Mkdir(filepath.Join(targetDir, "blocker2"), 0755))
+
+				plan, err := planRenameSync(targetHashes, referenceHashes, targetDir, referenceDir)
+				assert.Nil(t, err)
+				assert.Equal(t, []connectOperation(nil), plan.moves)
+				assert.Equal(t, []unplannedFile{
+					{src: filepath.Join(targetDir, "a"), dst: filepath.Join(targetDir, "blocker", "a"), reason: reasonAncestorOccupied},
+					{src: filepath.Join(targetDir, "b"), dst: filepath.Join(targetDir, "blocker2"), reason: reasonDestinationOccupied},
+				}, plan.skipped)
+			},
+		},
+		{
+			name: "chained skips",
+			test: func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "hashlink-rename-sync")
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				defer os.RemoveAll(dir)
+				targetDir := filepath.Join(dir, "target")
+				referenceDir := filepath.Join(dir, "reference")
+				// a can only move if b does, and b can't move as c is staying put.
+				targetHashes := writeTestTree(t, targetDir, map[string]string{"a": "A", "b": "B", "c": "C"})
+				referenceHashes := writeTestTree(t, referenceDir, map[string]string{"b": "A", "c": "B"})
+
+				plan, err := planRenameSync(targetHashes, referenceHashes, targetDir, referenceDir)
+				assert.Nil(t, err)
+				assert.Equal(t, []connectOperation(nil), plan.moves)
+				assert.Equal(t, 2, len(plan.skipped))
+			},
+		},
+	}
+
+	runRenameSyncTestTable(t, tests)
+}
+
+func TestMoveWithoutReplacing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashlink-rename-sync")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer os.RemoveAll(dir)
+	writeTestTree(t, dir, map[string]string{"a": "A", "b": "B"})
+	err = moveWithoutReplacing(filepath.Join(dir, "a"), filepath.Join(dir, "b"))
+	assert.NotNil(t, err)
+	assert.Equal(t, map[string]string{"a": "A", "b": "B"}, readTestTree(t, dir))
+
+	err = moveWithoutReplacing(filepath.Join(dir, "a"), filepath.Join(dir, "c"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"b": "B", "c": "A"}, readTestTree(t, dir))
+}
@@ -0,0 +1,376 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/ollien/hashlink"
+	"golang.org/x/xerrors"
+)
+
+// reportSchemaVersion is the version of the schema of reportEntry. It must be incremented whenever a field is removed
+// or its meaning changes; adding a field does not require a new version.
+const reportSchemaVersion = 1
+
+// Formats that a run report can be written in.
+const (
+	reportFormatJSON   = "json"
+	reportFormatNDJSON = "ndjson"
+	reportFormatCSV    = "csv"
+)
+
+// Reasons that a file may be skipped by a run, outside of those decided by a connectPlan.
+const (
+	reasonNotCopied = "no identical file in src_dir, and -c was not given"
+	reasonNoMatch   = "no identical file in reference_dir"
+)
+
+var errInvalidReportFormat = errors.New("invalid report format")
+
+// fileAction represents what was done with a file during a run.
+type fileAction string
+
+const (
+	actionLinked  fileAction = "linked"
+	actionCopied  fileAction = "copied"
+	actionSkipped fileAction = "skipped"
+	actionFailed  fileAction = "failed"
+)
+
+// reportEntry records what happened to a single file during a run. The JSON names of each field make up the
+// documented report schema; see the README for the meaning of each.
+type reportEntry struct {
+	SchemaVersion int        `json:"schema_version"`
+	DryRun        bool       `json:"dry_run"`
+	Action        fileAction `json:"action"`
+	Source        string     `json:"source"`
+	Destination   string     `json:"destination,omitempty"`
+	Digest        string     `json:"digest,omitempty"`
+	// Size will be nil if the size of the source could not be determined.
+	Size   *int64 `json:"size"`
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Retries is the number of times linking or copying the source to the destination was retried after a transient
+	// error.
+	Retries int `json:"retries"`
+	// HashRetries is the number of times reading the source to hash it was retried after a transient error.
+	HashRetries int `json:"hash_retries"`
+}
+
+// reportCSVHeader holds the CSV column names, which match the JSON names of reportEntry's fields.
+var reportCSVHeader = []string{
+	"schema_version", "dry_run", "action", "source", "destination", "digest", "size", "reason", "error", "retries",
+	"hash_retries",
+}
+
+// runReport collects a reportEntry for every file considered during a run.
+type runReport struct {
+	dryRun bool
+	// hashes holds the hashes of every src and reference file, so that entries may include digests.
+	hashes hashlink.PathHashes
+	// retries holds the number of retries made for each file and operation. It may be nil if nothing was retried.
+	retries *retryCounter
+	entries []reportEntry
+}
+
+// retryCounter counts the retries made while hashing each file, and while connecting each src file to each of its
+// destinations, separately. It is safe for concurrent use.
+type retryCounter struct {
+	lock          sync.Mutex
+	hashCounts    map[string]int
+	connectCounts map[connectKey]int
+}
+
+// connectKey identifies a single connection from a src file to a destination.
+type connectKey struct {
+	src string
+	dst string
+}
+
+// newRetryCounter makes a retryCounter with no retries recorded.
+func newRetryCounter() *retryCounter {
+	return &retryCounter{hashCounts: map[string]int{}, connectCounts: map[connectKey]int{}}
+}
+
+// recordHash records a single retry of hashing path. It has the signature of hashlink.RetryPolicy's OnRetry, so that it
+// may be used directly as one.
+func (counter *retryCounter) recordHash(path string, retry int, err error) {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	counter.hashCounts[path]++
+	runLog.debug("retrying hash after transient error", field("src", path), field("retry", retry), field("error", err))
+}
+
+// connectPolicy makes a copy of policy that records its retries against connecting operation's src to its dst. If
+// counter is nil, policy is returned as it is.
+func (counter *retryCounter) connectPolicy(policy hashlink.RetryPolicy, operation connectOperation) hashlink.RetryPolicy {
+	if counter == nil {
+		return policy
+	}
+
+	key := connectKey{src: operation.src, dst: operation.dst}
+	policy.OnRetry = func(_ string, retry int, err error) {
+		counter.lock.Lock()
+		defer counter.lock.Unlock()
+
+		counter.connectCounts[key]++
+		runLog.debug("retrying connection after transient error", field("src", key.src), field("dst", key.dst), field("retry", retry), field("error", err))
+	}
+
+	return policy
+}
+
+// hashCount gets the number of retries recorded for hashing path.
+func (counter *retryCounter) hashCount(path string) int {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	return counter.hashCounts[path]
+}
+
+// connectCount gets the number of retries recorded for connecting src to dst.
+func (counter *retryCounter) connectCount(src, dst string) int {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	return counter.connectCounts[connectKey{src: src, dst: dst}]
+}
+
+// newRunReport makes a runReport that will look up the digests of files in hashes.
+func newRunReport(dryRun bool, hashes hashlink.PathHashes) *runReport {
+	return &runReport{
+		dryRun: dryRun,
+		hashes: hashes,
+	}
+}
+
+// validateReportFormat checks that format is one that a runReport can be written in.
+func validateReportFormat(format string) error {
+	if format != reportFormatJSON && format != reportFormatNDJSON && format != reportFormatCSV {
+		return errInvalidReportFormat
+	}
+
+	return nil
+}
+
+// addConnectResults records the results of connecting files. Successful operations are recorded with the given action.
+func (report *runReport) addConnectResults(results []connectResult, action fileAction) {
+	for _, result := range results {
+		entryAction := action
+		if result.err != nil {
+			entryAction = actionFailed
+		}
+
+		report.addEntry(entryAction, result.operation.src, result.operation.dst, "", result.err)
+	}
+}
+
+// addUnplanned records every file that a connectPlan decided not to connect.
+func (report *runReport) addUnplanned(files []unplannedFile) {
+	for _, file := range files {
+		action := actionSkipped
+		if file.err != nil {
+			action = actionFailed
+		}
+
+		report.addEntry(action, file.src, file.dst, file.reason, file.err)
+	}
+}
+
+// addSkipped records that every one of the given files was skipped for the given reason.
+func (report *runReport) addSkipped(paths []string, reason string) {
+	for _, path := range paths {
+		report.addEntry(actionSkipped, path, "", reason, nil)
+	}
+}
+
+// addEntry records a single file.
+func (report *runReport) addEntry(action fileAction, src, dst, reason string, err error) {
+	entry := reportEntry{
+		SchemaVersion: reportSchemaVersion,
+		DryRun:        report.dryRun,
+		Action:        action,
+		Source:        src,
+		Destination:   dst,
+		Reason:        reason,
+	}
+
+	if hash, haveHash := report.hashes[src]; haveHash {
+		entry.Digest = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	if report.retries != nil {
+		entry.Retries = report.retries.connectCount(src, dst)
+		entry.HashRetries = report.retries.hashCount(src)
+	}
+
+	report.entries = append(report.entries, entry)
+}
+
+// countActions counts the number of files that ended up with each action.
+func (report *runReport) countActions() map[fileAction]int {
+	counts := map[fileAction]int{}
+	for _, entry := range report.entries {
+		counts[entry.Action]++
+	}
+
+	return counts
+}
+
+// formatActionCounts formats the number of files with each action as a table.
+func formatActionCounts(counts map[fileAction]int) string {
+	rows := []struct {
+		name   string
+		action fileAction
+	}{
+		{"Linked", actionLinked},
+		{"Copied", actionCopied},
+		{"Skipped", actionSkipped},
+		{"Failed", actionFailed},
+	}
+
+	output := bytes.Buffer{}
+	total := 0
+	for _, row := range rows {
+		fmt.Fprintf(&output, "%-40s%d\n", row.name+":", counts[row.action])
+		total += counts[row.action]
+	}
+
+	fmt.Fprintf(&output, "%-40s%d\n", "Total:", total)
+
+	return output.String()
+}
+
+// writeToFile writes the report to the file at path, replacing it if it exists.
+func (report *runReport) writeToFile(path, format string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return xerrors.Errorf("could not create report file: %w", err)
+	}
+
+	err = report.write(file, format)
+	if err != nil {
+		file.Close()
+		return xerrors.Errorf("could not write report file: %w", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return xerrors.Errorf("could not write report file: %w", err)
+	}
+
+	return nil
+}
+
+// write writes the report to writer in the given format, sorted by source. The size of every source file is read as
+// it is written.
+func (report *runReport) write(writer io.Writer, format string) error {
+	sort.SliceStable(report.entries, func(i, j int) bool {
+		return report.entries[i].Source < report.entries[j].Source
+	})
+
+	for i := range report.entries {
+		entry := &report.entries[i]
+		info, err := os.Lstat(entry.Source)
+		if err == nil {
+			size := info.Size()
+			entry.Size = &size
+		}
+	}
+
+	switch format {
+	case reportFormatJSON:
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "\t")
+		// Avoid writing null when there were no files
+		entries := report.entries
+		if entries == nil {
+			entries = []reportEntry{}
+		}
+
+		return encoder.Encode(entries)
+	case reportFormatNDJSON:
+		encoder := json.NewEncoder(writer)
+		for _, entry := range report.entries {
+			err := encoder.Encode(entry)
+			if err != nil {
+				return xerrors.Errorf("could not encode report entry: %w", err)
+			}
+		}
+
+		return nil
+	case reportFormatCSV:
+		return report.writeCSV(writer)
+	default:
+		return errInvalidReportFormat
+	}
+}
+
+// writeCSV writes the report as CSV, with a header row.
+func (report *runReport) writeCSV(writer io.Writer) error {
+	csvWriter := csv.NewWriter(writer)
+	err := csvWriter.Write(reportCSVHeader)
+	if err != nil {
+		return xerrors.Errorf("could not write report header: %w", err)
+	}
+
+	for _, entry := range report.entries {
+		size := ""
+		if entry.Size != nil {
+			size = strconv.FormatInt(*entry.Size, 10)
+		}
+
+		record := []string{
+			strconv.Itoa(entry.SchemaVersion),
+			strconv.FormatBool(entry.DryRun),
+			string(entry.Action),
+			entry.Source,
+			entry.Destination,
+			entry.Digest,
+			size,
+			entry.Reason,
+			entry.Error,
+			strconv.Itoa(entry.Retries),
+			strconv.Itoa(entry.HashRetries),
+		}
+
+		err = csvWriter.Write(record)
+		if err != nil {
+			return xerrors.Errorf("could not write report entry: %w", err)
+		}
+	}
+
+	csvWriter.Flush()
+
+	return csvWriter.Error()
+}
@@ -0,0 +1,246 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/ollien/hashlink"
+	"github.com/stretchr/testify/assert"
+)
+
+const helloWorldDigest = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+type reportTest struct {
+	name string
+	test func(t *testing.T)
+}
+
+func runReportTestTable(t *testing.T, table []reportTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t)
+		})
+	}
+}
+
+// makeTestReport makes a report with one of each kind of entry, where the linked file exists in dir and had to be read
+// twice to be hashed, and the failed file's link was retried twice.
+func makeTestReport(t *testing.T, dir string) *runReport {
+	srcPath := filepath.Join(dir, "a")
+	assert.Nil(t, ioutil.WriteFile(srcPath, []byte("hello world"), 0644))
+	hash := sha256.New()
+	hash.Write([]byte("hello world"))
+
+	report := newRunReport(true, hashlink.PathHashes{srcPath: hash})
+	report.retries = newRetryCounter()
+	report.retries.recordHash(srcPath, 1, syscall.EIO)
+	failedRetry := report.retries.connectPolicy(hashlink.RetryPolicy{}, connectOperation{src: "missing/b", dst: "out/b"})
+	failedRetry.OnRetry("missing/b", 1, syscall.EIO)
+	failedRetry.OnRetry("missing/b", 2, syscall.EIO)
+	report.addConnectResults([]connectResult{
+		{operation: connectOperation{src: srcPath, dst: "out/a"}},
+		{operation: connectOperation{src: "missing/b", dst: "out/b"}, err: errors.New("oh no")},
+	}, actionLinked)
+	report.addUnplanned([]unplannedFile{{src: "missing/c", dst: "out/c", reason: reasonDestinationExists}})
+	report.addSkipped([]string{"missing/d"}, reasonNoMatch)
+
+	return report
+}
+
+func TestRunReport_Write(t *testing.T) {
+	tests := []reportTest{
+		{
+			name: "json",
+			test: func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "hashlink-report")
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				defer os.RemoveAll(dir)
+				buffer := bytes.Buffer{}
+				err = makeTestReport(t, dir).write(&buffer, reportFormatJSON)
+				assert.Nil(t, err)
+
+				entries := []map[string]interface{}{}
+				err = json.Unmarshal(buffer.Bytes(), &entries)
+				assert.Nil(t, err)
+				assert.Equal(t, []map[string]interface{}{
+					{
+						"schema_version": 1.0,
+						"dry_run":        true,
+						"action":         "linked",
+						"source":         filepath.Join(dir, "a"),
+						"destination":    "out/a",
+						"digest":         helloWorldDigest,
+						"size":           11.0,
+						"retries":        0.0,
+						"hash_retries":   1.0,
+					},
+					{
+						"schema_version": 1.0,
+						"dry_run":        true,
+						"action":         "failed",
+						"source":         "missing/b",
+						"destination":    "out/b",
+						"size":           nil,
+						"error":          "oh no",
+						"retries":        2.0,
+						"hash_retries":   0.0,
+					},
+					{
+						"schema_version": 1.0,
+						"dry_run":        true,
+						"action":         "skipped",
+						"source":         "missing/c",
+						"destination":    "out/c",
+						"size":           nil,
+						"reason":         reasonDestinationExists,
+						"retries":        0.0,
+						"hash_retries":   0.0,
+					},
+					{
+						"schema_version": 1.0,
+						"dry_run":        true,
+						"action":         "skipped",
+						"source":         "missing/d",
+						"size":           nil,
+						"reason":         reasonNoMatch,
+						"retries":        0.0,
+						"hash_retries":   0.0,
+					},
+				}, entries)
+			},
+		},
+		{
+			name: "empty json",
+			test: func(t *testing.T) {
+				buffer := bytes.Buffer{}
+				err := newRunReport(false, hashlink.PathHashes{}).write(&buffer, reportFormatJSON)
+				assert.Nil(t, err)
+				assert.Equal(t, "[]\n", buffer.String())
+			},
+		},
+		{
+			name: "ndjson",
+			test: func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "hashlink-report")
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				defer os.RemoveAll(dir)
+				buffer := bytes.Buffer{}
+				err = makeTestReport(t, dir).write(&buffer, reportFormatNDJSON)
+				assert.Nil(t, err)
+
+				lines := strings.Split(strings.TrimSuffix(buffer.String(), "\n"), "\n")
+				assert.Equal(t, 4, len(lines))
+				entry := reportEntry{}
+				err = json.Unmarshal([]byte(lines[3]), &entry)
+				assert.Nil(t, err)
+				assert.Equal(t, reportEntry{
+					SchemaVersion: reportSchemaVersion,
+					DryRun:        true,
+					Action:        actionSkipped,
+					Source:        "missing/d",
+					Reason:        reasonNoMatch,
+				}, entry)
+			},
+		},
+		{
+			name: "csv",
+			test: func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "hashlink-report")
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				defer os.RemoveAll(dir)
+				buffer := bytes.Buffer{}
+				err = makeTestReport(t, dir).write(&buffer, reportFormatCSV)
+				assert.Nil(t, err)
+				assert.Equal(t, strings.Join([]string{
+					"schema_version,dry_run,action,source,destination,digest,size,reason,error,retries,hash_retries",
+					"1,true,linked," + filepath.Join(dir, "a") + ",out/a," + helloWorldDigest + ",11,,,0,1",
+					"1,true,failed,missing/b,out/b,,,,oh no,2,0",
+					"1,true,skipped,missing/c,out/c,,,destination already exists,,0,0",
+					"1,true,skipped,missing/d,,,,no identical file in reference_dir,,0,0",
+				}, "\n")+"\n", buffer.String())
+			},
+		},
+		{
+			name: "retries per destination",
+			test: func(t *testing.T) {
+				report := newRunReport(false, hashlink.PathHashes{})
+				report.retries = newRetryCounter()
+				report.retries.recordHash("src/a", 1, syscall.EIO)
+				first := connectOperation{src: "src/a", dst: "out/a"}
+				second := connectOperation{src: "src/a", dst: "out/a-2"}
+				report.retries.connectPolicy(hashlink.RetryPolicy{}, second).OnRetry("src/a", 1, syscall.EIO)
+				report.addConnectResults([]connectResult{{operation: first}, {operation: second}}, actionLinked)
+
+				if assert.Equal(t, 2, len(report.entries)) {
+					assert.Equal(t, 0, report.entries[0].Retries)
+					assert.Equal(t, 1, report.entries[1].Retries)
+					// Hashing is shared by every destination of the file.
+					assert.Equal(t, 1, report.entries[0].HashRetries)
+					assert.Equal(t, 1, report.entries[1].HashRetries)
+				}
+			},
+		},
+		{
+			name: "invalid format",
+			test: func(t *testing.T) {
+				err := newRunReport(false, hashlink.PathHashes{}).write(&bytes.Buffer{}, "xml")
+				assert.Equal(t, errInvalidReportFormat, err)
+			},
+		},
+	}
+
+	runReportTestTable(t, tests)
+}
+
+func TestRunReport_CountActions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashlink-report")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer os.RemoveAll(dir)
+	counts := makeTestReport(t, dir).countActions()
+	assert.Equal(t, map[fileAction]int{actionLinked: 1, actionFailed: 1, actionSkipped: 2}, counts)
+	assert.Equal(
+		t,
+		"Linked:                                 1\n"+
+			"Copied:                                 0\n"+
+			"Skipped:                                2\n"+
+			"Failed:                                 1\n"+
+			"Total:                                  4\n",
+		formatActionCounts(counts),
+	)
+}
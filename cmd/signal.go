@@ -0,0 +1,157 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// interruptSignals are the signals that stop a run. The first stops it cleanly, and the second stops it immediately.
+var interruptSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// runStatus tracks the progress of a run, so that it may be printed while the run continues. It is safe for
+// concurrent use.
+type runStatus struct {
+	lock  sync.Mutex
+	phase string
+	// total is the number of files in the current phase, or negative if it is not known.
+	total  int
+	done   int
+	failed int
+}
+
+// signalHandler decides what to do with each signal received during a run.
+type signalHandler struct {
+	// cancel cancels the run's context, so that no more work is started.
+	cancel      context.CancelFunc
+	status      *runStatus
+	interrupted bool
+	// output is where the status is printed.
+	output io.Writer
+	// exit exits the process with the given code.
+	exit func(code int)
+}
+
+// handleSignals handles interruptSignals and statusSignals until the returned stop function is called. The returned
+// context is cancelled at the first interrupt, while status is printed to stderr whenever a status signal is received.
+func handleSignals(status *runStatus) (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := &signalHandler{cancel: cancel, status: status, output: os.Stderr, exit: os.Exit}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append(append([]os.Signal{}, interruptSignals...), statusSignals...)...)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				handler.handle(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	stop = func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
+	}
+
+	return ctx, stop
+}
+
+// handle handles a single signal. The first interrupt cancels the run's context, so that files in progress are finished
+// but no more are started, while the second exits immediately. A status signal prints the status of the run.
+func (handler *signalHandler) handle(sig os.Signal) {
+	// Whatever is printed, the progress bar shouldn't be left in the way.
+	progressBarReporter{}.abort()
+	if isStatusSignal(sig) {
+		fmt.Fprintln(handler.output, handler.status)
+		return
+	} else if !handler.interrupted {
+		handler.interrupted = true
+		runLog.warn("Interrupted; finishing the files in progress. Interrupt again to stop immediately.")
+		handler.cancel()
+		return
+	}
+
+	runLog.warn("Interrupted again; stopping immediately. The run report and any script will be incomplete.")
+	runLog.close()
+	handler.exit(exitInterrupted)
+}
+
+// isStatusSignal checks whether sig is one of statusSignals.
+func isStatusSignal(sig os.Signal) bool {
+	for _, statusSignal := range statusSignals {
+		if sig == statusSignal {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newRunStatus makes a runStatus for a run that has not yet started any phase.
+func newRunStatus() *runStatus {
+	return &runStatus{phase: "Starting", total: -1}
+}
+
+// startPhase records that the run has moved on to the given phase, which will process total files. If the number of
+// files is not known, total should be negative.
+func (status *runStatus) startPhase(phase string, total int) {
+	status.lock.Lock()
+	defer status.lock.Unlock()
+
+	status.phase = phase
+	status.total = total
+	status.done = 0
+	status.failed = 0
+}
+
+// track wraps op so that every operation it performs is counted towards the current phase.
+func (status *runStatus) track(op operationFunction) operationFunction {
+	return func(operation connectOperation) error {
+		err := op(operation)
+		status.lock.Lock()
+		defer status.lock.Unlock()
+
+		status.done++
+		if err != nil {
+			status.failed++
+		}
+
+		return err
+	}
+}
+
+// String describes the current phase, and how many of its files have been processed.
+func (status *runStatus) String() string {
+	status.lock.Lock()
+	defer status.lock.Unlock()
+
+	if status.total < 0 {
+		return fmt.Sprintf("%s...", status.phase)
+	}
+
+	return fmt.Sprintf("%s: %d of %d files done, %d failed", status.phase, status.done, status.total, status.failed)
+}
@@ -0,0 +1,131 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type signalTest struct {
+	name string
+	test func(t *testing.T)
+}
+
+func runSignalTestTable(t *testing.T, table []signalTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t)
+		})
+	}
+}
+
+// makeTestSignalHandler makes a signalHandler that records its status output and exit code, rather than exiting.
+func makeTestSignalHandler(status *runStatus) (handler *signalHandler, ctx context.Context, output *bytes.Buffer, exitCode *int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	output = &bytes.Buffer{}
+	exitCode = new(int)
+	*exitCode = -1
+	handler = &signalHandler{
+		cancel: cancel,
+		status: status,
+		output: output,
+		exit:   func(code int) { *exitCode = code },
+	}
+
+	return handler, ctx, output, exitCode
+}
+
+func TestSignalHandler_Handle(t *testing.T) {
+	tests := []signalTest{
+		{
+			name: "first interrupt",
+			test: func(t *testing.T) {
+				handler, ctx, _, exitCode := makeTestSignalHandler(newRunStatus())
+				handler.handle(os.Interrupt)
+				assert.NotNil(t, ctx.Err())
+				assert.Equal(t, -1, *exitCode)
+			},
+		},
+		{
+			name: "second interrupt",
+			test: func(t *testing.T) {
+				handler, _, _, exitCode := makeTestSignalHandler(newRunStatus())
+				handler.handle(os.Interrupt)
+				handler.handle(syscall.SIGTERM)
+				assert.Equal(t, exitInterrupted, *exitCode)
+			},
+		},
+		{
+			name: "status",
+			test: func(t *testing.T) {
+				if len(statusSignals) == 0 {
+					t.Skip("no status signals on this platform")
+				}
+
+				status := newRunStatus()
+				status.startPhase("Linking", 3)
+				handler, ctx, output, exitCode := makeTestSignalHandler(status)
+				handler.handle(statusSignals[0])
+				assert.Nil(t, ctx.Err())
+				assert.Equal(t, -1, *exitCode)
+				assert.Equal(t, "Linking: 0 of 3 files done, 0 failed\n", output.String())
+			},
+		},
+	}
+
+	runSignalTestTable(t, tests)
+}
+
+func TestRunStatus(t *testing.T) {
+	tests := []signalTest{
+		{
+			name: "unknown total",
+			test: func(t *testing.T) {
+				status := newRunStatus()
+				status.startPhase("Scanning files", -1)
+				assert.Equal(t, "Scanning files...", status.String())
+			},
+		},
+		{
+			name: "tracked operations",
+			test: func(t *testing.T) {
+				status := newRunStatus()
+				status.startPhase("Copying", 3)
+				op := status.track(func(operation connectOperation) error {
+					if operation.src == "bad" {
+						return errors.New("oh no")
+					}
+
+					return nil
+				})
+
+				assert.Nil(t, op(connectOperation{src: "good"}))
+				assert.NotNil(t, op(connectOperation{src: "bad"}))
+				assert.Equal(t, "Copying: 2 of 3 files done, 1 failed", status.String())
+			},
+		},
+	}
+
+	runSignalTestTable(t, tests)
+}
@@ -0,0 +1,119 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// spaceUsage holds an amount of disk space, measured both by the apparent size of files and by the blocks allocated
+// to them.
+type spaceUsage struct {
+	apparent  int64
+	allocated int64
+}
+
+// spaceSummary tallies the space that a run saves by linking files, and uses by copying them.
+type spaceSummary struct {
+	// linked holds the space that would have been used had every linked file been copied instead.
+	linked spaceUsage
+	// copied holds the space taken by every copied file.
+	copied spaceUsage
+	// unmeasured holds the number of files that could not be measured, and so are not included in the totals.
+	unmeasured int
+}
+
+// add adds the size of the given file to the usage.
+func (usage *spaceUsage) add(info os.FileInfo) {
+	usage.apparent += info.Size()
+	usage.allocated += allocatedSize(info)
+}
+
+// addConnectResults adds the size of the src file of every successful operation in results. If copied is set, the
+// operations are counted as copies, and otherwise as links.
+func (summary *spaceSummary) addConnectResults(results []connectResult, copied bool) {
+	usage := &summary.linked
+	if copied {
+		usage = &summary.copied
+	}
+
+	for _, result := range results {
+		if result.err != nil {
+			continue
+		}
+
+		// The src file is measured, rather than the destination, so that dry runs get the same figures. A copy will
+		// be allocated (roughly) as many blocks as its source.
+		info, err := os.Lstat(result.operation.src)
+		if err != nil {
+			summary.unmeasured++
+			continue
+		}
+
+		usage.add(info)
+	}
+}
+
+// netUsage gets the space that the run adds to the src_dir filesystem. Links only add directory entries, so only
+// copies take up new space.
+func (summary spaceSummary) netUsage() spaceUsage {
+	return summary.copied
+}
+
+// String produces a table of the space saved and used, by both apparent size and allocated blocks.
+func (summary spaceSummary) String() string {
+	output := bytes.Buffer{}
+	fmt.Fprintf(&output, "%-40s%-16s%s\n", "Space", "Apparent", "Allocated")
+	rows := []struct {
+		name  string
+		usage spaceUsage
+	}{
+		{"Saved by linking", summary.linked},
+		{"Copied", summary.copied},
+		{"Net new usage on src_dir filesystem", summary.netUsage()},
+	}
+
+	for _, row := range rows {
+		fmt.Fprintf(&output, "%-40s%-16s%s\n", row.name+":", formatSize(row.usage.apparent), formatSize(row.usage.allocated))
+	}
+
+	if summary.unmeasured > 0 {
+		fmt.Fprintf(&output, "%d files could not be measured, and are not included above.\n", summary.unmeasured)
+	}
+
+	return output.String()
+}
+
+// formatSize formats a number of bytes in the largest binary unit that keeps it above one.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value := float64(size)
+	units := []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	i := -1
+	for value >= unit && i < len(units)-1 {
+		value /= unit
+		i++
+	}
+
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
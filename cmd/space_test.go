@@ -0,0 +1,92 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type spaceTest struct {
+	name string
+	test func(t *testing.T)
+}
+
+func runSpaceTestTable(t *testing.T, table []spaceTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t)
+		})
+	}
+}
+
+func TestSpaceSummary_AddConnectResults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashlink-space")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer os.RemoveAll(dir)
+	linkedPath := filepath.Join(dir, "linked")
+	copiedPath := filepath.Join(dir, "copied")
+	assert.Nil(t, ioutil.WriteFile(linkedPath, make([]byte, 5000), 0644))
+	assert.Nil(t, ioutil.WriteFile(copiedPath, make([]byte, 10), 0644))
+
+	summary := spaceSummary{}
+	summary.addConnectResults([]connectResult{
+		{operation: connectOperation{src: linkedPath, dst: "out/a"}},
+		{operation: connectOperation{src: linkedPath, dst: "out/b"}},
+		{operation: connectOperation{src: "missing", dst: "out/c"}},
+		{operation: connectOperation{src: linkedPath, dst: "out/d"}, err: errors.New("oh no")},
+	}, false)
+	summary.addConnectResults([]connectResult{{operation: connectOperation{src: copiedPath, dst: "out/e"}}}, true)
+
+	assert.Equal(t, int64(10000), summary.linked.apparent)
+	assert.Equal(t, int64(10), summary.copied.apparent)
+	assert.Equal(t, summary.copied, summary.netUsage())
+	assert.Equal(t, 1, summary.unmeasured)
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []spaceTest{
+		{
+			name: "bytes",
+			test: func(t *testing.T) {
+				assert.Equal(t, "1023 B", formatSize(1023))
+			},
+		},
+		{
+			name: "kibibytes",
+			test: func(t *testing.T) {
+				assert.Equal(t, "1.5 KiB", formatSize(1536))
+			},
+		},
+		{
+			name: "gibibytes",
+			test: func(t *testing.T) {
+				assert.Equal(t, "2.0 GiB", formatSize(2<<30))
+			},
+		},
+	}
+
+	runSpaceTestTable(t, tests)
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"os"
+	"syscall"
+)
+
+// blockSize is the unit of st_blocks, which is fixed regardless of the filesystem's block size.
+const blockSize = 512
+
+// allocatedSize gets the number of bytes allocated on disk to the given file.
+func allocatedSize(info os.FileInfo) int64 {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.Size()
+	}
+
+	return int64(stat.Blocks) * blockSize
+}
@@ -0,0 +1,25 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import "os"
+
+// allocatedSize gets the number of bytes allocated on disk to the given file. Windows does not expose allocated blocks
+// through os.FileInfo, so the apparent size is used.
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,305 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ollien/hashlink"
+	"golang.org/x/xerrors"
+)
+
+// verifyStatus represents the outcome of verifying a single path in out_dir.
+type verifyStatus int
+
+const (
+	// verifyLinked indicates the path shares an inode with a matching file in src_dir.
+	verifyLinked verifyStatus = iota
+	// verifyCopied indicates the path has the same digest as its reference file.
+	verifyCopied
+	// verifyNotLinked indicates the path has a matching file in src_dir, but is not a hardlink to any of them.
+	verifyNotLinked
+	// verifyDigestMismatch indicates the path was expected to be a copy, but does not match its reference file.
+	verifyDigestMismatch
+	// verifyUnexpected indicates the path has no counterpart in reference_dir, and would not have been produced.
+	verifyUnexpected
+	// verifyMissing indicates the path should have been produced, but is not present.
+	verifyMissing
+	// verifyFailed indicates the path could not be checked.
+	verifyFailed
+)
+
+// verifyResult represents the outcome of verifying a single path in out_dir.
+type verifyResult struct {
+	path   string
+	status verifyStatus
+	// If status is verifyFailed or verifyDigestMismatch, err holds the reason, as a *hashlink.PathError.
+	err error
+}
+
+// verifyReport holds the results of verifying every path in out_dir.
+type verifyReport struct {
+	results []verifyResult
+}
+
+// String gets a human readable description of the status.
+func (status verifyStatus) String() string {
+	switch status {
+	case verifyLinked:
+		return "linked"
+	case verifyCopied:
+		return "copied"
+	case verifyNotLinked:
+		return "not linked to a matching src_dir file"
+	case verifyDigestMismatch:
+		return "digest does not match reference_dir file"
+	case verifyUnexpected:
+		return "not produced from reference_dir"
+	case verifyMissing:
+		return "missing"
+	case verifyFailed:
+		return "could not verify"
+	default:
+		return "unknown"
+	}
+}
+
+// passed checks whether the status represents a correctly produced file.
+func (status verifyStatus) passed() bool {
+	return status == verifyLinked || status == verifyCopied
+}
+
+// passed checks whether every result in the report passed.
+func (report verifyReport) passed() bool {
+	for _, result := range report.results {
+		if !result.status.passed() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String produces a summary of the report, listing every discrepancy along with a count of each status.
+func (report verifyReport) String() string {
+	counts := map[verifyStatus]int{}
+	output := bytes.Buffer{}
+	for _, result := range report.results {
+		counts[result.status]++
+		if result.status.passed() {
+			continue
+		} else if result.status == verifyFailed {
+			fmt.Fprintf(&output, "FAIL %s: %s (%s)\n", result.path, result.status, result.err)
+		} else {
+			fmt.Fprintf(&output, "FAIL %s: %s\n", result.path, result.status)
+		}
+	}
+
+	fmt.Fprintf(&output, "\n")
+	for status := verifyLinked; status <= verifyFailed; status++ {
+		fmt.Fprintf(&output, "%-45s%d\n", status.String()+":", counts[status])
+	}
+
+	if report.passed() {
+		fmt.Fprintf(&output, "\nPASS: all %d entries in out_dir verified.", len(report.results))
+	} else {
+		fmt.Fprintf(&output, "\nFAIL: out_dir has discrepancies.")
+	}
+
+	return output.String()
+}
+
+// runVerify is the entrypoint for the verify subcommand, which audits an out_dir produced by a previous run against
+// its src_dir and reference_dir.
+func runVerify(arguments []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: ./hashlink verify [-j n] [-c] [-manifest file]... [-src-list file] [-reference-list file] [-from0] [-layout merged|separate] [-v | -q] [-log-file file [-log-format format]] src_dir reference_dir out_dir")
+		fmt.Fprintln(os.Stderr, "       ./hashlink verify [-j n] [-c] [-manifest file]... [-src-list file] [-reference-list file] [-from0] [-layout merged|separate] [-v | -q] [-log-file file [-log-format format]] -src dir... -reference dir... out_dir")
+		flags.PrintDefaults()
+	}
+
+	flags.Usage = usage
+	args, err := setupAndValidateVerifyArgs(flags, arguments)
+	if err != nil {
+		handleArgsError(err, args, usage)
+		os.Exit(exitUsage)
+	}
+
+	runLog.info("Scanning files...")
+	srcHashes, referenceHashes, _, err := getHashes(context.Background(), args.srcDirs, args.referenceDirs, args.numWorkers, args.manifests, args.fileLists, hashlink.ErrorPolicy{}, hashlink.RetryPolicy{}, 0)
+	if err != nil {
+		handleError(err)
+		os.Exit(exitScanFailed)
+	}
+
+	runLog.info("Done scanning.")
+	// Our expected links are in reference => src order, so that we can find the src files for each out_dir path.
+	identicalFiles := hashlink.FindIdenticalFiles(srcHashes, referenceHashes)
+	expectedLinks := hashlink.MakeFlippedFileMap(identicalFiles)
+	runLog.info("Verifying out_dir...")
+	report := verifyOutDir(args.outDir, args.outRoots, referenceHashes, expectedLinks, args.copyMissing)
+	fmt.Println(report)
+	if !report.passed() {
+		os.Exit(exitFileErrors)
+	}
+}
+
+func setupAndValidateVerifyArgs(flags *flag.FlagSet, arguments []string) (cliArgs, error) {
+	args := cliArgs{}
+	dirs := dirFlags{}
+	flags.IntVar(&args.numWorkers, "j", 1, "specify a number of workers")
+	flags.BoolVar(&args.copyMissing, "c", false, "expect the files that are missing from src_dir to have been copied")
+	registerDirFlags(flags, &args, &dirs)
+	registerLogFlags(flags, &args.logging)
+	// ExitOnError is set, so we will never get an error back.
+	_ = flags.Parse(arguments)
+	if args.numWorkers <= 0 {
+		return cliArgs{}, errInvalidNumberOfWorkers
+	}
+
+	err := setupLogging(args.logging)
+	if err != nil {
+		return args, err
+	}
+
+	err = setupDirArgs(&args, dirs, flags.Args())
+	if err != nil {
+		return args, err
+	}
+
+	return args, nil
+}
+
+// verifyOutDir checks every entry in outDir against the file at the same relative location in the reference_dir it
+// was produced from, according to roots. expectedLinks holds the src_dir files that each reference file should be
+// linked to (in reference => src order). Any reference file without an entry in expectedLinks is expected to be a
+// copy, and will only be reported as missing if expectCopies is set.
+func verifyOutDir(outDir string, roots []outRoot, referenceHashes hashlink.PathHashes, expectedLinks hashlink.FileMap, expectCopies bool) verifyReport {
+	report := verifyReport{}
+	// Holds the reference paths that have a counterpart in outDir.
+	seenReferencePaths := map[string]bool{}
+	walkErr := filepath.Walk(outDir, func(outPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			err = &hashlink.PathError{Path: outPath, Phase: hashlink.PhaseWalk, Err: err}
+			report.results = append(report.results, verifyResult{path: outPath, status: verifyFailed, err: err})
+			return nil
+		} else if info.IsDir() {
+			return nil
+		}
+
+		referencePath, haveReference := findReferencePath(outPath, roots, referenceHashes)
+		if !haveReference || !info.Mode().IsRegular() {
+			report.results = append(report.results, verifyResult{path: outPath, status: verifyUnexpected})
+			return nil
+		}
+
+		seenReferencePaths[referencePath] = true
+		result := verifyOutFile(outPath, info, referenceHashes[referencePath], expectedLinks[referencePath])
+		report.results = append(report.results, result)
+
+		return nil
+	})
+
+	if walkErr != nil {
+		report.results = append(report.results, verifyResult{path: outDir, status: verifyFailed, err: walkErr})
+	}
+
+	for referencePath := range referenceHashes {
+		_, shouldBeLinked := expectedLinks[referencePath]
+		if seenReferencePaths[referencePath] || (!shouldBeLinked && !expectCopies) {
+			continue
+		}
+
+		outPath, err := getOutPath(referencePath, roots)
+		if err != nil {
+			report.results = append(report.results, verifyResult{path: referencePath, status: verifyFailed, err: err})
+			continue
+		}
+
+		report.results = append(report.results, verifyResult{path: outPath, status: verifyMissing})
+	}
+
+	sort.Slice(report.results, func(i, j int) bool {
+		return report.results[i].path < report.results[j].path
+	})
+
+	return report
+}
+
+// findReferencePath finds the reference file that outPath would have been produced from. As several roots can share
+// an outDir, the first root that holds a reference file at the corresponding location is used.
+func findReferencePath(outPath string, roots []outRoot, referenceHashes hashlink.PathHashes) (string, bool) {
+	for _, root := range roots {
+		relPath, err := getContainedRelPath(root.outDir, outPath)
+		if err != nil {
+			continue
+		}
+
+		referencePath := filepath.Join(root.dir, relPath)
+		_, haveReference := referenceHashes[referencePath]
+		if haveReference {
+			return referencePath, true
+		}
+	}
+
+	return "", false
+}
+
+// verifyOutFile verifies a single file in out_dir. If srcPaths is non-empty, outPath must share an inode with one of
+// them. Otherwise, it must have the same digest as referenceHash. A src file that can't be stat'd only causes a failure
+// if none of the others share an inode with outPath.
+func verifyOutFile(outPath string, outInfo os.FileInfo, referenceHash hash.Hash, srcPaths []string) verifyResult {
+	if len(srcPaths) > 0 {
+		var statErr error
+		for _, srcPath := range srcPaths {
+			srcInfo, err := os.Stat(srcPath)
+			if err != nil && statErr == nil {
+				statErr = xerrors.Errorf("could not stat src file (%s): %w", srcPath, err)
+			} else if err == nil && os.SameFile(outInfo, srcInfo) {
+				return verifyResult{path: outPath, status: verifyLinked}
+			}
+		}
+
+		if statErr != nil {
+			err := &hashlink.PathError{Path: outPath, Phase: hashlink.PhaseVerify, Err: statErr}
+			return verifyResult{path: outPath, status: verifyFailed, err: err}
+		}
+
+		return verifyResult{path: outPath, status: verifyNotLinked}
+	}
+
+	// hashFile's error already says which path could not be opened or read.
+	outHash, err := hashFile(outPath)
+	if err != nil {
+		return verifyResult{path: outPath, status: verifyFailed, err: err}
+	}
+
+	if !bytes.Equal(outHash.Sum(nil), referenceHash.Sum(nil)) {
+		err = &hashlink.PathError{Path: outPath, Phase: hashlink.PhaseVerify, Err: hashlink.ErrDigestMismatch}
+		return verifyResult{path: outPath, status: verifyDigestMismatch, err: err}
+	}
+
+	return verifyResult{path: outPath, status: verifyCopied}
+}
@@ -0,0 +1,251 @@
+package main
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ollien/hashlink"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+// verifyFixture holds a src, reference and out dir within a temporary directory.
+type verifyFixture struct {
+	root, srcDir, referenceDir, outDir string
+}
+
+type verifyTest struct {
+	name string
+	test func(t *testing.T, fixture verifyFixture)
+}
+
+func runVerifyTestTable(t *testing.T, table []verifyTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "hashlink-verify")
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			defer os.RemoveAll(root)
+			fixture := verifyFixture{
+				root:         root,
+				srcDir:       filepath.Join(root, "src"),
+				referenceDir: filepath.Join(root, "ref"),
+				outDir:       filepath.Join(root, "out"),
+			}
+
+			tt.test(t, fixture)
+		})
+	}
+}
+
+// writeTestFile writes contents to path, creating any needed directories.
+func writeTestFile(t *testing.T, path, contents string) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path, []byte(contents), 0644)
+	assert.Nil(t, err)
+}
+
+// linkTestFile hardlinks src to dst, creating any needed directories.
+func linkTestFile(t *testing.T, src, dst string) {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	assert.Nil(t, err)
+	err = os.Link(src, dst)
+	assert.Nil(t, err)
+}
+
+// runVerifyOutDir hashes the fixture's src and reference dirs and runs verifyOutDir against them.
+func runVerifyOutDir(t *testing.T, fixture verifyFixture, expectCopies bool) verifyReport {
+	srcHashes, err := hashlink.NewSerialWalkHasher(sha256.New).WalkAndHash(fixture.srcDir)
+	assert.Nil(t, err)
+	referenceHashes, err := hashlink.NewSerialWalkHasher(sha256.New).WalkAndHash(fixture.referenceDir)
+	assert.Nil(t, err)
+	expectedLinks := hashlink.MakeFlippedFileMap(hashlink.FindIdenticalFiles(srcHashes, referenceHashes))
+
+	return verifyOutDir(fixture.outDir, []outRoot{{dir: fixture.referenceDir, outDir: fixture.outDir}}, referenceHashes, expectedLinks, expectCopies)
+}
+
+// getResultStatuses gets the status of every result in a report, keyed by the path relative to root.
+func getResultStatuses(t *testing.T, root string, report verifyReport) map[string]verifyStatus {
+	statuses := map[string]verifyStatus{}
+	for _, result := range report.results {
+		relPath, err := filepath.Rel(root, result.path)
+		assert.Nil(t, err)
+		statuses[relPath] = result.status
+	}
+
+	return statuses
+}
+
+func TestVerifyOutDir(t *testing.T) {
+	tests := []verifyTest{
+		{
+			name: "everything linked and copied",
+			test: func(t *testing.T, fixture verifyFixture) {
+				writeTestFile(t, filepath.Join(fixture.srcDir, "a"), "hello world")
+				writeTestFile(t, filepath.Join(fixture.referenceDir, "dir/b"), "hello world")
+				writeTestFile(t, filepath.Join(fixture.referenceDir, "c"), "only in reference")
+				linkTestFile(t, filepath.Join(fixture.srcDir, "a"), filepath.Join(fixture.outDir, "dir/b"))
+				writeTestFile(t, filepath.Join(fixture.outDir, "c"), "only in reference")
+
+				report := runVerifyOutDir(t, fixture, true)
+				assert.True(t, report.passed())
+				assert.Equal(t, map[string]verifyStatus{
+					"out/dir/b": verifyLinked,
+					"out/c":     verifyCopied,
+				}, getResultStatuses(t, fixture.root, report))
+			},
+		},
+		{
+			name: "discrepancies",
+			test: func(t *testing.T, fixture verifyFixture) {
+				writeTestFile(t, filepath.Join(fixture.srcDir, "a"), "hello world")
+				writeTestFile(t, filepath.Join(fixture.srcDir, "b"), "my awesome file!")
+				writeTestFile(t, filepath.Join(fixture.referenceDir, "a"), "hello world")
+				writeTestFile(t, filepath.Join(fixture.referenceDir, "b"), "my awesome file!")
+				writeTestFile(t, filepath.Join(fixture.referenceDir, "c"), "only in reference")
+				// a is a copy, rather than a link, b is absent, c has the wrong contents, and d should not exist.
+				writeTestFile(t, filepath.Join(fixture.outDir, "a"), "hello world")
+				writeTestFile(t, filepath.Join(fixture.outDir, "c"), "corrupted")
+				writeTestFile(t, filepath.Join(fixture.outDir, "d"), "who put this here?")
+
+				report := runVerifyOutDir(t, fixture, false)
+				assert.False(t, report.passed())
+				assert.Equal(t, map[string]verifyStatus{
+					"out/a": verifyNotLinked,
+					"out/b": verifyMissing,
+					"out/c": verifyDigestMismatch,
+					"out/d": verifyUnexpected,
+				}, getResultStatuses(t, fixture.root, report))
+
+				for _, result := range report.results {
+					if result.status == verifyDigestMismatch {
+						assert.True(t, xerrors.Is(result.err, hashlink.ErrDigestMismatch))
+					}
+				}
+			},
+		},
+		{
+			name: "copies only missing when expected",
+			test: func(t *testing.T, fixture verifyFixture) {
+				writeTestFile(t, filepath.Join(fixture.srcDir, "a"), "hello world")
+				writeTestFile(t, filepath.Join(fixture.referenceDir, "c"), "only in reference")
+				assert.Nil(t, os.MkdirAll(fixture.outDir, 0755))
+
+				report := runVerifyOutDir(t, fixture, false)
+				assert.True(t, report.passed())
+				assert.Empty(t, report.results)
+
+				report = runVerifyOutDir(t, fixture, true)
+				assert.False(t, report.passed())
+				assert.Equal(t, map[string]verifyStatus{
+					"out/c": verifyMissing,
+				}, getResultStatuses(t, fixture.root, report))
+			},
+		},
+		{
+			name: "unreadable copy",
+			test: func(t *testing.T, fixture verifyFixture) {
+				// The file vanishing between the walk and the hash is indistinguishable from it being unreadable.
+				outPath := filepath.Join(fixture.outDir, "gone")
+				result := verifyOutFile(outPath, nil, sha256.New(), nil)
+				assert.Equal(t, verifyFailed, result.status)
+				pathErr := &hashlink.PathError{}
+				if assert.True(t, xerrors.As(result.err, &pathErr)) {
+					assert.Equal(t, hashlink.PhaseOpen, pathErr.Phase)
+					assert.Equal(t, outPath, pathErr.Path)
+				}
+
+				assert.True(t, xerrors.Is(result.err, os.ErrNotExist))
+			},
+		},
+		{
+			name: "link to a later src file",
+			test: func(t *testing.T, fixture verifyFixture) {
+				srcPath := filepath.Join(fixture.srcDir, "a")
+				outPath := filepath.Join(fixture.outDir, "a")
+				writeTestFile(t, srcPath, "hello")
+				linkTestFile(t, srcPath, outPath)
+				outInfo, err := os.Lstat(outPath)
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				result := verifyOutFile(outPath, outInfo, nil, []string{filepath.Join(fixture.srcDir, "gone"), srcPath})
+				assert.Equal(t, verifyLinked, result.status)
+				assert.Nil(t, result.err)
+			},
+		},
+		{
+			name: "unstattable src file and no link",
+			test: func(t *testing.T, fixture verifyFixture) {
+				srcPath := filepath.Join(fixture.srcDir, "a")
+				outPath := filepath.Join(fixture.outDir, "a")
+				writeTestFile(t, srcPath, "hello")
+				writeTestFile(t, outPath, "hello")
+				outInfo, err := os.Lstat(outPath)
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				// Without being able to stat every src file, we can't know whether outPath is linked to any of them.
+				result := verifyOutFile(outPath, outInfo, nil, []string{srcPath, filepath.Join(fixture.srcDir, "gone")})
+				assert.Equal(t, verifyFailed, result.status)
+				assert.True(t, xerrors.Is(result.err, os.ErrNotExist))
+			},
+		},
+	}
+
+	runVerifyTestTable(t, tests)
+}
+
+func TestVerifyOutDir_MultipleRoots(t *testing.T) {
+	runVerifyTestTable(t, []verifyTest{
+		{
+			name: "separate layout",
+			test: func(t *testing.T, fixture verifyFixture) {
+				writeTestFile(t, filepath.Join(fixture.srcDir, "a"), "hello world")
+				writeTestFile(t, filepath.Join(fixture.referenceDir, "1/b"), "hello world")
+				writeTestFile(t, filepath.Join(fixture.referenceDir, "2/b"), "hello world")
+				linkTestFile(t, filepath.Join(fixture.srcDir, "a"), filepath.Join(fixture.outDir, "1/b"))
+				writeTestFile(t, filepath.Join(fixture.outDir, "3/b"), "hello world")
+
+				referenceDirs := []string{filepath.Join(fixture.referenceDir, "1"), filepath.Join(fixture.referenceDir, "2")}
+				roots := makeOutRoots(referenceDirs, fixture.outDir, true)
+				srcHashes, err := hashlink.NewSerialWalkHasher(sha256.New).WalkAndHash(fixture.srcDir)
+				assert.Nil(t, err)
+				referenceHashes, err := hashlink.NewSerialWalkHasher(sha256.New).WalkAndHash(fixture.referenceDir)
+				assert.Nil(t, err)
+				expectedLinks := hashlink.MakeFlippedFileMap(hashlink.FindIdenticalFiles(srcHashes, referenceHashes))
+
+				report := verifyOutDir(fixture.outDir, roots, referenceHashes, expectedLinks, false)
+				assert.Equal(t, map[string]verifyStatus{
+					"out/1/b": verifyLinked,
+					"out/2/b": verifyMissing,
+					"out/3/b": verifyUnexpected,
+				}, getResultStatuses(t, fixture.root, report))
+			},
+		},
+	})
+}
@@ -0,0 +1,160 @@
+package hashlink
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"encoding/hex"
+	"hash"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/xerrors"
+)
+
+// DiffStatus represents how a file differs between two trees.
+type DiffStatus int
+
+const (
+	// DiffIdentical indicates the file is present at the same path in both trees, with the same contents.
+	DiffIdentical DiffStatus = iota
+	// DiffMoved indicates the file's contents are present in both trees, but at different paths.
+	DiffMoved
+	// DiffModified indicates the file is present at the same path in both trees, with different contents.
+	DiffModified
+	// DiffOnlyInA indicates the file is present only in the first tree.
+	DiffOnlyInA
+	// DiffOnlyInB indicates the file is present only in the second tree.
+	DiffOnlyInB
+)
+
+// DiffEntry describes how a single file differs between two trees. Paths are relative to the root of each tree, and
+// digests are hex encoded; either side is empty if the file is not present in that tree.
+type DiffEntry struct {
+	Status  DiffStatus
+	PathA   string
+	PathB   string
+	DigestA string
+	DigestB string
+}
+
+// String gets a human readable name for the status.
+func (status DiffStatus) String() string {
+	switch status {
+	case DiffIdentical:
+		return "identical"
+	case DiffMoved:
+		return "moved"
+	case DiffModified:
+		return "modified"
+	case DiffOnlyInA:
+		return "only in a"
+	case DiffOnlyInB:
+		return "only in b"
+	default:
+		return "unknown"
+	}
+}
+
+// DiffTrees classifies every file in two trees, hashesA rooted at rootA and hashesB rooted at rootB, by comparing
+// their contents. Files at the same relative path are either identical or modified. Of the remaining files, those with
+// the same contents are paired up as moves; when several files share contents, they are paired in sorted order, and
+// any left over are reported as only being present in their own tree. Entries are sorted by path.
+func DiffTrees(hashesA PathHashes, rootA string, hashesB PathHashes, rootB string) ([]DiffEntry, error) {
+	relHashesA, err := makeRelativePathHashes(hashesA, rootA)
+	if err != nil {
+		return nil, xerrors.Errorf("could not diff trees: %w", err)
+	}
+
+	relHashesB, err := makeRelativePathHashes(hashesB, rootB)
+	if err != nil {
+		return nil, xerrors.Errorf("could not diff trees: %w", err)
+	}
+
+	entries := []DiffEntry{}
+	// Holds the files that are not present at the same path in the other tree.
+	remainingA := PathHashes{}
+	remainingB := PathHashes{}
+	for path, hashA := range relHashesA {
+		hashB, inB := relHashesB[path]
+		if !inB {
+			remainingA[path] = hashA
+			continue
+		}
+
+		entry := DiffEntry{Status: DiffIdentical, PathA: path, PathB: path, DigestA: getDigest(hashA), DigestB: getDigest(hashB)}
+		if entry.DigestA != entry.DigestB {
+			entry.Status = DiffModified
+		}
+
+		entries = append(entries, entry)
+	}
+
+	for path, hashB := range relHashesB {
+		if _, inA := relHashesA[path]; !inA {
+			remainingB[path] = hashB
+		}
+	}
+
+	moves := PairIdenticalFiles(FindIdenticalFiles(remainingA, remainingB))
+	for pathA, pathsB := range moves {
+		digest := getDigest(remainingA[pathA])
+		entries = append(entries, DiffEntry{Status: DiffMoved, PathA: pathA, PathB: pathsB[0], DigestA: digest, DigestB: digest})
+	}
+
+	for _, path := range GetUnmappedFiles(remainingA, moves) {
+		entries = append(entries, DiffEntry{Status: DiffOnlyInA, PathA: path, DigestA: getDigest(remainingA[path])})
+	}
+
+	for _, path := range GetUnmappedFiles(remainingB, MakeFlippedFileMap(moves)) {
+		entries = append(entries, DiffEntry{Status: DiffOnlyInB, PathB: path, DigestB: getDigest(remainingB[path])})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return getDiffSortKey(entries[i]) < getDiffSortKey(entries[j])
+	})
+
+	return entries, nil
+}
+
+// makeRelativePathHashes makes a copy of hashes with every path made relative to root.
+func makeRelativePathHashes(hashes PathHashes, root string) (PathHashes, error) {
+	relHashes := make(PathHashes, len(hashes))
+	for path, hash := range hashes {
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil, xerrors.Errorf("could not make (%s) relative to (%s): %w", path, root, err)
+		}
+
+		relHashes[relPath] = hash
+	}
+
+	return relHashes, nil
+}
+
+// getDigest gets the hex encoded digest of the given hash.
+func getDigest(hash hash.Hash) string {
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// getDiffSortKey gets the path that an entry should be sorted by, preferring the path in the first tree.
+func getDiffSortKey(entry DiffEntry) string {
+	if entry.PathA != "" {
+		return entry.PathA
+	}
+
+	return entry.PathB
+}
@@ -0,0 +1,103 @@
+package hashlink
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"crypto/sha256"
+	"hash"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type diffTest struct {
+	name string
+	test func(t *testing.T)
+}
+
+func runDiffTestTable(t *testing.T, table []diffTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t)
+		})
+	}
+}
+
+func TestDiffTrees(t *testing.T) {
+	makeHash := func(contents string) hash.Hash {
+		outHash := sha256.New()
+		outHash.Write([]byte(contents))
+
+		return outHash
+	}
+
+	helloDigest := getDigest(makeHash("hello"))
+	worldDigest := getDigest(makeHash("world"))
+
+	tests := []diffTest{
+		{
+			name: "empty trees",
+			test: func(t *testing.T) {
+				entries, err := DiffTrees(PathHashes{}, "a", PathHashes{}, "b")
+				assert.Nil(t, err)
+				assert.Equal(t, []DiffEntry{}, entries)
+			},
+		},
+		{
+			name: "identical and modified",
+			test: func(t *testing.T) {
+				hashesA := PathHashes{"a/x": makeHash("hello"), "a/y": makeHash("hello")}
+				hashesB := PathHashes{"b/x": makeHash("hello"), "b/y": makeHash("world")}
+				entries, err := DiffTrees(hashesA, "a", hashesB, "b")
+				assert.Nil(t, err)
+				assert.Equal(t, []DiffEntry{
+					{Status: DiffIdentical, PathA: "x", PathB: "x", DigestA: helloDigest, DigestB: helloDigest},
+					{Status: DiffModified, PathA: "y", PathB: "y", DigestA: helloDigest, DigestB: worldDigest},
+				}, entries)
+			},
+		},
+		{
+			name: "moves and only in one tree",
+			test: func(t *testing.T) {
+				hashesA := PathHashes{"a/old": makeHash("hello"), "a/gone": makeHash("world")}
+				hashesB := PathHashes{"b/dir/new": makeHash("hello"), "b/new2": makeHash("hello")}
+				entries, err := DiffTrees(hashesA, "a", hashesB, "b")
+				assert.Nil(t, err)
+				assert.Equal(t, []DiffEntry{
+					{Status: DiffOnlyInA, PathA: "gone", DigestA: worldDigest},
+					{Status: DiffOnlyInB, PathB: "new2", DigestB: helloDigest},
+					{Status: DiffMoved, PathA: "old", PathB: "dir/new", DigestA: helloDigest, DigestB: helloDigest},
+				}, entries)
+			},
+		},
+		{
+			name: "files at the same path are never moved",
+			test: func(t *testing.T) {
+				hashesA := PathHashes{"a/x": makeHash("hello"), "a/y": makeHash("world")}
+				hashesB := PathHashes{"b/x": makeHash("world")}
+				entries, err := DiffTrees(hashesA, "a", hashesB, "b")
+				assert.Nil(t, err)
+				assert.Equal(t, []DiffEntry{
+					{Status: DiffModified, PathA: "x", PathB: "x", DigestA: helloDigest, DigestB: worldDigest},
+					{Status: DiffOnlyInA, PathA: "y", DigestA: worldDigest},
+				}, entries)
+			},
+		},
+	}
+
+	runDiffTestTable(t, tests)
+}
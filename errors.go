@@ -0,0 +1,65 @@
+package hashlink
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Phase identifies the step of processing a file that failed.
+type Phase string
+
+const (
+	// PhaseWalk indicates the path could not be walked, such as an unreadable directory or a file that vanished.
+	PhaseWalk Phase = "walk"
+	// PhaseOpen indicates the file could not be opened.
+	PhaseOpen Phase = "open"
+	// PhaseRead indicates the file was opened, but could not be read in full.
+	PhaseRead Phase = "read"
+	// PhaseLink indicates the file could not be hardlinked to its destination.
+	PhaseLink Phase = "link"
+	// PhaseCopy indicates the file could not be copied to its destination.
+	PhaseCopy Phase = "copy"
+	// PhaseVerify indicates the file could not be verified, or did not pass verification.
+	PhaseVerify Phase = "verify"
+)
+
+var (
+	// ErrDigestMismatch indicates a file does not have the digest it was expected to have.
+	ErrDigestMismatch = errors.New("digest does not match")
+	// ErrCrossDevice indicates a file could not be linked because its destination is on a different device.
+	ErrCrossDevice = errors.New("cannot link across devices")
+)
+
+// PathError records the failure of a single path, along with the phase it failed in. It may be found within the errors
+// returned by this package with errors.As.
+type PathError struct {
+	Path  string
+	Phase Phase
+	Err   error
+}
+
+// Error gets a description of the failure.
+func (err *PathError) Error() string {
+	return fmt.Sprintf("could not %s (%s): %s", err.Phase, err.Path, err.Err)
+}
+
+// Unwrap gets the underlying cause of the failure.
+func (err *PathError) Unwrap() error {
+	return err.Err
+}
@@ -0,0 +1,88 @@
+package hashlink
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"crypto/sha256"
+	"os"
+	"testing"
+
+	"github.com/ollien/hashlink/multierror"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+type errorTest struct {
+	name string
+	test func(t *testing.T)
+}
+
+func runErrorTestTable(t *testing.T, table []errorTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t)
+		})
+	}
+}
+
+func TestPathError(t *testing.T) {
+	tests := []errorTest{
+		{
+			name: "message",
+			test: func(t *testing.T) {
+				err := &PathError{Path: "a/b", Phase: PhaseLink, Err: ErrCrossDevice}
+				assert.Equal(t, "could not link (a/b): cannot link across devices", err.Error())
+			},
+		},
+		{
+			name: "wrapped",
+			test: func(t *testing.T) {
+				err := xerrors.Errorf("could not connect: %w", &PathError{Path: "a/b", Phase: PhaseVerify, Err: ErrDigestMismatch})
+				pathErr := &PathError{}
+				if assert.True(t, xerrors.As(err, &pathErr)) {
+					assert.Equal(t, "a/b", pathErr.Path)
+					assert.Equal(t, PhaseVerify, pathErr.Phase)
+				}
+
+				assert.True(t, xerrors.Is(err, ErrDigestMismatch))
+			},
+		},
+		{
+			name: "from a hasher",
+			test: func(t *testing.T) {
+				walker := brokenWalker{
+					staticWalker: staticWalker{files: map[string]string{}, readers: map[string]*closableStringReader{}},
+					missing:      []string{"a/missing"},
+				}
+
+				_, err := makeSerialHashWalker(walker, sha256.New).WalkAndHash("a")
+				if !assert.IsType(t, &multierror.MultiError{}, err) {
+					return
+				}
+
+				pathErr := &PathError{}
+				if assert.True(t, xerrors.As(err.(*multierror.MultiError).Errors()[0], &pathErr)) {
+					assert.Equal(t, "a/missing", pathErr.Path)
+					assert.Equal(t, PhaseOpen, pathErr.Phase)
+					assert.True(t, xerrors.Is(pathErr, os.ErrNotExist))
+				}
+			},
+		},
+	}
+
+	runErrorTestTable(t, tests)
+}
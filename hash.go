@@ -17,9 +17,13 @@ package hashlink
 */
 
 import (
+	"context"
+	"errors"
 	"hash"
 	"io"
+	"time"
 
+	"github.com/ollien/hashlink/multierror"
 	"golang.org/x/xerrors"
 )
 
@@ -33,6 +37,89 @@ type WalkHasher interface {
 	WalkAndHash(root string) (PathHashes, error)
 }
 
+// ErrHashingStopped is included in the errors returned by a WalkHasher when it stopped hashing early because of its
+// ErrorPolicy, or because its context was done. Files that had not been hashed by then will be missing from its
+// results.
+var ErrHashingStopped = errors.New("hashing stopped early due to errors")
+
+// ErrorPolicy dictates how a WalkHasher behaves when a file cannot be hashed. Regardless of the policy, a WalkHasher
+// will return the hashes of every file it did hash, along with a MultiError holding the error of every file it didn't.
+// The zero value is a fail-fast policy.
+type ErrorPolicy struct {
+	// KeepGoing will skip any file that cannot be hashed and move on to the next, rather than stopping at the first.
+	KeepGoing bool
+	// If KeepGoing is set and MaxErrors is positive, hashing will stop once more than MaxErrors files have failed.
+	MaxErrors int
+}
+
+// HashResultHandler handles the result of hashing a single file. If the file could not be hashed, hash will be nil
+// and err will hold the reason.
+type HashResultHandler func(path string, hash hash.Hash, err error)
+
+// shouldStop checks whether hashing should stop, now that numErrors files have failed.
+func (policy ErrorPolicy) shouldStop(numErrors int) bool {
+	if !policy.KeepGoing {
+		return numErrors > 0
+	}
+
+	return policy.MaxErrors > 0 && numErrors > policy.MaxErrors
+}
+
+// groupOptions gets the options that make a multierror.Group stop according to the policy.
+func (policy ErrorPolicy) groupOptions() []func(*multierror.Group) {
+	if !policy.KeepGoing {
+		return []func(*multierror.Group){multierror.GroupErrorLimit(0)}
+	} else if policy.MaxErrors > 0 {
+		return []func(*multierror.Group){multierror.GroupErrorLimit(policy.MaxErrors)}
+	}
+
+	return []func(*multierror.Group){}
+}
+
+// MergePathHashes combines the hashes from several trees (e.g. one per root directory) into a single PathHashes, so
+// that they may be treated as one tree by FindIdenticalFiles and friends. If a path is present in more than one of the
+// given PathHashes, the last one wins.
+func MergePathHashes(hashes ...PathHashes) PathHashes {
+	merged := make(PathHashes)
+	for _, treeHashes := range hashes {
+		for path, hash := range treeHashes {
+			merged[path] = hash
+		}
+	}
+
+	return merged
+}
+
+// hashData will hash the data of reader with a new hash from constructor, retrying according to policy if it cannot be
+// opened or read, until ctx is done. If stallTimeout is positive, the file will be abandoned if no data can be read from it for that long.
+// Any error will be a *PathError.
+func hashData(ctx context.Context, reader pathedData, constructor func() hash.Hash, policy RetryPolicy, stallTimeout time.Duration) (hash.Hash, error) {
+	// If the path couldn't be walked, there is nothing that could be retried.
+	if reader.err != nil {
+		return nil, reader.err
+	}
+
+	var outHash hash.Hash
+	err := policy.Do(ctx, reader.path, func() error {
+		// An abandoned attempt may still be writing to its hash, so every attempt must have its own.
+		attemptHash := constructor()
+		err := hashWithStallTimeout(attemptHash, reader, stallTimeout)
+		if err != nil {
+			return err
+		}
+
+		outHash = attemptHash
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return outHash, nil
+}
+
 // hashReader will hash a reader into the given hash interface.
 func hashReader(h hash.Hash, reader io.Reader) (retErr error) {
 	_, err := io.Copy(h, reader)
@@ -17,12 +17,15 @@ package hashlink
 */
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"hash"
 	"testing"
 
+	"github.com/ollien/hashlink/multierror"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
 )
 
 func TestSerialWalkHasher_HashWalk(t *testing.T) {
@@ -37,6 +40,173 @@ func TestParallelWalkhasher_HashWalk(t *testing.T) {
 	})
 }
 
+func TestParallelWalkHasher_ResultHandler(t *testing.T) {
+	files := map[string]string{
+		"a/b": "hello world",
+		"a/c": "my awesome file!",
+	}
+
+	walker := staticWalker{files: files, readers: make(map[string]*closableStringReader, len(files))}
+	handledDigests := map[string]string{}
+	handler := func(path string, hash hash.Hash, err error) {
+		assert.Nil(t, err)
+		handledDigests[path] = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	hasher := makeParallelHashWalker(2, walker, sha256.New, ParallelWalkHasherResultHandler(handler))
+	_, err := hasher.WalkAndHash("a")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"a/b": "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+		"a/c": "6cd8ca076b44600d0c183520c0c30bd6d65995b11a36727dcee777fa8e6f5ad0",
+	}, handledDigests)
+}
+
+type errorPolicyTest struct {
+	name string
+	test func(t *testing.T)
+}
+
+func runErrorPolicyTestTable(t *testing.T, table []errorPolicyTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t)
+		})
+	}
+}
+
+// brokenWalker walks the files of a staticWalker, followed by the missing paths, which cannot be opened.
+type brokenWalker struct {
+	staticWalker
+	missing []string
+}
+
+func (walker brokenWalker) Walk(root string, process func(reader pathedData) error) error {
+	err := walker.staticWalker.Walk(root, process)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range walker.missing {
+		err = process(pathedData{path: path})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestSerialWalkHasher_ErrorPolicy(t *testing.T) {
+	testWalkHasherErrorPolicy(t, func(walker pathWalker, policy ErrorPolicy) WalkHasher {
+		return makeSerialHashWalker(walker, sha256.New, SerialWalkHasherErrorPolicy(policy))
+	})
+}
+
+func TestParallelWalkHasher_ErrorPolicy(t *testing.T) {
+	testWalkHasherErrorPolicy(t, func(walker pathWalker, policy ErrorPolicy) WalkHasher {
+		return makeParallelHashWalker(2, walker, sha256.New, ParallelWalkHasherErrorPolicy(policy))
+	})
+}
+
+func testWalkHasherErrorPolicy(t *testing.T, makeHasher func(walker pathWalker, policy ErrorPolicy) WalkHasher) {
+	makeWalker := func() brokenWalker {
+		files := map[string]string{"a/b": "hello world", "a/c": "my awesome file!"}
+		return brokenWalker{
+			staticWalker: staticWalker{files: files, readers: map[string]*closableStringReader{}},
+			missing:      []string{"a/missing1", "a/missing2", "a/missing3"},
+		}
+	}
+
+	// isStopped checks whether the hasher reported that it stopped early.
+	isStopped := func(t *testing.T, err error) bool {
+		return assert.IsType(t, &multierror.MultiError{}, err) && xerrors.Is(err, ErrHashingStopped)
+	}
+
+	tests := []errorPolicyTest{
+		{
+			name: "keep going",
+			test: func(t *testing.T) {
+				hashes, err := makeHasher(makeWalker(), ErrorPolicy{KeepGoing: true}).WalkAndHash("a")
+				assert.Equal(t, 2, len(hashes))
+				assert.False(t, isStopped(t, err))
+				assert.Equal(t, 3, err.(*multierror.MultiError).Len())
+			},
+		},
+		{
+			name: "keep going under the limit",
+			test: func(t *testing.T) {
+				hashes, err := makeHasher(makeWalker(), ErrorPolicy{KeepGoing: true, MaxErrors: 3}).WalkAndHash("a")
+				assert.Equal(t, 2, len(hashes))
+				assert.False(t, isStopped(t, err))
+			},
+		},
+		{
+			name: "keep going over the limit",
+			test: func(t *testing.T) {
+				_, err := makeHasher(makeWalker(), ErrorPolicy{KeepGoing: true, MaxErrors: 1}).WalkAndHash("a")
+				assert.True(t, isStopped(t, err))
+			},
+		},
+		{
+			name: "fail fast",
+			test: func(t *testing.T) {
+				hashes, err := makeHasher(makeWalker(), ErrorPolicy{}).WalkAndHash("a")
+				assert.NotNil(t, hashes)
+				assert.True(t, isStopped(t, err))
+			},
+		},
+	}
+
+	runErrorPolicyTestTable(t, tests)
+}
+
+func TestSerialWalkHasher_Context(t *testing.T) {
+	testWalkHasherContext(t, func(walker pathWalker, ctx context.Context) WalkHasher {
+		return makeSerialHashWalker(walker, sha256.New, SerialWalkHasherContext(ctx))
+	})
+}
+
+func TestParallelWalkHasher_Context(t *testing.T) {
+	testWalkHasherContext(t, func(walker pathWalker, ctx context.Context) WalkHasher {
+		return makeParallelHashWalker(2, walker, sha256.New, ParallelWalkHasherContext(ctx))
+	})
+}
+
+func testWalkHasherContext(t *testing.T, makeHasher func(walker pathWalker, ctx context.Context) WalkHasher) {
+	makeWalker := func() staticWalker {
+		files := map[string]string{"a/b": "hello world", "a/c": "my awesome file!"}
+		return staticWalker{files: files, readers: map[string]*closableStringReader{}}
+	}
+
+	tests := []errorPolicyTest{
+		{
+			name: "cancelled",
+			test: func(t *testing.T) {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				hashes, err := makeHasher(makeWalker(), ctx).WalkAndHash("a")
+				assert.Equal(t, 0, len(hashes))
+				assert.IsType(t, &multierror.MultiError{}, err)
+				assert.True(t, xerrors.Is(err, ErrHashingStopped))
+				assert.True(t, xerrors.Is(err, context.Canceled))
+			},
+		},
+		{
+			name: "not cancelled",
+			test: func(t *testing.T) {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				hashes, err := makeHasher(makeWalker(), ctx).WalkAndHash("a")
+				assert.Equal(t, 2, len(hashes))
+				assert.Nil(t, err)
+			},
+		},
+	}
+
+	runErrorPolicyTestTable(t, tests)
+}
+
 func testWalkHasherInterface(t *testing.T, makeHasher func(walker pathWalker, hashConstructor func() hash.Hash) WalkHasher) {
 	files := map[string]string{
 		"a/b":    "hello world",
@@ -76,3 +246,19 @@ func testWalkHasherInterface(t *testing.T, makeHasher func(walker pathWalker, ha
 		assert.Equal(t, 1, reader.closeCount, "file="+filename)
 	}
 }
+
+func TestMergePathHashes(t *testing.T) {
+	hash1 := sha256.New()
+	hash1.Write([]byte("hello world"))
+	hash2 := sha256.New()
+	hash2.Write([]byte("my awesome file!"))
+
+	assert.Equal(t, PathHashes{}, MergePathHashes())
+	merged := MergePathHashes(PathHashes{"a/b": hash1}, PathHashes{"c/d": hash2, "a/b": hash2})
+	assert.Equal(t, PathHashes{"a/b": hash2, "c/d": hash2}, merged)
+
+	// Merging roots should let us find identical files across all of them.
+	identicalFiles := FindIdenticalFiles(PathHashes{"src/a": hash1}, MergePathHashes(PathHashes{"ref1/b": hash1}, PathHashes{"ref2/c": hash1}))
+	assert.Equal(t, 1, len(identicalFiles))
+	assert.ElementsMatch(t, []string{"ref1/b", "ref2/c"}, identicalFiles["src/a"])
+}
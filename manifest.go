@@ -0,0 +1,365 @@
+package hashlink
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// ManifestFormat represents a checksum file format that can be written by WriteManifest.
+type ManifestFormat int
+
+const (
+	// GNUTextManifest is the format produced by coreutils tools such as sha256sum and b2sum.
+	GNUTextManifest ManifestFormat = iota
+	// GNUBinaryManifest is the format produced by coreutils tools when given -b, which marks each file with a '*'.
+	GNUBinaryManifest
+	// BSDManifest is the tagged format produced by BSD tools, and by coreutils tools when given --tag.
+	BSDManifest
+	// HashdeepManifest is the CSV format produced by hashdeep.
+	HashdeepManifest
+)
+
+const hashdeepHeader = "%%%% HASHDEEP-1.0"
+
+var (
+	// ErrMalformedManifest is returned when a manifest could not be parsed.
+	ErrMalformedManifest = errors.New("malformed manifest")
+	// errDigestHashWrite is returned when attempting to write to a digestHash.
+	errDigestHashWrite = errors.New("cannot write to a precomputed digest")
+
+	bsdLinePattern = regexp.MustCompile(`^([A-Za-z0-9-]+) \((.*)\) = ([0-9A-Fa-f]+)$`)
+	gnuLinePattern = regexp.MustCompile(`^([0-9A-Fa-f]+) ([ *])(.*)$`)
+
+	// knownDigestSizes holds the digest size, in bytes, of the algorithms that are commonly found in manifests.
+	// The GNU format does not name the algorithm it uses, so this is the only way we can check it.
+	knownDigestSizes = map[string]int{
+		"md5":     16,
+		"sha1":    20,
+		"sha224":  28,
+		"sha256":  32,
+		"sha384":  48,
+		"sha512":  64,
+		"blake2b": 64,
+	}
+)
+
+// digestHash is a hash.Hash that holds a precomputed digest, such as one read from a manifest.
+// It cannot be written to.
+type digestHash struct {
+	digest []byte
+}
+
+// Write will always fail, as a digestHash's digest is fixed.
+func (h digestHash) Write(p []byte) (int, error) {
+	return 0, errDigestHashWrite
+}
+
+// Sum appends the precomputed digest to b.
+func (h digestHash) Sum(b []byte) []byte {
+	return append(b, h.digest...)
+}
+
+// Reset does nothing, as a digestHash's digest is fixed.
+func (h digestHash) Reset() {
+}
+
+// Size returns the length of the precomputed digest.
+func (h digestHash) Size() int {
+	return len(h.digest)
+}
+
+// BlockSize returns 1, as a digestHash has no underlying block size.
+func (h digestHash) BlockSize() int {
+	return 1
+}
+
+// ReadManifest reads a checksum file and produces the PathHashes it describes, allowing a tree to be used without
+// rehashing it. GNU (text and binary), BSD and hashdeep formats are all understood. Paths in the manifest are taken to
+// be relative to root. Only digests produced by algorithm (e.g. "sha256") will be accepted; if algorithm is empty,
+// any digest will be.
+func ReadManifest(reader io.Reader, root, algorithm string) (PathHashes, error) {
+	bufferedReader := bufio.NewReader(reader)
+	firstLine, err := bufferedReader.Peek(len(hashdeepHeader))
+	if err != nil && err != io.EOF {
+		return nil, xerrors.Errorf("could not read manifest: %w", err)
+	}
+
+	scanner := bufio.NewScanner(bufferedReader)
+	if string(firstLine) == hashdeepHeader {
+		return readHashdeepManifest(scanner, root, algorithm)
+	}
+
+	return readChecksumManifest(scanner, root, algorithm)
+}
+
+// readChecksumManifest reads a manifest made of GNU and BSD formatted lines, which may be freely mixed.
+func readChecksumManifest(scanner *bufio.Scanner, root, algorithm string) (PathHashes, error) {
+	hashes := make(PathHashes)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		escaped := strings.HasPrefix(line, "\\")
+		if escaped {
+			line = line[1:]
+		}
+
+		var name, digest string
+		if match := bsdLinePattern.FindStringSubmatch(line); match != nil {
+			if algorithm != "" && !strings.EqualFold(match[1], algorithm) {
+				return nil, xerrors.Errorf("line %d uses algorithm %s, expected %s: %w", lineNumber, match[1], algorithm, ErrMalformedManifest)
+			}
+
+			name, digest = match[2], match[3]
+		} else if match := gnuLinePattern.FindStringSubmatch(line); match != nil && match[3] != "" {
+			name, digest = match[3], match[1]
+		} else {
+			return nil, xerrors.Errorf("could not parse line %d: %w", lineNumber, ErrMalformedManifest)
+		}
+
+		if escaped {
+			var err error
+			name, err = unescapeManifestName(name)
+			if err != nil {
+				return nil, xerrors.Errorf("could not unescape filename on line %d: %w", lineNumber, err)
+			}
+		}
+
+		err := addManifestEntry(hashes, root, name, digest, algorithm)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid entry on line %d: %w", lineNumber, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, xerrors.Errorf("could not read manifest: %w", err)
+	}
+
+	return hashes, nil
+}
+
+// readHashdeepManifest reads a hashdeep CSV manifest, using the column for the given algorithm.
+func readHashdeepManifest(scanner *bufio.Scanner, root, algorithm string) (PathHashes, error) {
+	hashes := make(PathHashes)
+	var columns []string
+	digestColumn := -1
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "##") || line == hashdeepHeader {
+			continue
+		} else if strings.HasPrefix(line, "%%%% ") {
+			columns = strings.Split(strings.TrimPrefix(line, "%%%% "), ",")
+			digestColumn = findHashdeepDigestColumn(columns, algorithm)
+			if digestColumn == -1 {
+				return nil, xerrors.Errorf("no column for algorithm %s on line %d: %w", algorithm, lineNumber, ErrMalformedManifest)
+			}
+
+			continue
+		} else if columns == nil {
+			return nil, xerrors.Errorf("no column header before line %d: %w", lineNumber, ErrMalformedManifest)
+		}
+
+		// Filenames are always the last column, and are not quoted, so anything past the other columns is the name.
+		fields := strings.SplitN(line, ",", len(columns))
+		if len(fields) != len(columns) {
+			return nil, xerrors.Errorf("wrong number of columns on line %d: %w", lineNumber, ErrMalformedManifest)
+		}
+
+		err := addManifestEntry(hashes, root, fields[len(fields)-1], fields[digestColumn], algorithm)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid entry on line %d: %w", lineNumber, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, xerrors.Errorf("could not read manifest: %w", err)
+	}
+
+	return hashes, nil
+}
+
+// findHashdeepDigestColumn finds the index of the column holding digests for the given algorithm. If algorithm is
+// empty, the first digest column is used. -1 is returned if there is no such column.
+func findHashdeepDigestColumn(columns []string, algorithm string) int {
+	for i, column := range columns {
+		if column == "size" || column == "filename" {
+			continue
+		} else if algorithm == "" || strings.EqualFold(column, algorithm) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// addManifestEntry decodes digest and adds it to hashes under the given name, made relative to root.
+func addManifestEntry(hashes PathHashes, root, name, digest, algorithm string) error {
+	decodedDigest, err := hex.DecodeString(digest)
+	if err != nil {
+		return xerrors.Errorf("could not decode digest (%s): %w", digest, ErrMalformedManifest)
+	}
+
+	expectedSize, haveSize := knownDigestSizes[strings.ToLower(algorithm)]
+	if haveSize && len(decodedDigest) != expectedSize {
+		return xerrors.Errorf("digest (%s) is not a %s digest: %w", digest, algorithm, ErrMalformedManifest)
+	}
+
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, name)
+	}
+
+	hashes[path] = digestHash{digest: decodedDigest}
+
+	return nil
+}
+
+// WriteManifest writes hashes to writer as a checksum file of the given format, with every path made relative to
+// root. algorithm is the name of the algorithm that produced the hashes (e.g. "sha256"), which is recorded by the BSD
+// and hashdeep formats. The hashdeep format also records file sizes, so every path must exist on disk.
+func WriteManifest(writer io.Writer, hashes PathHashes, root, algorithm string, format ManifestFormat) error {
+	paths := make([]string, 0, len(hashes))
+	for path := range hashes {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+	bufferedWriter := bufio.NewWriter(writer)
+	if format == HashdeepManifest {
+		fmt.Fprintf(bufferedWriter, "%s\n%%%%%%%% size,%s,filename\n## Invoked from: %s\n##\n", hashdeepHeader, strings.ToLower(algorithm), root)
+	}
+
+	sum := make([]byte, 0)
+	for _, path := range paths {
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return xerrors.Errorf("could not make path (%s) relative to manifest root: %w", path, err)
+		}
+
+		sum = hashes[path].Sum(sum[:0])
+		digest := hex.EncodeToString(sum)
+		line, err := formatManifestLine(format, algorithm, path, name, digest)
+		if err != nil {
+			return xerrors.Errorf("could not format manifest entry: %w", err)
+		}
+
+		_, err = bufferedWriter.WriteString(line)
+		if err != nil {
+			return xerrors.Errorf("could not write manifest: %w", err)
+		}
+	}
+
+	err := bufferedWriter.Flush()
+	if err != nil {
+		return xerrors.Errorf("could not write manifest: %w", err)
+	}
+
+	return nil
+}
+
+// formatManifestLine produces a single newline terminated manifest line for the file at path, recorded under name.
+func formatManifestLine(format ManifestFormat, algorithm, path, name, digest string) (string, error) {
+	switch format {
+	case GNUTextManifest, GNUBinaryManifest, BSDManifest:
+		prefix := ""
+		if needsManifestEscape(name) {
+			prefix = "\\"
+			name = escapeManifestName(name)
+		}
+
+		if format == BSDManifest {
+			return fmt.Sprintf("%s%s (%s) = %s\n", prefix, bsdAlgorithmTag(algorithm), name, digest), nil
+		} else if format == GNUBinaryManifest {
+			return fmt.Sprintf("%s%s *%s\n", prefix, digest, name), nil
+		}
+
+		return fmt.Sprintf("%s%s  %s\n", prefix, digest, name), nil
+	case HashdeepManifest:
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", xerrors.Errorf("could not get size of (%s) for hashdeep manifest: %w", path, err)
+		}
+
+		return fmt.Sprintf("%d,%s,%s\n", info.Size(), digest, name), nil
+	default:
+		return "", xerrors.Errorf("unknown manifest format (%d)", format)
+	}
+}
+
+// bsdAlgorithmTag gets the tag BSD formatted manifests use for the given algorithm.
+func bsdAlgorithmTag(algorithm string) string {
+	// b2sum is the odd one out, and does not use an entirely uppercase tag.
+	lowerAlgorithm := strings.ToLower(algorithm)
+	if strings.HasPrefix(lowerAlgorithm, "blake2b") {
+		return "BLAKE2b" + strings.ToUpper(strings.TrimPrefix(lowerAlgorithm, "blake2b"))
+	}
+
+	return strings.ToUpper(algorithm)
+}
+
+// needsManifestEscape checks whether a filename must be escaped in the GNU or BSD formats.
+func needsManifestEscape(name string) bool {
+	return strings.ContainsAny(name, "\\\n\r")
+}
+
+// escapeManifestName escapes a filename in the same fashion as coreutils.
+func escapeManifestName(name string) string {
+	replacer := strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r")
+
+	return replacer.Replace(name)
+}
+
+// unescapeManifestName reverses escapeManifestName.
+func unescapeManifestName(name string) (string, error) {
+	builder := strings.Builder{}
+	for i := 0; i < len(name); i++ {
+		if name[i] != '\\' {
+			builder.WriteByte(name[i])
+			continue
+		} else if i == len(name)-1 {
+			return "", xerrors.Errorf("trailing escape character: %w", ErrMalformedManifest)
+		}
+
+		i++
+		switch name[i] {
+		case '\\':
+			builder.WriteByte('\\')
+		case 'n':
+			builder.WriteByte('\n')
+		case 'r':
+			builder.WriteByte('\r')
+		default:
+			return "", xerrors.Errorf("unknown escape sequence (\\%c): %w", name[i], ErrMalformedManifest)
+		}
+	}
+
+	return builder.String(), nil
+}
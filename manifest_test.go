@@ -0,0 +1,243 @@
+package hashlink
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+const (
+	helloWorldDigest = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	awesomeDigest    = "6cd8ca076b44600d0c183520c0c30bd6d65995b11a36727dcee777fa8e6f5ad0"
+)
+
+type manifestTest struct {
+	name string
+	test func(t *testing.T)
+}
+
+func runManifestTestTable(t *testing.T, table []manifestTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t)
+		})
+	}
+}
+
+// getHexDigests converts all of the hashes in a PathHashes to hex strings, for easy comparison.
+func getHexDigests(hashes PathHashes) map[string]string {
+	digests := make(map[string]string, len(hashes))
+	for path, hash := range hashes {
+		digests[path] = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	return digests
+}
+
+func TestReadManifest(t *testing.T) {
+	tests := []manifestTest{
+		{
+			name: "empty manifest",
+			test: func(t *testing.T) {
+				hashes, err := ReadManifest(strings.NewReader(""), "root", "sha256")
+				assert.Nil(t, err)
+				assert.Equal(t, PathHashes{}, hashes)
+			},
+		},
+		{
+			name: "gnu text and binary markers",
+			test: func(t *testing.T) {
+				manifest := helloWorldDigest + "  a/b\n" + awesomeDigest + " *a/bb/c\n"
+				hashes, err := ReadManifest(strings.NewReader(manifest), "root", "sha256")
+				assert.Nil(t, err)
+				assert.Equal(t, map[string]string{
+					"root/a/b":    helloWorldDigest,
+					"root/a/bb/c": awesomeDigest,
+				}, getHexDigests(hashes))
+			},
+		},
+		{
+			name: "bsd tags",
+			test: func(t *testing.T) {
+				manifest := "SHA256 (a/b) = " + helloWorldDigest + "\nSHA256 (a (copy)) = " + awesomeDigest + "\n"
+				hashes, err := ReadManifest(strings.NewReader(manifest), "root", "sha256")
+				assert.Nil(t, err)
+				assert.Equal(t, map[string]string{
+					"root/a/b":      helloWorldDigest,
+					"root/a (copy)": awesomeDigest,
+				}, getHexDigests(hashes))
+			},
+		},
+		{
+			name: "escaped filenames",
+			test: func(t *testing.T) {
+				manifest := "\\" + helloWorldDigest + "  a\\nb\\\\c\n\\SHA256 (d\\re) = " + awesomeDigest + "\n"
+				hashes, err := ReadManifest(strings.NewReader(manifest), "root", "sha256")
+				assert.Nil(t, err)
+				assert.Equal(t, map[string]string{
+					"root/a\nb\\c": helloWorldDigest,
+					"root/d\re":    awesomeDigest,
+				}, getHexDigests(hashes))
+			},
+		},
+		{
+			name: "hashdeep",
+			test: func(t *testing.T) {
+				manifest := strings.Join([]string{
+					"%%%% HASHDEEP-1.0",
+					"%%%% size,md5,sha256,filename",
+					"## Invoked from: /home/user",
+					"## $ hashdeep -r a",
+					"##",
+					"11,5eb63bbbe01eeed093cb22bb8f5acdc3," + helloWorldDigest + ",a/b",
+					"16,0e4ca5b6b38a4b8ea9e6f3a52ea58d0c," + awesomeDigest + ",a/with,comma",
+				}, "\n")
+
+				hashes, err := ReadManifest(strings.NewReader(manifest), "root", "sha256")
+				assert.Nil(t, err)
+				assert.Equal(t, map[string]string{
+					"root/a/b":          helloWorldDigest,
+					"root/a/with,comma": awesomeDigest,
+				}, getHexDigests(hashes))
+			},
+		},
+		{
+			name: "wrong algorithm",
+			test: func(t *testing.T) {
+				manifest := "MD5 (a/b) = 5eb63bbbe01eeed093cb22bb8f5acdc3\n"
+				_, err := ReadManifest(strings.NewReader(manifest), "root", "sha256")
+				assert.True(t, xerrors.Is(err, ErrMalformedManifest))
+			},
+		},
+		{
+			name: "wrong digest size",
+			test: func(t *testing.T) {
+				manifest := "5eb63bbbe01eeed093cb22bb8f5acdc3  a/b\n"
+				_, err := ReadManifest(strings.NewReader(manifest), "root", "sha256")
+				assert.True(t, xerrors.Is(err, ErrMalformedManifest))
+			},
+		},
+		{
+			name: "garbage line",
+			test: func(t *testing.T) {
+				_, err := ReadManifest(strings.NewReader("this is not a manifest\n"), "root", "sha256")
+				assert.True(t, xerrors.Is(err, ErrMalformedManifest))
+			},
+		},
+	}
+
+	runManifestTestTable(t, tests)
+}
+
+func TestWriteManifest(t *testing.T) {
+	makeHashes := func() PathHashes {
+		hash1 := sha256.New()
+		hash1.Write([]byte("hello world"))
+		hash2 := sha256.New()
+		hash2.Write([]byte("my awesome file!"))
+
+		return PathHashes{
+			"root/a/b":     hash1,
+			"root/c\nd\\e": hash2,
+		}
+	}
+
+	tests := []manifestTest{
+		{
+			name: "gnu text",
+			test: func(t *testing.T) {
+				buffer := bytes.Buffer{}
+				err := WriteManifest(&buffer, makeHashes(), "root", "sha256", GNUTextManifest)
+				assert.Nil(t, err)
+				assert.Equal(t, helloWorldDigest+"  a/b\n\\"+awesomeDigest+"  c\\nd\\\\e\n", buffer.String())
+			},
+		},
+		{
+			name: "gnu binary",
+			test: func(t *testing.T) {
+				buffer := bytes.Buffer{}
+				err := WriteManifest(&buffer, makeHashes(), "root", "sha256", GNUBinaryManifest)
+				assert.Nil(t, err)
+				assert.Equal(t, helloWorldDigest+" *a/b\n\\"+awesomeDigest+" *c\\nd\\\\e\n", buffer.String())
+			},
+		},
+		{
+			name: "bsd",
+			test: func(t *testing.T) {
+				buffer := bytes.Buffer{}
+				err := WriteManifest(&buffer, makeHashes(), "root", "blake2b", BSDManifest)
+				assert.Nil(t, err)
+				assert.Equal(t, "BLAKE2b (a/b) = "+helloWorldDigest+"\n\\BLAKE2b (c\\nd\\\\e) = "+awesomeDigest+"\n", buffer.String())
+			},
+		},
+		{
+			name: "round trip",
+			test: func(t *testing.T) {
+				for _, format := range []ManifestFormat{GNUTextManifest, GNUBinaryManifest, BSDManifest} {
+					hashes := makeHashes()
+					buffer := bytes.Buffer{}
+					err := WriteManifest(&buffer, hashes, "root", "sha256", format)
+					assert.Nil(t, err)
+					readHashes, err := ReadManifest(&buffer, "root", "sha256")
+					assert.Nil(t, err)
+					assert.Equal(t, getHexDigests(hashes), getHexDigests(readHashes))
+				}
+			},
+		},
+		{
+			name: "hashdeep round trip",
+			test: func(t *testing.T) {
+				root, err := ioutil.TempDir("", "hashlink-manifest")
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				defer os.RemoveAll(root)
+				path := filepath.Join(root, "a,b")
+				err = ioutil.WriteFile(path, []byte("hello world"), 0644)
+				if !assert.Nil(t, err) {
+					return
+				}
+
+				hash := sha256.New()
+				hash.Write([]byte("hello world"))
+				hashes := PathHashes{path: hash}
+				buffer := bytes.Buffer{}
+				err = WriteManifest(&buffer, hashes, root, "sha256", HashdeepManifest)
+				assert.Nil(t, err)
+				assert.Contains(t, buffer.String(), "%%%% size,sha256,filename\n")
+				assert.Contains(t, buffer.String(), "11,"+helloWorldDigest+",a,b\n")
+
+				readHashes, err := ReadManifest(&buffer, root, "sha256")
+				assert.Nil(t, err)
+				assert.Equal(t, getHexDigests(hashes), getHexDigests(readHashes))
+			},
+		},
+	}
+
+	runManifestTestTable(t, tests)
+}
@@ -17,25 +17,31 @@ package multierror
 */
 
 import (
+	"fmt"
 	"strings"
 	"sync"
+
+	"golang.org/x/xerrors"
 )
 
-// MultiError represents a set of errors that occurred. Implements the error interface.
+// MultiError represents a set of errors that occurred. Implements the error interface. A MultiError never holds
+// another MultiError; the errors within one are held directly instead.
 type MultiError struct {
 	errors    []error
 	errorLock sync.RWMutex
 }
 
+// ErrorGroup holds errors that share the same root cause.
+type ErrorGroup struct {
+	// Cause is the root cause of the first of Errors.
+	Cause  error
+	Errors []error
+}
+
 // NewMultiError will make a MultiError with the given errors.
 func NewMultiError(errors ...error) *MultiError {
-	errorList := errors
-	if len(errorList) == 0 {
-		errorList = make([]error, 0)
-	}
-
 	return &MultiError{
-		errors: errorList,
+		errors: flatten(errors),
 	}
 }
 
@@ -53,16 +59,18 @@ func (multiError *MultiError) Error() string {
 }
 
 // Append will append an error to the list of errors within the MultiError.
-// If a nil error is passed, it will be ignored.
+// If a nil error is passed, it will be ignored. If a MultiError is passed, each of its errors will be appended.
 func (multiError *MultiError) Append(err error) {
 	if err == nil {
 		return
 	}
 
+	// This must be done before locking, as err may well be multiError.
+	errors := flatten([]error{err})
 	multiError.errorLock.Lock()
 	defer multiError.errorLock.Unlock()
 
-	multiError.errors = append(multiError.errors, err)
+	multiError.errors = append(multiError.errors, errors...)
 }
 
 // Errors will get all errors in the form they were passed in, rather than as a single error.
@@ -83,3 +91,78 @@ func (multiError *MultiError) Len() int {
 
 	return len(multiError.errors)
 }
+
+// Is checks whether any of the contained errors is, or wraps, target. Allows xerrors.Is (or errors.Is) to search the
+// contained errors.
+func (multiError *MultiError) Is(target error) bool {
+	for _, err := range multiError.Errors() {
+		if xerrors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// As finds the first of the contained errors that can be assigned to target, as per xerrors.As. Allows xerrors.As (or
+// errors.As) to search the contained errors.
+func (multiError *MultiError) As(target interface{}) bool {
+	for _, err := range multiError.Errors() {
+		if xerrors.As(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Group groups the contained errors by their root cause, as given by RootCause. Causes are considered the same if
+// they have the same message. Groups are in the order their first error was appended, as are the errors within them.
+func (multiError *MultiError) Group() []ErrorGroup {
+	groups := []ErrorGroup{}
+	groupIndexes := map[string]int{}
+	for _, err := range multiError.Errors() {
+		cause := RootCause(err)
+		index, haveGroup := groupIndexes[cause.Error()]
+		if !haveGroup {
+			index = len(groups)
+			groupIndexes[cause.Error()] = index
+			groups = append(groups, ErrorGroup{Cause: cause})
+		}
+
+		groups[index].Errors = append(groups[index].Errors, err)
+	}
+
+	return groups
+}
+
+// String gets a summary of the group, such as "412 × permission denied".
+func (group ErrorGroup) String() string {
+	return fmt.Sprintf("%d × %s", len(group.Errors), group.Cause)
+}
+
+// RootCause gets the innermost error that err wraps, or err itself if it wraps nothing.
+func RootCause(err error) error {
+	for {
+		wrapped := xerrors.Unwrap(err)
+		if wrapped == nil {
+			return err
+		}
+
+		err = wrapped
+	}
+}
+
+// flatten replaces any MultiError within errors with the errors it holds.
+func flatten(errors []error) []error {
+	flattened := make([]error, 0, len(errors))
+	for _, err := range errors {
+		if multiErr, isMulti := err.(*MultiError); isMulti {
+			flattened = append(flattened, multiErr.Errors()...)
+		} else {
+			flattened = append(flattened, err)
+		}
+	}
+
+	return flattened
+}
@@ -22,6 +22,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
 )
 
 type specialError struct {
@@ -112,6 +113,24 @@ func TestMultiError_Append(t *testing.T) {
 				assert.Equal(t, 0, multiError.Len())
 			},
 		},
+		{
+			name: "append multierror",
+			setup: func() *MultiError {
+				return NewMultiError(errors.New("an error"), NewMultiError(errors.New("a nested error")))
+			},
+			test: func(t *testing.T, multiError *MultiError) {
+				multiError.Append(NewMultiError(errors.New("another nested error")))
+				multiError.Append(multiError)
+				assert.Equal(t, []error{
+					errors.New("an error"),
+					errors.New("a nested error"),
+					errors.New("another nested error"),
+					errors.New("an error"),
+					errors.New("a nested error"),
+					errors.New("another nested error"),
+				}, multiError.Errors())
+			},
+		},
 	}
 
 	runMultiErrorTestTable(t, tests)
@@ -165,3 +184,96 @@ func TestMultiError_Errors(t *testing.T) {
 
 	runMultiErrorTestTable(t, tests)
 }
+
+func TestMultiError_Is(t *testing.T) {
+	errTarget := errors.New("target")
+	tests := []multiErrorTest{
+		{
+			name: "contains target",
+			setup: func() *MultiError {
+				return NewMultiError(errors.New("an error"), xerrors.Errorf("wrapped: %w", errTarget))
+			},
+			test: func(t *testing.T, multiError *MultiError) {
+				assert.True(t, xerrors.Is(multiError, errTarget))
+				assert.True(t, xerrors.Is(xerrors.Errorf("wrapped: %w", multiError), errTarget))
+			},
+		},
+		{
+			name: "does not contain target",
+			setup: func() *MultiError {
+				return NewMultiError(errors.New("an error"), errors.New("target"))
+			},
+			test: func(t *testing.T, multiError *MultiError) {
+				assert.False(t, xerrors.Is(multiError, errTarget))
+			},
+		},
+	}
+
+	runMultiErrorTestTable(t, tests)
+}
+
+func TestMultiError_As(t *testing.T) {
+	tests := []multiErrorTest{
+		{
+			name: "contains type",
+			setup: func() *MultiError {
+				return NewMultiError(errors.New("an error"), xerrors.Errorf("wrapped: %w", specialError{42}), specialError{5})
+			},
+			test: func(t *testing.T, multiError *MultiError) {
+				target := specialError{}
+				assert.True(t, xerrors.As(multiError, &target))
+				assert.Equal(t, specialError{42}, target)
+			},
+		},
+		{
+			name: "does not contain type",
+			setup: func() *MultiError {
+				return NewMultiError(errors.New("an error"))
+			},
+			test: func(t *testing.T, multiError *MultiError) {
+				target := specialError{}
+				assert.False(t, xerrors.As(multiError, &target))
+			},
+		},
+	}
+
+	runMultiErrorTestTable(t, tests)
+}
+
+func TestMultiError_Group(t *testing.T) {
+	errDenied := errors.New("permission denied")
+	tests := []multiErrorTest{
+		{
+			name: "no errors",
+			setup: func() *MultiError {
+				return NewMultiError()
+			},
+			test: func(t *testing.T, multiError *MultiError) {
+				assert.Equal(t, []ErrorGroup{}, multiError.Group())
+			},
+		},
+		{
+			name: "by root cause",
+			setup: func() *MultiError {
+				return NewMultiError(
+					xerrors.Errorf("could not open a: %w", errDenied),
+					specialError{5},
+					xerrors.Errorf("could not hash b: %w", xerrors.Errorf("could not open b: %w", errDenied)),
+					// Causes with the same message are considered the same, even if they are distinct values.
+					specialError{5},
+				)
+			},
+			test: func(t *testing.T, multiError *MultiError) {
+				errs := multiError.Errors()
+				groups := multiError.Group()
+				assert.Equal(t, []ErrorGroup{
+					{Cause: errDenied, Errors: []error{errs[0], errs[2]}},
+					{Cause: specialError{5}, Errors: []error{errs[1], errs[3]}},
+				}, groups)
+				assert.Equal(t, "2 × permission denied", groups[0].String())
+			},
+		},
+	}
+
+	runMultiErrorTestTable(t, tests)
+}
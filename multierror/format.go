@@ -0,0 +1,85 @@
+package multierror
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// jsonEntry is the JSON representation of a single error within a MultiError.
+type jsonEntry struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+	Cause string `json:"cause"`
+}
+
+// Lines formats the contained errors with one per line, each preceded by its index (starting from 1). If limit is
+// positive, only the first limit errors are included, followed by a line counting the rest.
+func (multiError *MultiError) Lines(limit int) string {
+	errors, numOmitted := multiError.limitedErrors(limit)
+	output := strings.Builder{}
+	for i, err := range errors {
+		fmt.Fprintf(&output, "%d: %s\n", i+1, err)
+	}
+
+	if numOmitted > 0 {
+		fmt.Fprintf(&output, "... and %d more\n", numOmitted)
+	}
+
+	return output.String()
+}
+
+// Truncated formats the contained errors on a single line, as Error does, but only includes the first limit errors,
+// followed by a count of the rest. If limit is not positive, every error is included.
+func (multiError *MultiError) Truncated(limit int) string {
+	errors, numOmitted := multiError.limitedErrors(limit)
+	errorStrings := make([]string, len(errors), len(errors)+1)
+	for i, err := range errors {
+		errorStrings[i] = err.Error()
+	}
+
+	if numOmitted > 0 {
+		errorStrings = append(errorStrings, fmt.Sprintf("and %d more", numOmitted))
+	}
+
+	return strings.Join(errorStrings, "; ")
+}
+
+// MarshalJSON encodes the contained errors as a JSON array, holding an object with the index (starting from 1),
+// message and root cause of each. Implements json.Marshaler.
+func (multiError *MultiError) MarshalJSON() ([]byte, error) {
+	errors := multiError.Errors()
+	entries := make([]jsonEntry, len(errors))
+	for i, err := range errors {
+		entries[i] = jsonEntry{Index: i + 1, Error: err.Error(), Cause: RootCause(err).Error()}
+	}
+
+	return json.Marshal(entries)
+}
+
+// limitedErrors gets the first limit of the contained errors, along with the number that were left out. If limit is
+// not positive, every error is given.
+func (multiError *MultiError) limitedErrors(limit int) ([]error, int) {
+	errors := multiError.Errors()
+	if limit <= 0 || len(errors) <= limit {
+		return errors, 0
+	}
+
+	return errors[:limit], len(errors) - limit
+}
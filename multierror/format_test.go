@@ -0,0 +1,121 @@
+package multierror
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+func TestMultiError_Lines(t *testing.T) {
+	tests := []multiErrorTest{
+		{
+			name: "no errors",
+			setup: func() *MultiError {
+				return NewMultiError()
+			},
+			test: func(t *testing.T, multiError *MultiError) {
+				assert.Equal(t, "", multiError.Lines(0))
+			},
+		},
+		{
+			name: "no limit",
+			setup: func() *MultiError {
+				return NewMultiError(errors.New("something broke :("), errors.New("aw shucks"))
+			},
+			test: func(t *testing.T, multiError *MultiError) {
+				assert.Equal(t, "1: something broke :(\n2: aw shucks\n", multiError.Lines(0))
+				assert.Equal(t, "1: something broke :(\n2: aw shucks\n", multiError.Lines(2))
+			},
+		},
+		{
+			name: "limited",
+			setup: func() *MultiError {
+				return NewMultiError(errors.New("something broke :("), errors.New("aw shucks"), errors.New("this is bad"))
+			},
+			test: func(t *testing.T, multiError *MultiError) {
+				assert.Equal(t, "1: something broke :(\n... and 2 more\n", multiError.Lines(1))
+			},
+		},
+	}
+
+	runMultiErrorTestTable(t, tests)
+}
+
+func TestMultiError_Truncated(t *testing.T) {
+	tests := []multiErrorTest{
+		{
+			name: "no limit",
+			setup: func() *MultiError {
+				return NewMultiError(errors.New("something broke :("), errors.New("aw shucks"))
+			},
+			test: func(t *testing.T, multiError *MultiError) {
+				assert.Equal(t, multiError.Error(), multiError.Truncated(0))
+				assert.Equal(t, multiError.Error(), multiError.Truncated(5))
+			},
+		},
+		{
+			name: "limited",
+			setup: func() *MultiError {
+				return NewMultiError(errors.New("something broke :("), errors.New("aw shucks"), errors.New("this is bad"))
+			},
+			test: func(t *testing.T, multiError *MultiError) {
+				assert.Equal(t, "something broke :(; aw shucks; and 1 more", multiError.Truncated(2))
+			},
+		},
+	}
+
+	runMultiErrorTestTable(t, tests)
+}
+
+func TestMultiError_MarshalJSON(t *testing.T) {
+	tests := []multiErrorTest{
+		{
+			name: "no errors",
+			setup: func() *MultiError {
+				return NewMultiError()
+			},
+			test: func(t *testing.T, multiError *MultiError) {
+				encoded, err := json.Marshal(multiError)
+				assert.Nil(t, err)
+				assert.Equal(t, "[]", string(encoded))
+			},
+		},
+		{
+			name: "several errors",
+			setup: func() *MultiError {
+				return NewMultiError(errors.New("something broke :("), xerrors.Errorf("could not open a: %w", errors.New("permission denied")))
+			},
+			test: func(t *testing.T, multiError *MultiError) {
+				encoded, err := json.Marshal(multiError)
+				assert.Nil(t, err)
+				assert.JSONEq(
+					t,
+					`[{"index":1,"error":"something broke :(","cause":"something broke :("},`+
+						`{"index":2,"error":"could not open a: permission denied","cause":"permission denied"}]`,
+					string(encoded),
+				)
+			},
+		},
+	}
+
+	runMultiErrorTestTable(t, tests)
+}
@@ -0,0 +1,144 @@
+package multierror
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"context"
+	"sync"
+)
+
+// Group runs functions concurrently, and collects the errors they return into a single MultiError. Its context is
+// cancelled once it has collected more errors than its error limit, if it has one. Must be made with NewGroup.
+type Group struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	waitGroup sync.WaitGroup
+	// slots holds a value for every function that is running. It will be nil if there is no concurrency limit.
+	slots chan struct{}
+	// errorLimit is the number of errors that may be collected before the context is cancelled. It will be negative if
+	// there is no limit.
+	errorLimit int
+	errors     *MultiError
+	stopped    bool
+	lock       sync.Mutex
+}
+
+// GroupConcurrencyLimit will limit the number of functions that a Group runs at once. If limit is not positive, there
+// is no limit. Intended to be passed to NewGroup as an option.
+func GroupConcurrencyLimit(limit int) func(*Group) {
+	return func(group *Group) {
+		group.slots = nil
+		if limit > 0 {
+			group.slots = make(chan struct{}, limit)
+		}
+	}
+}
+
+// GroupErrorLimit will make a Group cancel its context once it has collected more than limit errors. A limit of zero
+// will cancel it at the first error. If not given, the context is only cancelled by Wait. Intended to be passed to
+// NewGroup as an option.
+func GroupErrorLimit(limit int) func(*Group) {
+	return func(group *Group) {
+		group.errorLimit = limit
+	}
+}
+
+// NewGroup makes a new Group, along with its context, which is derived from ctx.
+func NewGroup(ctx context.Context, options ...func(*Group)) (*Group, context.Context) {
+	groupCtx, cancel := context.WithCancel(ctx)
+	group := &Group{
+		ctx:        groupCtx,
+		cancel:     cancel,
+		errorLimit: -1,
+		errors:     NewMultiError(),
+	}
+
+	for _, optionFunc := range options {
+		optionFunc(group)
+	}
+
+	return group, groupCtx
+}
+
+// Go runs f in its own goroutine, with the Group's context, blocking until doing so would not exceed the
+// concurrency limit. If the context is done before f can be started, f will not be run.
+func (group *Group) Go(f func(ctx context.Context) error) {
+	if group.slots != nil {
+		select {
+		case group.slots <- struct{}{}:
+		case <-group.ctx.Done():
+			return
+		}
+	}
+
+	if group.ctx.Err() != nil {
+		group.releaseSlot()
+		return
+	}
+
+	group.waitGroup.Add(1)
+	go func() {
+		defer group.waitGroup.Done()
+		err := f(group.ctx)
+		// The error must be collected first, so that no more functions are started if it exceeds the error limit.
+		group.collect(err)
+		group.releaseSlot()
+	}()
+}
+
+// Wait waits for every function started by Go to return, and then cancels the Group's context. The errors that they
+// returned are given as a single MultiError, or nil if there were none.
+func (group *Group) Wait() *MultiError {
+	group.waitGroup.Wait()
+	group.cancel()
+	if group.errors.Len() == 0 {
+		return nil
+	}
+
+	return group.errors
+}
+
+// Stopped checks whether the Group's context was cancelled because the error limit was exceeded.
+func (group *Group) Stopped() bool {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+
+	return group.stopped
+}
+
+// releaseSlot frees a slot that was taken by Go, if there is a concurrency limit.
+func (group *Group) releaseSlot() {
+	if group.slots != nil {
+		<-group.slots
+	}
+}
+
+// collect collects err, if it is not nil, and cancels the context if the error limit has been exceeded.
+func (group *Group) collect(err error) {
+	if err == nil {
+		return
+	}
+
+	group.lock.Lock()
+	defer group.lock.Unlock()
+
+	group.errors.Append(err)
+	if !group.stopped && group.errorLimit >= 0 && group.errors.Len() > group.errorLimit {
+		group.stopped = true
+		group.cancel()
+	}
+}
@@ -0,0 +1,145 @@
+package multierror
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type groupTest struct {
+	name string
+	test func(t *testing.T)
+}
+
+func runGroupTestTable(t *testing.T, table []groupTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t)
+		})
+	}
+}
+
+func TestGroup(t *testing.T) {
+	tests := []groupTest{
+		{
+			name: "no errors",
+			test: func(t *testing.T) {
+				group, _ := NewGroup(context.Background())
+				for i := 0; i < 5; i++ {
+					group.Go(func(context.Context) error {
+						return nil
+					})
+				}
+
+				assert.Nil(t, group.Wait())
+				assert.False(t, group.Stopped())
+			},
+		},
+		{
+			name: "collects every error",
+			test: func(t *testing.T) {
+				group, ctx := NewGroup(context.Background())
+				for i := 0; i < 5; i++ {
+					i := i
+					group.Go(func(context.Context) error {
+						return specialError{i}
+					})
+				}
+
+				errs := group.Wait()
+				if assert.NotNil(t, errs) {
+					assert.ElementsMatch(t, []error{specialError{0}, specialError{1}, specialError{2}, specialError{3}, specialError{4}}, errs.Errors())
+				}
+
+				// Without an error limit, the context should only be cancelled once we're done.
+				assert.False(t, group.Stopped())
+				assert.NotNil(t, ctx.Err())
+			},
+		},
+		{
+			name: "concurrency limit",
+			test: func(t *testing.T) {
+				group, _ := NewGroup(context.Background(), GroupConcurrencyLimit(2))
+				lock := sync.Mutex{}
+				running, maxRunning := 0, 0
+				for i := 0; i < 10; i++ {
+					group.Go(func(context.Context) error {
+						lock.Lock()
+						running++
+						if running > maxRunning {
+							maxRunning = running
+						}
+						lock.Unlock()
+
+						lock.Lock()
+						running--
+						lock.Unlock()
+
+						return nil
+					})
+				}
+
+				assert.Nil(t, group.Wait())
+				assert.True(t, maxRunning <= 2)
+			},
+		},
+		{
+			name: "error limit",
+			test: func(t *testing.T) {
+				group, ctx := NewGroup(context.Background(), GroupConcurrencyLimit(1), GroupErrorLimit(1))
+				numRun := 0
+				for i := 0; i < 5; i++ {
+					group.Go(func(context.Context) error {
+						numRun++
+						return errors.New("something broke :(")
+					})
+				}
+
+				errs := group.Wait()
+				// With only one function running at a time, nothing should be started after the second error.
+				assert.Equal(t, 2, numRun)
+				if assert.NotNil(t, errs) {
+					assert.Equal(t, 2, errs.Len())
+				}
+
+				assert.True(t, group.Stopped())
+				assert.NotNil(t, ctx.Err())
+			},
+		},
+		{
+			name: "cancelled parent",
+			test: func(t *testing.T) {
+				parentCtx, cancel := context.WithCancel(context.Background())
+				cancel()
+				group, _ := NewGroup(parentCtx)
+				group.Go(func(context.Context) error {
+					return errors.New("should not run")
+				})
+
+				assert.Nil(t, group.Wait())
+				assert.False(t, group.Stopped())
+			},
+		},
+	}
+
+	runGroupTestTable(t, tests)
+}
@@ -19,7 +19,8 @@ package hashlink
 import (
 	"context"
 	"hash"
-	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ollien/hashlink/multierror"
 	"golang.org/x/xerrors"
@@ -31,6 +32,11 @@ type ParallelWalkHasher struct {
 	walker           pathWalker
 	numWorkers       int
 	progressReporter ProgressReporter
+	resultHandler    HashResultHandler
+	errorPolicy      ErrorPolicy
+	retryPolicy      RetryPolicy
+	stallTimeout     time.Duration
+	ctx              context.Context
 }
 
 // hashResult represents the result of a hashing operation.
@@ -51,6 +57,57 @@ func ParallelWalkHasherProgressReporter(reporter ProgressReporter) func(*Paralle
 	}
 }
 
+// ParallelWalkHasherResultHandler will make a ParallelWalkHasher call handler with the result of hashing each file,
+// as soon as that result is available. Intended to be passed to NewParallelWalkHasher as an option.
+func ParallelWalkHasherResultHandler(handler HashResultHandler) func(*ParallelWalkHasher) {
+	return func(hasher *ParallelWalkHasher) {
+		hasher.resultHandler = handler
+	}
+}
+
+// ParallelWalkHasherErrorPolicy will set how a ParallelWalkHasher behaves when a file cannot be hashed. If not given,
+// it will fail fast. Intended to be passed to NewParallelWalkHasher as an option.
+func ParallelWalkHasherErrorPolicy(policy ErrorPolicy) func(*ParallelWalkHasher) {
+	return func(hasher *ParallelWalkHasher) {
+		hasher.errorPolicy = policy
+	}
+}
+
+// ParallelWalkHasherRetryPolicy will set how a ParallelWalkHasher retries files that fail to open or read with a
+// transient error. If not given, no file will be retried. Intended to be passed to NewParallelWalkHasher as an option.
+func ParallelWalkHasherRetryPolicy(policy RetryPolicy) func(*ParallelWalkHasher) {
+	return func(hasher *ParallelWalkHasher) {
+		hasher.retryPolicy = policy
+	}
+}
+
+// ParallelWalkHasherStallTimeout will make a ParallelWalkHasher abandon any file that no data can be read from for
+// longer than timeout, so that its worker may move on to the next. The abandoned file fails with an error wrapping
+// ErrStalled. If not given, files are never abandoned. Intended to be passed to NewParallelWalkHasher as an option.
+func ParallelWalkHasherStallTimeout(timeout time.Duration) func(*ParallelWalkHasher) {
+	return func(hasher *ParallelWalkHasher) {
+		hasher.stallTimeout = timeout
+	}
+}
+
+// ParallelWalkHasherContext will make a ParallelWalkHasher stop giving out files once ctx is done, such as when a run
+// is interrupted. Files that are already being hashed are finished, and the errors returned by WalkAndHash will
+// include both ErrHashingStopped and the context's error. Intended to be passed to NewParallelWalkHasher as an option.
+func ParallelWalkHasherContext(ctx context.Context) func(*ParallelWalkHasher) {
+	return func(hasher *ParallelWalkHasher) {
+		hasher.ctx = ctx
+	}
+}
+
+// ParallelWalkHasherFileList will make a ParallelWalkHasher hash only the given files, rather than walking the root
+// passed to WalkAndHash. Every file must be within that root. Intended to be passed to NewParallelWalkHasher as an
+// option.
+func ParallelWalkHasherFileList(paths []string) func(*ParallelWalkHasher) {
+	return func(hasher *ParallelWalkHasher) {
+		hasher.walker = listWalker{paths: paths}
+	}
+}
+
 // NewParallelWalkHasher makekes a new ParallelWalkHasher with a constructor for a hash algorithm and a number
 // of workers.
 func NewParallelWalkHasher(numWorkers int, constructor func() hash.Hash, options ...func(*ParallelWalkHasher)) *ParallelWalkHasher {
@@ -66,6 +123,8 @@ func makeParallelHashWalker(numWorkers int, walker pathWalker, constructor func(
 		constructor:      constructor,
 		numWorkers:       numWorkers,
 		progressReporter: nilProgressReporter{},
+		resultHandler:    func(string, hash.Hash, error) {},
+		ctx:              context.Background(),
 	}
 
 	for _, optionFunc := range options {
@@ -75,7 +134,9 @@ func makeParallelHashWalker(numWorkers int, walker pathWalker, constructor func(
 	return hasher
 }
 
-// WalkAndHash walks the given path across all workers and returns hashes for all the files in the path.
+// WalkAndHash walks the given path across all workers and returns hashes for all the files in the path. If any file
+// could not be hashed, the hashes of all other files will be returned alongside a MultiError, according to the
+// hasher's ErrorPolicy.
 func (hasher *ParallelWalkHasher) WalkAndHash(root string) (PathHashes, error) {
 	walkerItems, err := getAllItemsFromWalker(hasher.walker, root)
 	if err != nil {
@@ -83,163 +144,68 @@ func (hasher *ParallelWalkHasher) WalkAndHash(root string) (PathHashes, error) {
 	}
 
 	hasher.progressReporter.ReportProgress(Progress(0))
-	ctx, cancelFunc := context.WithCancel(context.Background())
-	workerWaitGroup := sync.WaitGroup{}
-	workChan := make(chan pathedData)
-	errorChan := make(chan error)
-
-	// Spawn all workers, and send work to them
-	resultChan := hasher.spawnWorkers(ctx, &workerWaitGroup, workChan)
-	collectedResultChannel := hasher.collectResults(cancelFunc, resultChan, errorChan)
-	collectedErrorChannel := hasher.collectErrors(errorChan)
-	hasher.dispatchWork(ctx, walkerItems, workChan)
-
-	close(workChan)
-	workerWaitGroup.Wait()
-	results := <-collectedResultChannel
-	errors := <-collectedErrorChannel
+	options := append(hasher.errorPolicy.groupOptions(), multierror.GroupConcurrencyLimit(hasher.numWorkers))
+	group, ctx := multierror.NewGroup(hasher.ctx, options...)
+	resultChan := make(chan hashResult)
+	collectedResultChannel := hasher.collectResults(resultChan)
+	numStarted := int64(0)
+	for i, reader := range walkerItems {
+		// If we must stop, there are still workers that may want to finish up, but we shouldn't give them any more work.
+		if ctx.Err() != nil {
+			break
+		}
 
-	retErr := error(nil)
-	if errors.Len() > 0 {
-		retErr = errors
-	}
+		reader := reader
+		group.Go(func(context.Context) error {
+			atomic.AddInt64(&numStarted, 1)
+			outHash, err := hasher.processData(reader)
+			resultChan <- hashResult{path: reader.path, hash: outHash, err: err}
 
-	return results, retErr
-}
+			return err
+		})
 
-// spawnWorkers spawns all workers needed for hashing. All worker results will be returned on the provided channel.
-func (hasher *ParallelWalkHasher) spawnWorkers(ctx context.Context, waitGroup *sync.WaitGroup, workChan <-chan pathedData) <-chan hashResult {
-	workerChannels := make([]chan hashResult, hasher.numWorkers)
-	for i := 0; i < hasher.numWorkers; i++ {
-		workerChannel := make(chan hashResult)
-		workerChannels[i] = workerChannel
-		waitGroup.Add(1)
-		go func() {
-			hasher.doHashWork(ctx, workChan, workerChannel)
-			waitGroup.Done()
-		}()
+		// Not the _MOST_ accurate, since we're really just reporting when work has been sent, but it's good enough.
+		hasher.progressReporter.ReportProgress(Progress(i * 100 / len(walkerItems)))
 	}
 
-	return mergeResultChannels(workerChannels)
-}
-
-// dispatchWork will send jobs to all workers through the given workChan.
-func (hasher *ParallelWalkHasher) dispatchWork(ctx context.Context, work []pathedData, workChan chan<- pathedData) {
-	for i, job := range work {
-		// Send some work, but we may need to bail out early if the context has been cancelled.
-		select {
-		case workChan <- job:
-			// Not the _MOST_ accurate, since we're really just reporting when work has been sent, but it's good enough.
-			hasher.progressReporter.ReportProgress(Progress(i * 100 / len(work)))
-		case <-ctx.Done():
+	errors := group.Wait()
+	close(resultChan)
+	results := <-collectedResultChannel
+	if hasher.ctx.Err() != nil && int(numStarted) < len(walkerItems) {
+		if errors == nil {
+			errors = multierror.NewMultiError()
 		}
-	}
-}
-
-// doHashWork provides all of the coordination needed for workers to process hashes.
-func (hasher *ParallelWalkHasher) doHashWork(ctx context.Context, workChan <-chan pathedData, resultChan chan<- hashResult) {
-	defer close(resultChan)
-	for {
-		select {
-		case reader, ok := <-workChan:
-			// If there's no work left, we're done.
-			if !ok {
-				return
-			}
 
-			outHash, err := hasher.processData(reader)
-			result := hashResult{
-				path: reader.path,
-				hash: outHash,
-				err:  err,
-			}
-
-			resultChan <- result
-		case <-ctx.Done():
-			return
-		}
+		errors.Append(hasher.ctx.Err())
+		errors.Append(ErrHashingStopped)
+	} else if errors == nil {
+		return results, nil
+	} else if group.Stopped() {
+		errors.Append(ErrHashingStopped)
 	}
+
+	return results, errors
 }
 
-// processData will perform the hash and any cleanup needed for the given reader.
+// processData will perform the hash and any cleanup needed for the given reader. Any error will be a *PathError.
 func (hasher *ParallelWalkHasher) processData(reader pathedData) (hash.Hash, error) {
-	outHash := hasher.constructor()
-	data, err := reader.open()
-	if err != nil {
-		err = xerrors.Errorf("could not open data for path (%s) in worker: %w", reader.path, err)
-		return nil, err
-	}
-
-	defer data.Close()
-	err = hashReader(outHash, data)
-	if err != nil {
-		err = xerrors.Errorf("could not hash reader in worker (%s): %w", reader.path, err)
-		return nil, err
-	}
-
-	return outHash, nil
+	return hashData(hasher.ctx, reader, hasher.constructor, hasher.retryPolicy, hasher.stallTimeout)
 }
 
 // collectResults collects all of the results from workers, and will return it on the provided channel when complete.
-func (hasher *ParallelWalkHasher) collectResults(cancelFunc context.CancelFunc, resultChan <-chan hashResult, errorChan chan<- error) <-chan PathHashes {
+func (hasher *ParallelWalkHasher) collectResults(resultChan <-chan hashResult) <-chan PathHashes {
 	outChan := make(chan PathHashes)
 	go func() {
 		hashes := make(PathHashes)
 		for result := range resultChan {
-			// If we've received an error, we should store it and move on.
-			// We will cancel the context, but there are still workers that may want to finish up.
-			if result.err != nil {
-				errorChan <- result.err
-				cancelFunc()
-				continue
+			hasher.resultHandler(result.path, result.hash, result.err)
+			if result.err == nil {
+				hashes[result.path] = result.hash
 			}
-
-			hashes[result.path] = result.hash
 		}
 
 		outChan <- hashes
 		close(outChan)
-		// We've collected all results, so we're also done collecting errors.
-		close(errorChan)
-	}()
-
-	return outChan
-}
-
-// collectErrors collects all of the errors from errorChan, and will produce one MultiError on the provided channel.
-func (hasher *ParallelWalkHasher) collectErrors(errorChan <-chan error) <-chan *multierror.MultiError {
-	outChan := make(chan *multierror.MultiError)
-	errors := multierror.NewMultiError()
-	go func() {
-		for err := range errorChan {
-			errors.Append(err)
-		}
-
-		outChan <- errors
-		close(outChan)
-	}()
-
-	return outChan
-}
-
-// mergeResultChannels will merge all channels of hashResult into a single channel.
-func mergeResultChannels(workerChannels []chan hashResult) <-chan hashResult {
-	outChan := make(chan hashResult)
-	go func() {
-		waitGroup := sync.WaitGroup{}
-		for _, workerChan := range workerChannels {
-			waitGroup.Add(1)
-			go func(workerChan <-chan hashResult, outChan chan<- hashResult) {
-				for result := range workerChan {
-					outChan <- result
-				}
-				waitGroup.Done()
-			}(workerChan, outChan)
-		}
-
-		// When we're done merging all of the results, we can safely close the channel
-		waitGroup.Wait()
-		close(outChan)
 	}()
 
 	return outChan
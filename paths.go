@@ -16,7 +16,10 @@ package hashlink
 	limitations under the License.
 */
 
-import "encoding/hex"
+import (
+	"encoding/hex"
+	"sort"
+)
 
 // FileMap represents a mapping between one file path and any related file paths.
 type FileMap map[string][]string
@@ -68,6 +71,78 @@ func MakeFlippedFileMap(files FileMap) FileMap {
 	return outMap
 }
 
+// AssignUniqueSources takes a FileMap, such as one produced by FindIdenticalFiles, and picks exactly one of the files
+// mapped to each related path, so that every related path appears only once in the result. When several files are
+// mapped to the same related path, the one that sorts first is picked, so the result is stable between runs. Files
+// left with no related paths are omitted.
+func AssignUniqueSources(files FileMap) FileMap {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+	assigned := make(map[string]bool)
+	outMap := FileMap{}
+	for _, path := range paths {
+		for _, relatedPath := range files[path] {
+			if assigned[relatedPath] {
+				continue
+			}
+
+			assigned[relatedPath] = true
+			outMap[path] = append(outMap[path], relatedPath)
+		}
+	}
+
+	return outMap
+}
+
+// PairIdenticalFiles takes a FileMap, such as one produced by FindIdenticalFiles, and pairs each file with at most one
+// of its related paths, such that no related path is used twice. Unlike AssignUniqueSources, every file in the result
+// has exactly one related path. Files are paired in sorted order, so the result is stable between runs.
+func PairIdenticalFiles(files FileMap) FileMap {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+	used := make(map[string]bool)
+	pairs := FileMap{}
+	for _, path := range paths {
+		relatedPaths := append([]string{}, files[path]...)
+		sort.Strings(relatedPaths)
+		for _, relatedPath := range relatedPaths {
+			if used[relatedPath] {
+				continue
+			}
+
+			used[relatedPath] = true
+			pairs[path] = []string{relatedPath}
+			break
+		}
+	}
+
+	return pairs
+}
+
+// FindDuplicateFiles finds every group of paths in hashes that share a hash. The result maps the hex digest of each
+// shared hash to its paths, in sorted order. Hashes that belong to only one path are omitted.
+func FindDuplicateFiles(hashes PathHashes) map[string][]string {
+	duplicates := make(map[string][]string)
+	for digest, paths := range mapHashesToPaths(hashes) {
+		if len(paths) < 2 {
+			continue
+		}
+
+		sort.Strings(paths)
+		duplicates[digest] = paths
+	}
+
+	return duplicates
+}
+
 // mapHashesToPaths will flip the map, and bucket all non-unique hashes into one key, where the keys are string digests
 // of the hash. hash.Hashes are not compariable on their own, thus we need to encode them.
 func mapHashesToPaths(hashes PathHashes) map[string][]string {
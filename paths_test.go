@@ -18,6 +18,7 @@ package hashlink
 
 import (
 	"crypto/sha256"
+	"hash"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -288,3 +289,116 @@ func TestMakeFlippedFileMap(t *testing.T) {
 
 	runPathTestTable(t, tests)
 }
+
+func TestAssignUniqueSources(t *testing.T) {
+	tests := []pathTest{
+		{
+			name: "no files",
+			test: func(t *testing.T) {
+				assert.Equal(t, FileMap{}, AssignUniqueSources(FileMap{}))
+			},
+		},
+		{
+			name: "already unique",
+			test: func(t *testing.T) {
+				files := FileMap{
+					"a/b": []string{"b/c"},
+					"d/e": []string{"f/g", "h/i"},
+				}
+
+				assert.Equal(t, files, AssignUniqueSources(files))
+			},
+		},
+		{
+			name: "shared related paths",
+			test: func(t *testing.T) {
+				files := FileMap{
+					"d/e": []string{"b/c", "g/h"},
+					"a/b": []string{"b/c"},
+					"z/z": []string{"g/h"},
+				}
+
+				assert.Equal(t, FileMap{
+					"a/b": []string{"b/c"},
+					"d/e": []string{"g/h"},
+				}, AssignUniqueSources(files))
+			},
+		},
+	}
+
+	runPathTestTable(t, tests)
+}
+
+func TestFindDuplicateFiles(t *testing.T) {
+	makeHash := func(contents string) hash.Hash {
+		outHash := sha256.New()
+		outHash.Write([]byte(contents))
+
+		return outHash
+	}
+
+	tests := []pathTest{
+		{
+			name: "no files",
+			test: func(t *testing.T) {
+				assert.Equal(t, map[string][]string{}, FindDuplicateFiles(PathHashes{}))
+			},
+		},
+		{
+			name: "unique files are omitted",
+			test: func(t *testing.T) {
+				hashes := PathHashes{
+					"a/b": makeHash("hello"),
+					"c/d": makeHash("world"),
+				}
+
+				assert.Equal(t, map[string][]string{}, FindDuplicateFiles(hashes))
+			},
+		},
+		{
+			name: "duplicates are grouped and sorted",
+			test: func(t *testing.T) {
+				hashes := PathHashes{
+					"z/z": makeHash("hello world"),
+					"a/b": makeHash("hello world"),
+					"c/d": makeHash("hello world"),
+					"e/f": makeHash("unique"),
+				}
+
+				assert.Equal(t, map[string][]string{
+					"b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9": []string{"a/b", "c/d", "z/z"},
+				}, FindDuplicateFiles(hashes))
+			},
+		},
+	}
+
+	runPathTestTable(t, tests)
+}
+
+func TestPairIdenticalFiles(t *testing.T) {
+	tests := []pathTest{
+		{
+			name: "no files",
+			test: func(t *testing.T) {
+				assert.Equal(t, FileMap{}, PairIdenticalFiles(FileMap{}))
+			},
+		},
+		{
+			name: "one related path each",
+			test: func(t *testing.T) {
+				files := FileMap{
+					"b/b": []string{"y/y", "x/x"},
+					"a/a": []string{"x/x", "y/y"},
+					"c/c": []string{"x/x"},
+				}
+
+				assert.Equal(t, FileMap{
+					"a/a": []string{"x/x"},
+					"b/b": []string{"y/y"},
+				}, PairIdenticalFiles(files))
+			},
+		},
+	}
+
+	runPathTestTable(t, tests)
+}
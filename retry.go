@@ -0,0 +1,97 @@
+package hashlink
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"context"
+	"syscall"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// TransientErrnos are the errors that a RetryPolicy retries if it is not given any others. Each of them may be
+// produced by flaky devices or network filesystems, and succeed when the operation is tried again.
+var TransientErrnos = []syscall.Errno{syscall.EIO, syscall.EAGAIN, syscall.EINTR, syscall.ESTALE, syscall.ETIMEDOUT}
+
+// RetryPolicy dictates how an operation on a file that failed with a transient error is retried. The zero value never
+// retries.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times an operation is attempted, including the first attempt.
+	MaxAttempts int
+	// InitialBackoff is how long to wait before the first retry. Every retry after it waits twice as long as the last.
+	InitialBackoff time.Duration
+	// If MaxBackoff is positive, no retry will wait longer than it.
+	MaxBackoff time.Duration
+	// Errnos holds the errors that may be retried. If empty, TransientErrnos are retried.
+	Errnos []syscall.Errno
+	// If OnRetry is set, it is called before every retry of an operation on path, with the number of the retry
+	// (starting from 1) and the error that caused it. It may be called from several goroutines at once.
+	OnRetry func(path string, retry int, err error)
+}
+
+// Do performs op, which operates on path, until it succeeds, fails with an error that can't be retried, or has been
+// attempted MaxAttempts times. Once ctx is done, no more attempts are made, even if Do is waiting to retry. The error
+// from the final attempt is returned.
+func (policy RetryPolicy) Do(ctx context.Context, path string, op func() error) error {
+	backoff := policy.capBackoff(policy.InitialBackoff)
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= policy.MaxAttempts || !policy.isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		if policy.OnRetry != nil {
+			policy.OnRetry(path, attempt, err)
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+
+		backoff = policy.capBackoff(backoff * 2)
+	}
+}
+
+// capBackoff limits backoff to the policy's MaxBackoff, if it has one.
+func (policy RetryPolicy) capBackoff(backoff time.Duration) time.Duration {
+	if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+		return policy.MaxBackoff
+	}
+
+	return backoff
+}
+
+// isRetryable checks whether err is, or wraps, one of the errors that the policy retries.
+func (policy RetryPolicy) isRetryable(err error) bool {
+	errnos := policy.Errnos
+	if len(errnos) == 0 {
+		errnos = TransientErrnos
+	}
+
+	for _, errno := range errnos {
+		if xerrors.Is(err, errno) {
+			return true
+		}
+	}
+
+	return false
+}
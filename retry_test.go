@@ -0,0 +1,218 @@
+package hashlink
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+// flakyReader fails its first numFailures reads with err, and then reads from its underlying reader.
+type flakyReader struct {
+	reader      *strings.Reader
+	numFailures int
+	err         error
+}
+
+func (reader *flakyReader) Read(p []byte) (int, error) {
+	if reader.numFailures > 0 {
+		reader.numFailures--
+		return 0, reader.err
+	}
+
+	return reader.reader.Read(p)
+}
+
+// Close will simply nop.
+func (reader *flakyReader) Close() error {
+	return nil
+}
+
+type retryTest struct {
+	name string
+	test func(t *testing.T)
+}
+
+func runRetryTestTable(t *testing.T, table []retryTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t)
+		})
+	}
+}
+
+func TestRetryPolicy_Do(t *testing.T) {
+	// failingOp makes an operation that fails with err numFailures times before succeeding, and counts its attempts.
+	failingOp := func(numFailures int, err error, numAttempts *int) func() error {
+		return func() error {
+			*numAttempts++
+			if *numAttempts <= numFailures {
+				return err
+			}
+
+			return nil
+		}
+	}
+
+	transientErr := &os.PathError{Op: "read", Path: "a", Err: syscall.EIO}
+	tests := []retryTest{
+		{
+			name: "succeeds after retrying",
+			test: func(t *testing.T) {
+				numAttempts := 0
+				retries := []int{}
+				policy := RetryPolicy{
+					MaxAttempts:    3,
+					InitialBackoff: time.Millisecond,
+					OnRetry: func(path string, retry int, err error) {
+						assert.Equal(t, "a", path)
+						assert.Equal(t, transientErr, err)
+						retries = append(retries, retry)
+					},
+				}
+
+				err := policy.Do(context.Background(), "a", failingOp(2, transientErr, &numAttempts))
+				assert.Nil(t, err)
+				assert.Equal(t, 3, numAttempts)
+				assert.Equal(t, []int{1, 2}, retries)
+			},
+		},
+		{
+			name: "gives up",
+			test: func(t *testing.T) {
+				numAttempts := 0
+				policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+				err := policy.Do(context.Background(), "a", failingOp(5, transientErr, &numAttempts))
+				assert.Equal(t, transientErr, err)
+				assert.Equal(t, 3, numAttempts)
+			},
+		},
+		{
+			name: "error that can't be retried",
+			test: func(t *testing.T) {
+				numAttempts := 0
+				policy := RetryPolicy{MaxAttempts: 3}
+				err := policy.Do(context.Background(), "a", failingOp(1, &os.PathError{Op: "open", Path: "a", Err: syscall.ENOENT}, &numAttempts))
+				assert.True(t, xerrors.Is(err, syscall.ENOENT))
+				assert.Equal(t, 1, numAttempts)
+			},
+		},
+		{
+			name: "custom errnos",
+			test: func(t *testing.T) {
+				numAttempts := 0
+				policy := RetryPolicy{MaxAttempts: 3, Errnos: []syscall.Errno{syscall.ENOENT}}
+				err := policy.Do(context.Background(), "a", failingOp(1, xerrors.Errorf("could not open: %w", syscall.ENOENT), &numAttempts))
+				assert.Nil(t, err)
+				assert.Equal(t, 2, numAttempts)
+
+				numAttempts = 0
+				err = policy.Do(context.Background(), "a", failingOp(1, transientErr, &numAttempts))
+				assert.Equal(t, transientErr, err)
+				assert.Equal(t, 1, numAttempts)
+			},
+		},
+		{
+			name: "cancelled while waiting",
+			test: func(t *testing.T) {
+				numAttempts := 0
+				ctx, cancel := context.WithCancel(context.Background())
+				// Cancel as soon as the first retry is about to wait, which would otherwise take a minute.
+				policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Minute, OnRetry: func(string, int, error) { cancel() }}
+				start := time.Now()
+				err := policy.Do(ctx, "a", failingOp(5, transientErr, &numAttempts))
+				assert.Equal(t, transientErr, err)
+				assert.Equal(t, 1, numAttempts)
+				assert.True(t, time.Since(start) < time.Minute)
+			},
+		},
+		{
+			name: "already cancelled",
+			test: func(t *testing.T) {
+				numAttempts := 0
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				policy := RetryPolicy{MaxAttempts: 3}
+				err := policy.Do(ctx, "a", failingOp(5, transientErr, &numAttempts))
+				assert.Equal(t, transientErr, err)
+				assert.Equal(t, 1, numAttempts)
+			},
+		},
+		{
+			name: "zero value",
+			test: func(t *testing.T) {
+				numAttempts := 0
+				err := RetryPolicy{}.Do(context.Background(), "a", failingOp(1, transientErr, &numAttempts))
+				assert.Equal(t, transientErr, err)
+				assert.Equal(t, 1, numAttempts)
+			},
+		},
+	}
+
+	runRetryTestTable(t, tests)
+}
+
+func TestHashData_Retry(t *testing.T) {
+	tests := []retryTest{
+		{
+			name: "transient read error",
+			test: func(t *testing.T) {
+				reader := &flakyReader{reader: strings.NewReader("hello world"), numFailures: 1, err: syscall.EIO}
+				policy := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}
+				outHash, err := hashData(context.Background(), pathedData{path: "a", data: reader}, sha256.New, policy, 0)
+				if assert.Nil(t, err) {
+					// sha256 of "hello world"
+					assert.Equal(t, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", hex.EncodeToString(outHash.Sum(nil)))
+				}
+			},
+		},
+		{
+			name: "without retries",
+			test: func(t *testing.T) {
+				reader := &flakyReader{reader: strings.NewReader("hello world"), numFailures: 1, err: syscall.EIO}
+				_, err := hashData(context.Background(), pathedData{path: "a", data: reader}, sha256.New, RetryPolicy{}, 0)
+				pathErr := &PathError{}
+				if assert.True(t, xerrors.As(err, &pathErr)) {
+					assert.Equal(t, PhaseRead, pathErr.Phase)
+					assert.True(t, xerrors.Is(err, syscall.EIO))
+				}
+			},
+		},
+		{
+			name: "unwalkable path",
+			test: func(t *testing.T) {
+				numRetries := 0
+				policy := RetryPolicy{MaxAttempts: 2, OnRetry: func(string, int, error) { numRetries++ }}
+				walkErr := &PathError{Path: "a", Phase: PhaseWalk, Err: syscall.EIO}
+				_, err := hashData(context.Background(), pathedData{path: "a", err: walkErr}, sha256.New, policy, 0)
+				assert.Equal(t, walkErr, err)
+				assert.Equal(t, 0, numRetries)
+			},
+		},
+	}
+
+	runRetryTestTable(t, tests)
+}
@@ -17,7 +17,9 @@ package hashlink
 */
 
 import (
+	"context"
 	"hash"
+	"time"
 
 	"github.com/ollien/hashlink/multierror"
 	"golang.org/x/xerrors"
@@ -29,6 +31,11 @@ type SerialWalkHasher struct {
 	constructor      func() hash.Hash
 	walker           pathWalker
 	progressReporter ProgressReporter
+	resultHandler    HashResultHandler
+	errorPolicy      ErrorPolicy
+	retryPolicy      RetryPolicy
+	stallTimeout     time.Duration
+	ctx              context.Context
 }
 
 // SerialWalkHasherProgressReporter will provide a ProgressReporter for a SerialWalkHasher.
@@ -39,6 +46,57 @@ func SerialWalkHasherProgressReporter(reporter ProgressReporter) func(*SerialWal
 	}
 }
 
+// SerialWalkHasherResultHandler will make a SerialWalkHasher call handler with the result of hashing each file, as
+// soon as that result is available. Intended to be passed to NewSerialWalkHasher as an option.
+func SerialWalkHasherResultHandler(handler HashResultHandler) func(*SerialWalkHasher) {
+	return func(hasher *SerialWalkHasher) {
+		hasher.resultHandler = handler
+	}
+}
+
+// SerialWalkHasherErrorPolicy will set how a SerialWalkHasher behaves when a file cannot be hashed. If not given, it
+// will fail fast. Intended to be passed to NewSerialWalkHasher as an option.
+func SerialWalkHasherErrorPolicy(policy ErrorPolicy) func(*SerialWalkHasher) {
+	return func(hasher *SerialWalkHasher) {
+		hasher.errorPolicy = policy
+	}
+}
+
+// SerialWalkHasherRetryPolicy will set how a SerialWalkHasher retries files that fail to open or read with a transient
+// error. If not given, no file will be retried. Intended to be passed to NewSerialWalkHasher as an option.
+func SerialWalkHasherRetryPolicy(policy RetryPolicy) func(*SerialWalkHasher) {
+	return func(hasher *SerialWalkHasher) {
+		hasher.retryPolicy = policy
+	}
+}
+
+// SerialWalkHasherStallTimeout will make a SerialWalkHasher abandon any file that no data can be read from for longer
+// than timeout, so that it may move on to the next. The abandoned file fails with an error wrapping ErrStalled. If not
+// given, files are never abandoned. Intended to be passed to NewSerialWalkHasher as an option.
+func SerialWalkHasherStallTimeout(timeout time.Duration) func(*SerialWalkHasher) {
+	return func(hasher *SerialWalkHasher) {
+		hasher.stallTimeout = timeout
+	}
+}
+
+// SerialWalkHasherContext will make a SerialWalkHasher stop before hashing its next file once ctx is done, such as
+// when a run is interrupted. The errors returned by WalkAndHash will then include both ErrHashingStopped and the
+// context's error. Intended to be passed to NewSerialWalkHasher as an option.
+func SerialWalkHasherContext(ctx context.Context) func(*SerialWalkHasher) {
+	return func(hasher *SerialWalkHasher) {
+		hasher.ctx = ctx
+	}
+}
+
+// SerialWalkHasherFileList will make a SerialWalkHasher hash only the given files, rather than walking the root
+// passed to WalkAndHash. Every file must be within that root. Intended to be passed to NewSerialWalkHasher as an
+// option.
+func SerialWalkHasherFileList(paths []string) func(*SerialWalkHasher) {
+	return func(hasher *SerialWalkHasher) {
+		hasher.walker = listWalker{paths: paths}
+	}
+}
+
 // NewSerialWalkHasher makes a new SerialWalkHasher with a constructor for a hash algorithm.
 func NewSerialWalkHasher(constructor func() hash.Hash, options ...func(*SerialWalkHasher)) *SerialWalkHasher {
 	walker := fileWalker{}
@@ -52,6 +110,8 @@ func makeSerialHashWalker(walker pathWalker, constructor func() hash.Hash, optio
 		walker:           walker,
 		constructor:      constructor,
 		progressReporter: nilProgressReporter{},
+		resultHandler:    func(string, hash.Hash, error) {},
+		ctx:              context.Background(),
 	}
 
 	for _, optionFunc := range options {
@@ -61,7 +121,8 @@ func makeSerialHashWalker(walker pathWalker, constructor func() hash.Hash, optio
 	return hasher
 }
 
-// WalkAndHash walks the given path and returns hashes for all the files in the path.
+// WalkAndHash walks the given path and returns hashes for all the files in the path. If any file could not be hashed,
+// the hashes of all other files will be returned alongside a MultiError, according to the hasher's ErrorPolicy.
 func (hasher SerialWalkHasher) WalkAndHash(root string) (PathHashes, error) {
 	walkedMap := make(PathHashes)
 	// Walk all of the files and collect hashes for them
@@ -73,10 +134,22 @@ func (hasher SerialWalkHasher) WalkAndHash(root string) (PathHashes, error) {
 	errors := multierror.NewMultiError()
 	hasher.progressReporter.ReportProgress(Progress(0))
 	for i, reader := range walkerItems {
+		if hasher.ctx.Err() != nil {
+			errors.Append(hasher.ctx.Err())
+			errors.Append(ErrHashingStopped)
+			break
+		}
+
 		outHash, err := hasher.processData(reader)
+		hasher.resultHandler(reader.path, outHash, err)
 		hasher.progressReporter.ReportProgress(Progress(i * 100 / len(walkerItems)))
 		if err != nil {
 			errors.Append(err)
+			if hasher.errorPolicy.shouldStop(errors.Len()) {
+				errors.Append(ErrHashingStopped)
+				break
+			}
+
 			continue
 		}
 
@@ -84,27 +157,13 @@ func (hasher SerialWalkHasher) WalkAndHash(root string) (PathHashes, error) {
 	}
 
 	if errors.Len() > 0 {
-		return nil, xerrors.Errorf("could not perform serial hash walker: %w", errors)
+		return walkedMap, errors
 	}
 
 	return walkedMap, nil
 }
 
-// processData will perform the hash and any cleanup needed for the given reader.
+// processData will perform the hash and any cleanup needed for the given reader. Any error will be a *PathError.
 func (hasher SerialWalkHasher) processData(reader pathedData) (hash.Hash, error) {
-	data, err := reader.open()
-	if err != nil {
-		err = xerrors.Errorf("could not open data for path (%s)", reader.path, err)
-		return nil, err
-	}
-
-	defer data.Close()
-	outHash := hasher.constructor()
-	err = hashReader(outHash, data)
-	if err != nil {
-		err = xerrors.Errorf("could not hash path (%s): %w", reader.path, err)
-		return nil, err
-	}
-
-	return outHash, nil
+	return hashData(hasher.ctx, reader, hasher.constructor, hasher.retryPolicy, hasher.stallTimeout)
 }
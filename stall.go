@@ -0,0 +1,114 @@
+package hashlink
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"errors"
+	"hash"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ErrStalled is wrapped by the errors of files that were abandoned because no data could be read from them for longer
+// than a hasher's stall timeout, such as those on a hung network mount or a failing disk.
+var ErrStalled = errors.New("no data was read before the stall timeout")
+
+// progressReader wraps a reader, recording when data was last read from it.
+type progressReader struct {
+	reader io.Reader
+	// lastProgress is the time of the last read that returned any data, in nanoseconds since the Unix epoch. It must
+	// only be accessed atomically.
+	lastProgress *int64
+}
+
+// Read reads from the underlying reader, and records the time if any data was read.
+func (reader progressReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(reader.lastProgress, time.Now().UnixNano())
+	}
+
+	return n, err
+}
+
+// hashWithStallTimeout opens reader and hashes all of its data into h. If timeout is positive and passes without any
+// data being read (including while the file is being opened), the file is abandoned and a *PathError wrapping
+// ErrStalled is returned. A read that is blocked in the kernel cannot be interrupted, so it is left to finish in the
+// background; h must not be used after the file is abandoned. Any other error will be a *PathError.
+func hashWithStallTimeout(h hash.Hash, reader pathedData, timeout time.Duration) error {
+	if timeout <= 0 {
+		return hashOpened(h, reader, nil)
+	}
+
+	lastProgress := time.Now().UnixNano()
+	opened := int32(0)
+	// Buffered so that an abandoned hash can still finish without anything left to receive its result.
+	done := make(chan error, 1)
+	go func() {
+		done <- hashOpened(h, reader, func(data io.Reader) io.Reader {
+			atomic.StoreInt32(&opened, 1)
+			atomic.StoreInt64(&lastProgress, time.Now().UnixNano())
+
+			return progressReader{reader: data, lastProgress: &lastProgress}
+		})
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-timer.C:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&lastProgress)))
+			if idle < timeout {
+				timer.Reset(timeout - idle)
+				continue
+			}
+
+			phase := PhaseRead
+			if atomic.LoadInt32(&opened) == 0 {
+				phase = PhaseOpen
+			}
+
+			return &PathError{Path: reader.path, Phase: phase, Err: ErrStalled}
+		}
+	}
+}
+
+// hashOpened opens reader and hashes all of its data into h. If wrap is not nil, the opened data is read through the
+// reader it returns. Any error will be a *PathError.
+func hashOpened(h hash.Hash, reader pathedData, wrap func(io.Reader) io.Reader) error {
+	data, err := reader.open()
+	if err != nil {
+		return err
+	}
+
+	defer data.Close()
+	wrappedData := io.Reader(data)
+	if wrap != nil {
+		wrappedData = wrap(data)
+	}
+
+	err = hashReader(h, wrappedData)
+	if err != nil {
+		return &PathError{Path: reader.path, Phase: PhaseRead, Err: err}
+	}
+
+	return nil
+}
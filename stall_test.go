@@ -0,0 +1,163 @@
+package hashlink
+
+/*
+	Copyright 2019 Nicholas Krichevsky
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ollien/hashlink/multierror"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+// stuckReader blocks every read until it is released, as a read from a hung mount would.
+type stuckReader struct {
+	release chan struct{}
+}
+
+func (reader stuckReader) Read(p []byte) (int, error) {
+	<-reader.release
+
+	return 0, xerrors.New("released")
+}
+
+// Close will simply nop.
+func (reader stuckReader) Close() error {
+	return nil
+}
+
+// slowReader reads one byte at a time from its underlying reader, waiting for delay before each.
+type slowReader struct {
+	reader *strings.Reader
+	delay  time.Duration
+}
+
+func (reader slowReader) Read(p []byte) (int, error) {
+	time.Sleep(reader.delay)
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	return reader.reader.Read(p[:1])
+}
+
+// Close will simply nop.
+func (reader slowReader) Close() error {
+	return nil
+}
+
+// fixedWalker walks a fixed list of items, in order.
+type fixedWalker struct {
+	items []pathedData
+}
+
+// Walk passes each of the walker's items to process, ignoring root.
+func (walker fixedWalker) Walk(root string, process func(reader pathedData) error) error {
+	for _, item := range walker.items {
+		err := process(item)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type stallTest struct {
+	name string
+	test func(t *testing.T)
+}
+
+func runStallTestTable(t *testing.T, table []stallTest) {
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t)
+		})
+	}
+}
+
+func TestHashData_StallTimeout(t *testing.T) {
+	tests := []stallTest{
+		{
+			name: "stalled read",
+			test: func(t *testing.T) {
+				reader := stuckReader{release: make(chan struct{})}
+				defer close(reader.release)
+				_, err := hashData(context.Background(), pathedData{path: "a", data: reader}, sha256.New, RetryPolicy{}, 10*time.Millisecond)
+				pathErr := &PathError{}
+				if assert.True(t, xerrors.As(err, &pathErr)) {
+					assert.Equal(t, "a", pathErr.Path)
+					assert.Equal(t, PhaseRead, pathErr.Phase)
+					assert.True(t, xerrors.Is(err, ErrStalled))
+				}
+			},
+		},
+		{
+			name: "slow but steady read",
+			test: func(t *testing.T) {
+				// The whole file takes far longer than the timeout to read, but data keeps arriving.
+				reader := slowReader{reader: strings.NewReader("hello world"), delay: 5 * time.Millisecond}
+				outHash, err := hashData(context.Background(), pathedData{path: "a", data: reader}, sha256.New, RetryPolicy{}, 25*time.Millisecond)
+				if assert.Nil(t, err) {
+					// sha256 of "hello world"
+					assert.Equal(t, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", hex.EncodeToString(outHash.Sum(nil)))
+				}
+			},
+		},
+		{
+			name: "no timeout",
+			test: func(t *testing.T) {
+				reader := slowReader{reader: strings.NewReader("hello world"), delay: time.Millisecond}
+				outHash, err := hashData(context.Background(), pathedData{path: "a", data: reader}, sha256.New, RetryPolicy{}, 0)
+				if assert.Nil(t, err) {
+					assert.Equal(t, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", hex.EncodeToString(outHash.Sum(nil)))
+				}
+			},
+		},
+		{
+			name: "stalled file does not hold up the pool",
+			test: func(t *testing.T) {
+				stuck := stuckReader{release: make(chan struct{})}
+				defer close(stuck.release)
+				walker := fixedWalker{items: []pathedData{
+					{path: "stuck", data: stuck},
+					{path: "fine", data: &closableStringReader{Reader: strings.NewReader("hello world")}},
+				}}
+
+				hasher := makeParallelHashWalker(1, walker, sha256.New,
+					ParallelWalkHasherErrorPolicy(ErrorPolicy{KeepGoing: true}),
+					ParallelWalkHasherStallTimeout(10*time.Millisecond),
+				)
+
+				hashes, err := hasher.WalkAndHash("/")
+				assert.Contains(t, hashes, "fine")
+				assert.NotContains(t, hashes, "stuck")
+				if assert.IsType(t, &multierror.MultiError{}, err) {
+					assert.Equal(t, 1, err.(*multierror.MultiError).Len())
+					assert.True(t, xerrors.Is(err, ErrStalled))
+				}
+			},
+		},
+	}
+
+	runStallTestTable(t, tests)
+}
@@ -17,29 +17,44 @@ package hashlink
 */
 
 import (
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
-
-	"golang.org/x/xerrors"
+	"strings"
 )
 
+// ErrOutsideRoot is returned when a file given to a WalkHasher through a file list is not within the root it walks.
+var ErrOutsideRoot = errors.New("path is outside of root")
+
 // pathedData represents a some kind of data that has an associated filesystem path
 type pathedData struct {
 	path string
 	data io.ReadCloser
+	// err holds why the path could not be walked, if it could not be. Such data cannot be opened.
+	err error
 }
 
 type pathWalker interface {
-	// Walk takes a path and a function to process the file as an io.Reader.
+	// Walk takes a path and a function to process the file as an io.Reader. Paths within root that cannot be walked
+	// are passed to process with their error, rather than stopping the walk.
 	Walk(root string, process func(reader pathedData) error) error
 }
 
 // fileWalker will only walk regular files
 type fileWalker struct{}
 
+// listWalker will only walk the regular files in a fixed list of paths, rather than walking a tree.
+type listWalker struct {
+	paths []string
+}
+
 // open will open the data at the path if needed.
 func (data pathedData) open() (io.ReadCloser, error) {
+	if data.err != nil {
+		return nil, data.err
+	}
+
 	// If we've already opened the file, don't re-open it
 	if data.data != nil {
 		return data.data, nil
@@ -47,8 +62,7 @@ func (data pathedData) open() (io.ReadCloser, error) {
 
 	openedFile, err := os.Open(data.path)
 	if err != nil {
-		err = xerrors.Errorf("could not open file (%s): %w", data.path, err)
-		return nil, err
+		return nil, &PathError{Path: data.path, Phase: PhaseOpen, Err: err}
 	}
 
 	data.data = openedFile
@@ -56,11 +70,16 @@ func (data pathedData) open() (io.ReadCloser, error) {
 	return openedFile, nil
 }
 
-// Walk acts as a simple wrapper for filepath.Walk, only processing regular files.
+// Walk acts as a simple wrapper for filepath.Walk, only processing regular files. Unreadable directories and entries
+// that vanish during the walk are processed as errors, and skipped.
 func (walker fileWalker) Walk(path string, process func(reader pathedData) error) error {
 	return filepath.Walk(path, func(walkedPath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return xerrors.Errorf("could not walk: %w", err)
+		// If we can't even walk the root, there's nothing we can walk.
+		if err != nil && walkedPath == path {
+			return &PathError{Path: walkedPath, Phase: PhaseWalk, Err: err}
+		} else if err != nil {
+			// filepath.Walk will not descend into a directory that we have been given an error for.
+			return process(pathedData{path: walkedPath, err: &PathError{Path: walkedPath, Phase: PhaseWalk, Err: err}})
 		}
 
 		// If we don't have a regular file, continue
@@ -72,6 +91,45 @@ func (walker fileWalker) Walk(path string, process func(reader pathedData) error
 	})
 }
 
+// Walk processes each of the walker's paths that is a regular file. Every path must be within root.
+func (walker listWalker) Walk(root string, process func(reader pathedData) error) error {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return &PathError{Path: root, Phase: PhaseWalk, Err: err}
+	}
+
+	for _, path := range walker.paths {
+		// Compare absolute paths, so that relative paths may be listed under an absolute root, and vice versa.
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return &PathError{Path: path, Phase: PhaseWalk, Err: err}
+		}
+
+		relPath, err := filepath.Rel(absRoot, absPath)
+		if err != nil {
+			return &PathError{Path: path, Phase: PhaseWalk, Err: err}
+		} else if relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			return &PathError{Path: path, Phase: PhaseWalk, Err: ErrOutsideRoot}
+		}
+
+		data := pathedData{path: path}
+		info, err := os.Lstat(path)
+		if err != nil {
+			data.err = &PathError{Path: path, Phase: PhaseWalk, Err: err}
+		} else if !info.Mode().IsRegular() {
+			// If we don't have a regular file, continue
+			continue
+		}
+
+		err = process(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // getAllItemsFromWalker gets every item that the given pathWalker would pass to its callback.
 func getAllItemsFromWalker(walker pathWalker, path string) ([]pathedData, error) {
 	result := make([]pathedData, 0)
@@ -17,10 +17,14 @@ package hashlink
 */
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
 )
 
 // closableStringReader serves as a wrapper for *strings.Reader to allow it to implement the io.ReadCloser interface
@@ -118,3 +122,124 @@ func TestGetAllItemsFromWalker(t *testing.T) {
 
 	runWalkTestTable(t, tests)
 }
+
+func TestListWalker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashlink-walk")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a"), []byte("hello"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "b"), []byte("world"), 0644))
+
+	tests := []walkTest{
+		{
+			name: "only listed regular files",
+			setup: func() pathWalker {
+				return listWalker{paths: []string{filepath.Join(dir, "a"), filepath.Join(dir, "sub")}}
+			},
+			test: func(t *testing.T, walker pathWalker) {
+				result, err := getAllItemsFromWalker(walker, dir)
+				assert.Nil(t, err)
+				assert.Equal(t, []pathedData{{path: filepath.Join(dir, "a")}}, result)
+			},
+		},
+		{
+			name: "relative paths under an absolute root",
+			setup: func() pathWalker {
+				workingDir, err := os.Getwd()
+				assert.Nil(t, err)
+				relPath, err := filepath.Rel(workingDir, filepath.Join(dir, "b"))
+				assert.Nil(t, err)
+
+				return listWalker{paths: []string{relPath}}
+			},
+			test: func(t *testing.T, walker pathWalker) {
+				result, err := getAllItemsFromWalker(walker, dir)
+				assert.Nil(t, err)
+				// Listed paths should be passed along exactly as they were given.
+				assert.Equal(t, []pathedData{{path: walker.(listWalker).paths[0]}}, result)
+			},
+		},
+		{
+			name: "missing file",
+			setup: func() pathWalker {
+				return listWalker{paths: []string{filepath.Join(dir, "missing")}}
+			},
+			test: func(t *testing.T, walker pathWalker) {
+				result, err := getAllItemsFromWalker(walker, dir)
+				assert.Nil(t, err)
+				if assert.Equal(t, 1, len(result)) {
+					assert.Equal(t, filepath.Join(dir, "missing"), result[0].path)
+					assert.True(t, xerrors.Is(result[0].err, os.ErrNotExist))
+					assert.Equal(t, PhaseWalk, result[0].err.(*PathError).Phase)
+				}
+			},
+		},
+		{
+			name: "outside of root",
+			setup: func() pathWalker {
+				return listWalker{paths: []string{filepath.Join(dir, "a")}}
+			},
+			test: func(t *testing.T, walker pathWalker) {
+				_, err := getAllItemsFromWalker(walker, filepath.Join(dir, "sub"))
+				assert.True(t, xerrors.Is(err, ErrOutsideRoot))
+			},
+		},
+	}
+
+	runWalkTestTable(t, tests)
+}
+
+func TestFileWalker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashlink-walk")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "locked"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "locked", "a"), []byte("hello"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "b"), []byte("world"), 0644))
+
+	tests := []walkTest{
+		{
+			name: "unreadable directory",
+			setup: func() pathWalker {
+				assert.Nil(t, os.Chmod(filepath.Join(dir, "locked"), 0))
+
+				return fileWalker{}
+			},
+			test: func(t *testing.T, walker pathWalker) {
+				defer os.Chmod(filepath.Join(dir, "locked"), 0755)
+				if os.Geteuid() == 0 {
+					t.Skip("permissions are not enforced for root")
+				}
+
+				result, err := getAllItemsFromWalker(walker, dir)
+				assert.Nil(t, err)
+				if assert.Equal(t, 2, len(result)) {
+					// filepath.Walk walks in lexical order
+					assert.Equal(t, filepath.Join(dir, "b"), result[0].path)
+					assert.Nil(t, result[0].err)
+					assert.Equal(t, filepath.Join(dir, "locked"), result[1].path)
+					assert.True(t, xerrors.Is(result[1].err, os.ErrPermission))
+				}
+			},
+		},
+		{
+			name: "missing root",
+			setup: func() pathWalker {
+				return fileWalker{}
+			},
+			test: func(t *testing.T, walker pathWalker) {
+				_, err := getAllItemsFromWalker(walker, filepath.Join(dir, "missing"))
+				assert.True(t, xerrors.Is(err, os.ErrNotExist))
+			},
+		},
+	}
+
+	runWalkTestTable(t, tests)
+}